@@ -0,0 +1,122 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netstack
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// KeepAlive configures the TCP keepalives of connections.
+type KeepAlive struct {
+	// The time a connection has to be idle before
+	// the first keepalive is sent.
+	Idle time.Duration
+
+	// The interval between keepalives.
+	Interval time.Duration
+
+	// The number of unanswered keepalives after
+	// which the connection is closed.
+	Count int
+}
+
+// keepAliveListener is a TCP listener that enables keepalives on the
+// connections it accepts. The stack doesn't have a default for them,
+// and accepted endpoints don't inherit them from the listener.
+type keepAliveListener struct {
+	*gonet.TCPListener
+	ep        tcpip.Endpoint
+	wq        *waiter.Queue
+	keepAlive KeepAlive
+}
+
+// ListenTCPKeepAlive is like ListenTCP, but enables
+// keepalives on the connections it accepts.
+func (net *Net) ListenTCPKeepAlive(addr *net.TCPAddr, keepAlive KeepAlive) (net.Listener, error) {
+	if addr == nil {
+		panic("todo: deal with auto addr semantics for nil addr")
+	}
+	fa, pn := convertToFullAddr(addr.IP, addr.Port)
+
+	var wq waiter.Queue
+	ep, tcpErr := net.stack.NewEndpoint(tcp.ProtocolNumber, pn, &wq)
+	if tcpErr != nil {
+		return nil, errors.New(tcpErr.String())
+	}
+	if tcpErr := ep.Bind(fa); tcpErr != nil {
+		ep.Close()
+		return nil, errors.New(tcpErr.String())
+	}
+	if tcpErr := ep.Listen(10); tcpErr != nil {
+		ep.Close()
+		return nil, errors.New(tcpErr.String())
+	}
+
+	return &keepAliveListener{
+		TCPListener: gonet.NewTCPListener(net.stack, &wq, ep),
+		ep:          ep,
+		wq:          &wq,
+		keepAlive:   keepAlive,
+	}, nil
+}
+
+// Accept waits for the next connection and enables keepalives on it.
+// It returns an error when the listener is closed.
+func (l *keepAliveListener) Accept() (net.Conn, error) {
+	n, wq, tcpErr := l.ep.Accept(nil)
+	if _, ok := tcpErr.(*tcpip.ErrWouldBlock); ok {
+		waitEntry, notifyCh := waiter.NewChannelEntry(waiter.ReadableEvents)
+		l.wq.EventRegister(&waitEntry)
+		defer l.wq.EventUnregister(&waitEntry)
+
+		for {
+			n, wq, tcpErr = l.ep.Accept(nil)
+			if _, ok := tcpErr.(*tcpip.ErrWouldBlock); !ok {
+				break
+			}
+			<-notifyCh
+		}
+	}
+	if tcpErr != nil {
+		return nil, &net.OpError{
+			Op:   "accept",
+			Net:  "tcp",
+			Addr: l.Addr(),
+			Err:  errors.New(tcpErr.String()),
+		}
+	}
+
+	n.SocketOptions().SetKeepAlive(true)
+	if l.keepAlive.Idle > 0 {
+		idle := tcpip.KeepaliveIdleOption(l.keepAlive.Idle)
+		n.SetSockOpt(&idle)
+	}
+	if l.keepAlive.Interval > 0 {
+		interval := tcpip.KeepaliveIntervalOption(l.keepAlive.Interval)
+		n.SetSockOpt(&interval)
+	}
+	if l.keepAlive.Count > 0 {
+		n.SetSockOptInt(tcpip.KeepaliveCountOption, l.keepAlive.Count)
+	}
+
+	return gonet.NewTCPConn(wq, n), nil
+}
@@ -0,0 +1,184 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wgtest
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// channelQueueLen is the number of datagrams that can be queued for
+// a ChannelBind. Datagrams are dropped when the queue is full, like
+// they would be by a UDP socket.
+const channelQueueLen = 1024
+
+// bindCount numbers the addresses of the binds.
+var bindCount uint32
+
+// ChannelBind is a conn.Bind that exchanges datagrams in memory, over
+// channels, with the binds that it is paired with. It lets WireGuard
+// devices in the same process talk to each other without sockets.
+type ChannelBind struct {
+	addr string
+	rx   chan datagram
+
+	mu     sync.Mutex
+	peers  map[string]*ChannelBind
+	closed chan struct{} // nil when the bind isn't open
+}
+
+// datagram is a datagram that a bind received, with the bind it came from.
+type datagram struct {
+	data []byte
+	from *ChannelBind
+}
+
+// NewBindPair returns two binds that are paired with each other.
+func NewBindPair() (*ChannelBind, *ChannelBind) {
+	a := newChannelBind()
+	return a, a.Pair()
+}
+
+func newChannelBind() *ChannelBind {
+	return &ChannelBind{
+		addr:  fmt.Sprintf("memory:%d", atomic.AddUint32(&bindCount, 1)),
+		rx:    make(chan datagram, channelQueueLen),
+		peers: make(map[string]*ChannelBind),
+	}
+}
+
+// Pair returns a new bind that is paired with b, so that
+// a device can have more than one peer in memory.
+func (b *ChannelBind) Pair() *ChannelBind {
+	p := newChannelBind()
+	b.connect(p)
+	p.connect(b)
+	return p
+}
+
+func (b *ChannelBind) connect(p *ChannelBind) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.peers[p.addr] = p
+}
+
+// Addr returns the address of the bind, which is the
+// endpoint of the bind for the devices of its peers.
+func (b *ChannelBind) Addr() string {
+	return b.addr
+}
+
+// Open opens the bind. The port is only reported back.
+func (b *ChannelBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+	closed := make(chan struct{})
+	b.closed = closed
+	receive := func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		select {
+		case d := <-b.rx:
+			sizes[0] = copy(packets[0], d.data)
+			eps[0] = channelEndpoint{d.from}
+			return 1, nil
+		case <-closed:
+			return 0, net.ErrClosed
+		}
+	}
+	return []conn.ReceiveFunc{receive}, port, nil
+}
+
+// Close closes the bind. Datagrams sent to a closed bind are dropped.
+func (b *ChannelBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed != nil {
+		close(b.closed)
+		b.closed = nil
+	}
+	return nil
+}
+
+// SetMark does nothing, as there are no sockets to mark.
+func (b *ChannelBind) SetMark(mark uint32) error {
+	return nil
+}
+
+// Send sends the datagrams to the bind of ep.
+func (b *ChannelBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	e, ok := ep.(channelEndpoint)
+	if !ok {
+		return conn.ErrWrongEndpointType
+	}
+	for _, buf := range bufs {
+		e.bind.deliver(datagram{data: append([]byte(nil), buf...), from: b})
+	}
+	return nil
+}
+
+// deliver queues d, or drops it when the bind is closed or its queue is full.
+func (b *ChannelBind) deliver(d datagram) {
+	b.mu.Lock()
+	open := b.closed != nil
+	b.mu.Unlock()
+	if !open {
+		return
+	}
+	select {
+	case b.rx <- d:
+	default:
+	}
+}
+
+// ParseEndpoint returns the endpoint of the paired bind with address s.
+func (b *ChannelBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p, ok := b.peers[s]
+	if !ok {
+		return nil, fmt.Errorf("no bind paired at %s", s)
+	}
+	return channelEndpoint{p}, nil
+}
+
+// BatchSize returns the number of datagrams that are received at once.
+func (b *ChannelBind) BatchSize() int {
+	return 1
+}
+
+// channelEndpoint is the endpoint of a paired bind.
+type channelEndpoint struct {
+	bind *ChannelBind
+}
+
+func (e channelEndpoint) ClearSrc()           {}
+func (e channelEndpoint) SrcToString() string { return "" }
+func (e channelEndpoint) DstToString() string { return e.bind.addr }
+func (e channelEndpoint) DstToBytes() []byte  { return []byte(e.bind.addr) }
+func (e channelEndpoint) DstIP() netip.Addr   { return netip.Addr{} }
+func (e channelEndpoint) SrcIP() netip.Addr   { return netip.Addr{} }
+
+// Interface guards
+var (
+	_ conn.Bind     = (*ChannelBind)(nil)
+	_ conn.Endpoint = channelEndpoint{}
+)
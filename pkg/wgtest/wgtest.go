@@ -0,0 +1,243 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package wgtest runs the WireGuard app and a peer that is connected
+// to it in the same process, for end-to-end tests of what is served
+// on the tunnel.
+//
+// The devices exchange their datagrams in memory, with the binds of
+// NewBindPair, so the harness doesn't use any sockets for WireGuard.
+package wgtest
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"golang.zx2c4.com/wireguard/device"
+
+	// the storage module of the harness
+	_ "github.com/caddyserver/caddy/v2/modules/filestorage"
+
+	"github.com/hslatman/caddy-wireguard/pkg/netstack"
+	"github.com/hslatman/caddy-wireguard/pkg/wireguard"
+)
+
+// bindName is the name under which the bind of the app is registered.
+const bindName = "wgtest"
+
+// The tunnel addresses of the app and the peer.
+var (
+	ServerIP = net.IPv4(10, 99, 0, 1)
+	PeerIP   = net.IPv4(10, 99, 0, 2)
+)
+
+// Config configures the harness.
+type Config struct {
+	// The config of the Caddy HTTP app, whose servers are served on
+	// the tunnel. The servers listen on the host as well, so they
+	// should listen on a loopback address, like 127.0.0.1:8080.
+	HTTP json.RawMessage
+
+	// Changes the config of the WireGuard app before it is loaded,
+	// like configuring a hub or a firewall. The app has the peer of
+	// the harness as its first peer.
+	WireGuard func(*wireguard.WireGuard)
+}
+
+// Harness is a running WireGuard app with a peer that is connected to
+// it. Caddy only runs a single config per process, so only one harness
+// can run at a time.
+type Harness struct {
+	// The netstack of the peer, to dial the app through the tunnel.
+	Peer *netstack.Net
+
+	// The keys of the app and of the peer.
+	ServerPublicKey string
+	PeerPublicKey   string
+
+	bind *ChannelBind
+	devs []*device.Device
+	dir  string
+}
+
+// Start loads the WireGuard app and the HTTP app with Caddy, and
+// connects a peer to it. The harness has to be closed when done.
+func Start(config Config) (*Harness, error) {
+	serverKey, serverPublicKey, err := wireguard.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	peerKey, peerPublicKey, err := wireguard.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "wgtest")
+	if err != nil {
+		return nil, fmt.Errorf("creating storage directory: %v", err)
+	}
+	h := &Harness{
+		ServerPublicKey: serverPublicKey,
+		PeerPublicKey:   peerPublicKey,
+		bind:            newChannelBind(),
+		dir:             dir,
+	}
+	wireguard.RegisterBind(bindName, h.bind)
+
+	app := &wireguard.WireGuard{
+		PrivateKey: serverKey,
+		Bind:       bindName,
+		Addresses:  []string{ServerIP.String()},
+		DNS:        []string{ServerIP.String()},
+		Peers: []*wireguard.Peer{{
+			PublicKey:  peerPublicKey,
+			AllowedIPs: []string{PeerIP.String() + "/32"},
+		}},
+	}
+	if config.WireGuard != nil {
+		config.WireGuard(app)
+	}
+	if err := h.loadCaddy(app, config.HTTP); err != nil {
+		h.Close()
+		return nil, err
+	}
+	if h.Peer, err = h.Connect(peerKey, PeerIP); err != nil {
+		h.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// loadCaddy runs the apps with Caddy, with the storage in
+// the directory of the harness and the admin API disabled.
+func (h *Harness) loadCaddy(app *wireguard.WireGuard, httpApp json.RawMessage) error {
+	if httpApp == nil {
+		httpApp = json.RawMessage(`{}`)
+	}
+	storage, err := json.Marshal(map[string]string{"module": "file_system", "root": h.dir})
+	if err != nil {
+		return err
+	}
+	appJSON, err := json.Marshal(app)
+	if err != nil {
+		return fmt.Errorf("encoding WireGuard app: %v", err)
+	}
+	cfg := caddy.Config{
+		Admin:      &caddy.AdminConfig{Disabled: true},
+		StorageRaw: storage,
+		AppsRaw: caddy.ModuleMap{
+			"wireguard": appJSON,
+			"http":      httpApp,
+		},
+	}
+	cfgJSON, err := json.Marshal(cfg)
+	if err != nil {
+		return fmt.Errorf("encoding config: %v", err)
+	}
+	if err := caddy.Load(cfgJSON, true); err != nil {
+		return fmt.Errorf("loading config: %v", err)
+	}
+	return nil
+}
+
+// Connect starts the device of another peer of the app, with the
+// private key and the tunnel address ip, like a peer that enrolled.
+// The peer only routes the tunnel address of the app. It returns
+// the netstack of the peer, to dial the app through the tunnel.
+func (h *Harness) Connect(privateKey string, ip net.IP) (*netstack.Net, error) {
+	tun, tnet, err := netstack.CreateNetTUN([]net.IP{ip}, []net.IP{ServerIP}, 1420)
+	if err != nil {
+		return nil, fmt.Errorf("creating netstack: %v", err)
+	}
+	privateKeyHex, err := uapiKey(privateKey)
+	if err != nil {
+		tun.Close()
+		return nil, err
+	}
+	serverKeyHex, err := uapiKey(h.ServerPublicKey)
+	if err != nil {
+		tun.Close()
+		return nil, err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "private_key=%s\n", privateKeyHex)
+	fmt.Fprintf(&b, "public_key=%s\n", serverKeyHex)
+	fmt.Fprintf(&b, "endpoint=%s\n", h.bind.Addr())
+	fmt.Fprintf(&b, "allowed_ip=%s/32\n", ServerIP)
+
+	logger := log.New(os.Stderr, "wgtest: ", log.LstdFlags)
+	dev := device.NewDevice(tun, h.bind.Pair(), &device.Logger{Verbosef: device.DiscardLogf, Errorf: logger.Printf})
+	if err := dev.IpcSet(b.String()); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("configuring peer device: %v", err)
+	}
+	if err := dev.Up(); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("starting peer device: %v", err)
+	}
+	h.devs = append(h.devs, dev)
+	return tnet, nil
+}
+
+// HTTPClient returns an HTTP client that connects through the tunnel,
+// to the tunnel address of the app or any other address it routes.
+func (h *Harness) HTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return h.Peer.DialContext(ctx, network, address)
+			},
+		},
+	}
+}
+
+// Storage returns the storage of the app, like
+// for creating enrollment tokens.
+func (h *Harness) Storage() certmagic.Storage {
+	return &certmagic.FileStorage{Path: h.dir}
+}
+
+// Close stops Caddy and the peers, and removes the storage.
+func (h *Harness) Close() error {
+	for _, dev := range h.devs {
+		dev.Close()
+	}
+	err := caddy.Stop()
+	wireguard.UnregisterBind(bindName)
+	if rmErr := os.RemoveAll(h.dir); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// uapiKey converts a base64 encoded key into the hex encoding of the UAPI.
+func uapiKey(key string) (string, error) {
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", fmt.Errorf("invalid key: %v", err)
+	}
+	return hex.EncodeToString(k), nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wgtest
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+func TestChannelBind(t *testing.T) {
+	a, b := NewBindPair()
+	fnsA, _, err := a.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if _, _, err := b.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.Open(0); err != conn.ErrBindAlreadyOpen {
+		t.Fatalf("opening twice: got %v, want %v", err, conn.ErrBindAlreadyOpen)
+	}
+
+	ep, err := b.ParseEndpoint(a.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Send([][]byte{[]byte("hello")}, ep); err != nil {
+		t.Fatal(err)
+	}
+
+	packets := [][]byte{make([]byte, 64)}
+	sizes := make([]int, 1)
+	eps := make([]conn.Endpoint, 1)
+	n, err := fnsA[0](packets, sizes, eps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || !bytes.Equal(packets[0][:sizes[0]], []byte("hello")) {
+		t.Fatalf("got %q, want %q", packets[0][:sizes[0]], "hello")
+	}
+	if got := eps[0].DstToString(); got != b.Addr() {
+		t.Errorf("endpoint = %s, want %s", got, b.Addr())
+	}
+
+	// datagrams for a closed bind are dropped
+	b.Close()
+	if err := a.Send([][]byte{[]byte("dropped")}, eps[0]); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.rx) != 0 {
+		t.Errorf("closed bind queued %d datagrams", len(b.rx))
+	}
+
+	a.Close()
+	if _, err := fnsA[0](packets, sizes, eps); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("receiving after close: got %v, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestHarness(t *testing.T) {
+	h, err := Start(Config{
+		HTTP: []byte(`{"servers": {"test": {
+			"listen": ["127.0.0.1:23801"],
+			"automatic_https": {"disable": true},
+			"routes": [{"handle": [{"handler": "static_response", "body": "{http.request.remote.host}"}]}]
+		}}}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	client := h.HTTPClient()
+	client.Timeout = 10 * time.Second
+	resp, err := client.Get("http://" + ServerIP.String() + ":23801/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(body); got != PeerIP.String() {
+		t.Errorf("remote host = %s, want %s", got, PeerIP)
+	}
+}
@@ -0,0 +1,500 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// adminAPI is a module that serves the WireGuard endpoints of the admin API.
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.wireguard",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes returns the admin routes for the WireGuard app.
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/wireguard/client-config",
+			Handler: caddy.AdminHandlerFunc(a.handleClientConfig),
+		},
+		{
+			Pattern: "/wireguard/peers",
+			Handler: caddy.AdminHandlerFunc(a.handlePeers),
+		},
+		{
+			Pattern: "/wireguard/enroll-tokens",
+			Handler: caddy.AdminHandlerFunc(a.handleEnrollTokens),
+		},
+		{
+			Pattern: "/wireguard/firewall",
+			Handler: caddy.AdminHandlerFunc(a.handleFirewall),
+		},
+		{
+			Pattern: "/wireguard/traffic",
+			Handler: caddy.AdminHandlerFunc(a.handleTraffic),
+		},
+		{
+			Pattern: "/wireguard/ping",
+			Handler: caddy.AdminHandlerFunc(a.handlePing),
+		},
+		{
+			Pattern: "/wireguard/tls-ask",
+			Handler: caddy.AdminHandlerFunc(a.handleTLSAsk),
+		},
+		{
+			Pattern: "/wireguard/capture",
+			Handler: caddy.AdminHandlerFunc(a.handleCapture),
+		},
+		{
+			Pattern: "/wireguard/key-rotation",
+			Handler: caddy.AdminHandlerFunc(a.handleKeyRotation),
+		},
+	}
+}
+
+// handleClientConfig returns the client configuration of the peer with
+// the public key given in the query. The format query parameter selects
+// between the plain configuration (conf), a PNG QR code (png) and a QR
+// code rendered for terminals (terminal). With next=true, the
+// configuration has the keys that were published for the next key
+// rotation.
+func (adminAPI) handleClientConfig(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	app, err := runningApp()
+	if err != nil {
+		return err
+	}
+
+	publicKey := r.URL.Query().Get("public_key")
+	p := app.peer(publicKey)
+	if p == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("unknown peer: %s", publicKey),
+		}
+	}
+
+	if p.PrivateKey == "" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("private key of peer %s is unknown", publicKey),
+		}
+	}
+
+	var config string
+	if r.URL.Query().Get("next") == "true" {
+		config, err = app.nextClientConfig(p)
+	} else {
+		config, err = app.clientConfig(p)
+	}
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        err,
+		}
+	}
+
+	format := r.URL.Query().Get("format")
+	body, err := renderClientConfig(config, format)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        err,
+		}
+	}
+
+	if format == formatPNG {
+		w.Header().Set("Content-Type", "image/png")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+// handleEnrollTokens creates a one-time token for the enrollment
+// handler. The optional ttl query parameter sets when the token
+// expires.
+func (adminAPI) handleEnrollTokens(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	app, err := runningApp()
+	if err != nil {
+		return err
+	}
+
+	var ttl time.Duration
+	if s := r.URL.Query().Get("ttl"); s != "" {
+		ttl, err = caddy.ParseDuration(s)
+		if err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("invalid ttl: %v", err),
+			}
+		}
+	}
+
+	token, err := createEnrollToken(app.ctx, app.ctx.Storage(), ttl)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(map[string]string{"token": token})
+}
+
+// handlePeers returns the peers of the app, without the peers that
+// have expired.
+func (adminAPI) handlePeers(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	app, err := runningApp()
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(app.peerInfos(time.Now()))
+}
+
+// handleFirewall returns the firewall rules with their counters.
+func (adminAPI) handleFirewall(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	app, err := runningApp()
+	if err != nil {
+		return err
+	}
+
+	if app.Firewall == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("firewall not configured"),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(app.Firewall.stats())
+}
+
+// handleTraffic returns the cumulative traffic of the peers.
+func (adminAPI) handleTraffic(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	app, err := runningApp()
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(app.traffic())
+}
+
+// handleKeyRotation returns the schedule of the key rotation
+// and the public key that was published for the next rotation.
+func (adminAPI) handleKeyRotation(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	app, err := runningApp()
+	if err != nil {
+		return err
+	}
+
+	status, err := app.keyRotationStatus()
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(status)
+}
+
+// handlePing sends echo requests through the tunnel to the address
+// in the ip query parameter, or to the first address of the peer with
+// the public key in the public_key query parameter. The optional count
+// query parameter sets the number of echo requests.
+func (adminAPI) handlePing(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	app, err := runningApp()
+	if err != nil {
+		return err
+	}
+
+	query := r.URL.Query()
+	var ip net.IP
+	switch {
+	case query.Get("ip") != "":
+		ip = net.ParseIP(query.Get("ip"))
+		if ip == nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("invalid ip: %s", query.Get("ip")),
+			}
+		}
+	case query.Get("public_key") != "":
+		publicKey := query.Get("public_key")
+		p := app.peer(publicKey)
+		if p == nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusNotFound,
+				Err:        fmt.Errorf("unknown peer: %s", publicKey),
+			}
+		}
+		ips, err := parsePrefixIPs(p.addresses())
+		if err != nil || len(ips) == 0 {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("peer %s has no tunnel address", publicKey),
+			}
+		}
+		ip = ips[0]
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("ip or public_key is required"),
+		}
+	}
+
+	count := defaultPingCount
+	if s := query.Get("count"); s != "" {
+		count, err = strconv.Atoi(s)
+		if err != nil || count < 1 || count > maxPingCount {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("count must be between 1 and %d", maxPingCount),
+			}
+		}
+	}
+
+	result, err := app.ping(r.Context(), ip, count)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(result)
+}
+
+// handleTLSAsk is meant to be the ask URL of on-demand TLS for
+// published peers. It allows a certificate for the domain query
+// parameter when a wireguard_publish handler publishes a peer at it.
+// The optional suffix query parameter restricts the rest of the
+// domain, like tunnels.example.com.
+func (adminAPI) handleTLSAsk(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	app, err := runningApp()
+	if err != nil {
+		return err
+	}
+
+	query := r.URL.Query()
+	domain := strings.ToLower(strings.TrimSuffix(query.Get("domain"), "."))
+	parts := strings.SplitN(domain, ".", 2)
+	if len(parts) != 2 {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("invalid domain: %s", domain),
+		}
+	}
+	suffix := strings.ToLower(strings.Trim(query.Get("suffix"), "."))
+	if suffix != "" && parts[1] != suffix {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("domain %s is not a subdomain of %s", domain, suffix),
+		}
+	}
+	if !published(app, domain) {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no published peer at %s", domain),
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// handleCapture streams the decrypted packets that are exchanged with
+// peers in the pcapng format. The optional duration query parameter
+// sets how long packets are captured, and the public_key and port
+// query parameters select the packets of a peer and of a TCP or UDP
+// port.
+func (adminAPI) handleCapture(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	app, err := runningApp()
+	if err != nil {
+		return err
+	}
+
+	query := r.URL.Query()
+	duration := defaultCaptureDuration
+	if s := query.Get("duration"); s != "" {
+		duration, err = caddy.ParseDuration(s)
+		if err != nil || duration <= 0 || duration > maxCaptureDuration {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("duration must be positive and at most %s", maxCaptureDuration),
+			}
+		}
+	}
+
+	var filter captureFilter
+	if publicKey := query.Get("public_key"); publicKey != "" {
+		p := app.peer(publicKey)
+		if p == nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusNotFound,
+				Err:        fmt.Errorf("unknown peer: %s", publicKey),
+			}
+		}
+		filter.nets = p.allowedNets
+	}
+	if s := query.Get("port"); s != "" {
+		port, err := strconv.ParseUint(s, 10, 16)
+		if err != nil || port == 0 {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("invalid port: %s", s),
+			}
+		}
+		filter.port = uint16(port)
+	}
+
+	c := app.startCapture(filter)
+	defer app.stopCapture(c)
+
+	w.Header().Set("Content-Type", "application/x-pcapng")
+	w.Header().Set("Content-Disposition", `attachment; filename="wireguard.pcapng"`)
+	pw, err := newPcapngWriter(w, "wireguard", maxPacketSize)
+	if err != nil {
+		return nil
+	}
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return nil
+		case <-r.Context().Done():
+			return nil
+		case p := <-c.packets:
+			// the response has started, so errors
+			// can't be reported to the client anymore
+			if err := pw.writePacket(p.time, p.data, len(p.data), p.outbound); err != nil {
+				return nil
+			}
+			if flusher != nil && len(c.packets) == 0 {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// runningApp returns the WireGuard app that is currently running.
+func runningApp() (*WireGuard, error) {
+	app := running()
+	if app == nil {
+		return nil, caddy.APIError{
+			HTTPStatus: http.StatusServiceUnavailable,
+			Err:        fmt.Errorf("WireGuard app is not running"),
+		}
+	}
+	return app, nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module      = (*adminAPI)(nil)
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
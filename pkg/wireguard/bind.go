@@ -0,0 +1,310 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// binds are the Binds registered by programs that embed Caddy, by name.
+var (
+	bindsMu sync.Mutex
+	binds   = make(map[string]conn.Bind)
+)
+
+// RegisterBind registers b under name, so that the app uses it for the
+// datagrams of the device instead of UDP sockets when its bind is set
+// to name. This is meant for programs that embed Caddy, like tests that
+// connect the device to a peer in memory with the wgtest package.
+func RegisterBind(name string, b conn.Bind) {
+	bindsMu.Lock()
+	defer bindsMu.Unlock()
+	binds[name] = b
+}
+
+// UnregisterBind removes the Bind registered under name.
+func UnregisterBind(name string) {
+	bindsMu.Lock()
+	defer bindsMu.Unlock()
+	delete(binds, name)
+}
+
+// registeredBind returns the Bind registered under name.
+func registeredBind(name string) (conn.Bind, error) {
+	bindsMu.Lock()
+	defer bindsMu.Unlock()
+	b, ok := binds[name]
+	if !ok {
+		return nil, fmt.Errorf("no bind registered as %q", name)
+	}
+	return b, nil
+}
+
+// newBind returns the Bind of the device, which sends and receives
+// the datagrams of the device on UDP sockets on the listen addresses,
+// or on the listen port on all interfaces by default.
+func (w *WireGuard) newBind() (conn.Bind, error) {
+	if w.Bind != "" {
+		return registeredBind(w.Bind)
+	}
+	if len(w.Listen) > 0 {
+		return newListenBind(w.Listen), nil
+	}
+	return conn.NewStdNetBind(), nil
+}
+
+// transportQueueLen is the number of datagrams received by the
+// transports of the app that can be queued for the device.
+const transportQueueLen = 1024
+
+// appBind is the Bind of the device. It sends and receives datagrams
+// through a base Bind, which are the UDP sockets of the device by
+// default, and through the transports of the app, like WebSockets.
+// The transports deliver the datagrams that they receive to the
+// device with an endpoint of their own, on which the device sends
+// its answers, so that no sockets are needed to relay them.
+type appBind struct {
+	base     conn.Bind
+	incoming chan transportDatagram
+
+	mu        sync.Mutex
+	closed    chan struct{} // nil when the bind isn't open
+	endpoints map[string]*transportEndpoint
+	overlap   *overlapBind
+}
+
+// transportDatagram is a datagram received by a transport of the app.
+type transportDatagram struct {
+	data []byte
+	ep   *transportEndpoint
+}
+
+// newAppBind returns a Bind that wraps base.
+func newAppBind(base conn.Bind) *appBind {
+	return &appBind{
+		base:      base,
+		incoming:  make(chan transportDatagram, transportQueueLen),
+		endpoints: make(map[string]*transportEndpoint),
+	}
+}
+
+// Open opens the base Bind and receives the datagrams
+// of the transports as well.
+func (b *appBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+	fns, actualPort, err := b.base.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	closed := make(chan struct{})
+	b.closed = closed
+	fns = append(fns, b.receiveTransports(closed))
+	for i, fn := range fns {
+		fns[i] = b.splitOverlap(fn)
+	}
+	return fns, actualPort, nil
+}
+
+// splitOverlap returns a function that receives with fn and hands the
+// datagrams for the overlap device to it, during the overlap window
+// of a key rotation.
+func (b *appBind) splitOverlap(fn conn.ReceiveFunc) conn.ReceiveFunc {
+	return func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		for {
+			n, err := fn(packets, sizes, eps)
+			if err != nil || n == 0 {
+				return n, err
+			}
+			b.mu.Lock()
+			overlap := b.overlap
+			b.mu.Unlock()
+			if overlap == nil {
+				return n, nil
+			}
+			// the buffers belong to the device, so the
+			// datagrams that it keeps are moved into place
+			kept := 0
+			for i := 0; i < n; i++ {
+				msg := packets[i][:sizes[i]]
+				toOverlap, toApp := overlap.route(msg)
+				if toOverlap {
+					overlap.deliver(append([]byte(nil), msg...), eps[i])
+				}
+				if toApp {
+					if kept != i {
+						sizes[kept] = copy(packets[kept], msg)
+						eps[kept] = eps[i]
+					}
+					kept++
+				}
+			}
+			if kept > 0 {
+				return kept, nil
+			}
+		}
+	}
+}
+
+// setOverlap sets the Bind of the overlap device, which
+// is nil when there is no overlap device.
+func (b *appBind) setOverlap(overlap *overlapBind) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.overlap = overlap
+}
+
+// receiveTransports returns the function that receives
+// the datagrams of the transports until closed is closed.
+func (b *appBind) receiveTransports(closed chan struct{}) conn.ReceiveFunc {
+	return func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		var d transportDatagram
+		select {
+		case d = <-b.incoming:
+		case <-closed:
+			return 0, net.ErrClosed
+		}
+		n := 0
+		for {
+			sizes[n] = copy(packets[n], d.data)
+			eps[n] = d.ep
+			n++
+			if n == len(packets) {
+				return n, nil
+			}
+			select {
+			case d = <-b.incoming:
+			default:
+				return n, nil
+			}
+		}
+	}
+}
+
+// Close closes the base Bind. The datagrams of the
+// transports are dropped while the bind is closed.
+func (b *appBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed != nil {
+		close(b.closed)
+		b.closed = nil
+	}
+	return b.base.Close()
+}
+
+// SetMark sets the firewall mark on the base Bind.
+func (b *appBind) SetMark(mark uint32) error {
+	return b.base.SetMark(mark)
+}
+
+// Send sends the datagrams through the transport of the
+// endpoint, or through the base Bind for other endpoints.
+func (b *appBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	te, ok := ep.(*transportEndpoint)
+	if !ok {
+		return b.base.Send(bufs, ep)
+	}
+	for _, buf := range bufs {
+		if err := te.send(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseEndpoint returns the transport endpoint that was added under
+// s, like the URL of a WebSocket transport, or parses s as an
+// endpoint of the base Bind.
+func (b *appBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	b.mu.Lock()
+	ep, ok := b.endpoints[s]
+	b.mu.Unlock()
+	if ok {
+		return ep, nil
+	}
+	return b.base.ParseEndpoint(s)
+}
+
+// BatchSize returns the batch size of the base Bind.
+func (b *appBind) BatchSize() int {
+	return b.base.BatchSize()
+}
+
+// addEndpoint adds a transport endpoint that peers can be
+// configured with by name, like the endpoint of the relay
+// to a WebSocket transport in client mode.
+func (b *appBind) addEndpoint(name string, ep *transportEndpoint) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.endpoints[name] = ep
+}
+
+// deliver queues a datagram that a transport received on ep for the
+// device. The bind takes ownership of data. Datagrams are dropped
+// when the bind is closed or when the queue is full, like they
+// would be by a UDP socket.
+func (b *appBind) deliver(data []byte, ep *transportEndpoint) {
+	b.mu.Lock()
+	open := b.closed != nil
+	b.mu.Unlock()
+	if !open {
+		return
+	}
+	select {
+	case b.incoming <- transportDatagram{data: data, ep: ep}:
+	default:
+	}
+}
+
+// transportEndpoint is the endpoint of a peer that is reached
+// through a transport of the app instead of the base Bind.
+type transportEndpoint struct {
+	addr string     // the address of the peer, for logging
+	ip   netip.Addr // the IP of the peer, if known
+	send func([]byte) error
+}
+
+// newTransportEndpoint returns an endpoint that sends datagrams with
+// send. The address is the remote address of the peer, like the
+// remote address of a WebSocket, or a URL.
+func newTransportEndpoint(addr string, send func([]byte) error) *transportEndpoint {
+	ep := &transportEndpoint{addr: addr, send: send}
+	if ap, err := netip.ParseAddrPort(addr); err == nil {
+		ep.ip = ap.Addr()
+	}
+	return ep
+}
+
+func (e *transportEndpoint) ClearSrc()           {}
+func (e *transportEndpoint) SrcToString() string { return "" }
+func (e *transportEndpoint) DstToString() string { return e.addr }
+func (e *transportEndpoint) DstToBytes() []byte  { return []byte(e.addr) }
+func (e *transportEndpoint) DstIP() netip.Addr   { return e.ip }
+func (e *transportEndpoint) SrcIP() netip.Addr   { return netip.Addr{} }
+
+// Interface guards
+var (
+	_ conn.Bind     = (*appBind)(nil)
+	_ conn.Endpoint = (*transportEndpoint)(nil)
+)
@@ -0,0 +1,133 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Defaults and limits of packet captures.
+const (
+	defaultCaptureDuration = 10 * time.Second
+	maxCaptureDuration     = 10 * time.Minute
+
+	// captureQueueLen is the number of packets that can be queued for
+	// a capture. Packets are dropped from the capture, not from the
+	// tunnel, when the capture can't keep up.
+	captureQueueLen = 1024
+)
+
+// captureFilter selects the packets of a capture. The zero
+// value selects all packets.
+type captureFilter struct {
+	// nets selects packets from or to the allowed IPs of a peer.
+	nets []*net.IPNet
+
+	// port selects TCP and UDP packets from or to the port.
+	port uint16
+}
+
+// matches reports whether the filter selects the packet.
+func (f captureFilter) matches(packet []byte) bool {
+	if f.port != 0 {
+		_, srcPort, dstPort, hasPorts := packetTransport(packet)
+		if !hasPorts || (srcPort != f.port && dstPort != f.port) {
+			return false
+		}
+	}
+	if len(f.nets) > 0 {
+		src, dst := packetAddrs(packet)
+		if src == nil || (!containsIP(f.nets, src) && !containsIP(f.nets, dst)) {
+			return false
+		}
+	}
+	return true
+}
+
+// capturedPacket is a copy of a packet exchanged with a peer.
+type capturedPacket struct {
+	time     time.Time
+	data     []byte
+	outbound bool
+}
+
+// capture is a running packet capture.
+type capture struct {
+	filter  captureFilter
+	packets chan capturedPacket
+	dropped uint64 // accessed atomically
+}
+
+// captures are the running packet captures of the app.
+type captures struct {
+	mu     sync.RWMutex
+	active map[*capture]struct{}
+	n      int32 // accessed atomically
+}
+
+// startCapture starts capturing the packets
+// that are selected by the filter.
+func (w *WireGuard) startCapture(filter captureFilter) *capture {
+	c := &capture{
+		filter:  filter,
+		packets: make(chan capturedPacket, captureQueueLen),
+	}
+	w.captures.mu.Lock()
+	w.captures.active[c] = struct{}{}
+	atomic.StoreInt32(&w.captures.n, int32(len(w.captures.active)))
+	w.captures.mu.Unlock()
+	return c
+}
+
+// stopCapture stops the capture.
+func (w *WireGuard) stopCapture(c *capture) {
+	w.captures.mu.Lock()
+	delete(w.captures.active, c)
+	atomic.StoreInt32(&w.captures.n, int32(len(w.captures.active)))
+	w.captures.mu.Unlock()
+
+	if dropped := atomic.LoadUint64(&c.dropped); dropped > 0 {
+		w.logger.Warn("packets dropped from capture", zap.Uint64("dropped", dropped))
+	}
+}
+
+// capture hands a copy of a packet that is sent to or received from
+// a peer to the running captures that select it.
+func (w *WireGuard) capture(packet []byte, outbound bool) {
+	if atomic.LoadInt32(&w.captures.n) == 0 {
+		return
+	}
+	now := time.Now()
+
+	w.captures.mu.RLock()
+	defer w.captures.mu.RUnlock()
+	for c := range w.captures.active {
+		if !c.filter.matches(packet) {
+			continue
+		}
+		data := make([]byte, len(packet))
+		copy(data, packet)
+		select {
+		case c.packets <- capturedPacket{time: now, data: data, outbound: outbound}:
+		default:
+			atomic.AddUint64(&c.dropped, 1)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Client connects the app to a remote WireGuard server, like a
+// central hub, so that Caddy can serve sites from behind NAT. In
+// client mode, the addresses of the app are the tunnel addresses
+// that the remote server assigned to it.
+type Client struct {
+	// The base64 encoded public key of the remote server.
+	PublicKey string `json:"public_key,omitempty"`
+
+	// An optional base64 encoded preshared key.
+	PresharedKey string `json:"preshared_key,omitempty"`
+
+	// The host:port of the remote server. The host can be a
+	// hostname, which is re-resolved periodically and when
+	// handshakes fail, so that servers with a dynamic address
+	// can be followed. It can also be the wss:// URL of a
+	// wireguard_transport handler, for networks that block UDP.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// The IP ranges, in CIDR notation, that are routed to
+	// the remote server, like the subnet of the tunnel.
+	AllowedIPs []string `json:"allowed_ips,omitempty"`
+
+	// The interval at which keepalive packets are sent to the
+	// remote server, which keeps NAT mappings open. Default: 25s
+	PersistentKeepalive caddy.Duration `json:"persistent_keepalive,omitempty"`
+
+	// The interval at which the endpoint is re-resolved.
+	// Default: 1m
+	ResolveInterval caddy.Duration `json:"resolve_interval,omitempty"`
+
+	peer  *Peer
+	relay *websocketRelay
+}
+
+// provision sets the defaults and checks the configuration.
+func (c *Client) provision() error {
+	if c.PersistentKeepalive == 0 {
+		c.PersistentKeepalive = caddy.Duration(25 * time.Second)
+	}
+	if c.ResolveInterval == 0 {
+		c.ResolveInterval = caddy.Duration(defaultResolveInterval)
+	}
+
+	if c.Endpoint == "" {
+		return fmt.Errorf("endpoint is required")
+	}
+	if len(c.AllowedIPs) == 0 {
+		return fmt.Errorf("allowed IPs are required")
+	}
+
+	c.peer = &Peer{
+		PublicKey:           c.PublicKey,
+		PresharedKey:        c.PresharedKey,
+		AllowedIPs:          c.AllowedIPs,
+		Endpoint:            c.Endpoint,
+		PersistentKeepalive: c.PersistentKeepalive,
+		ResolveInterval:     c.ResolveInterval,
+	}
+	if !isWebSocketURL(c.Endpoint) {
+		return c.peer.validate()
+	}
+	var err error
+	if c.relay, err = newWebSocketRelay(c.Endpoint); err != nil {
+		return err
+	}
+	// the URL is the name of the endpoint of the relay on the bind
+	c.peer.Endpoint = ""
+	if err := c.peer.validate(); err != nil {
+		return err
+	}
+	c.peer.Endpoint = c.Endpoint
+	return nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Formats in which a client configuration can be rendered.
+const (
+	formatConf     = "conf"
+	formatPNG      = "png"
+	formatTerminal = "terminal"
+)
+
+// qrCodePNGSize is the width and height in pixels of generated QR codes.
+const qrCodePNGSize = 512
+
+// clientConfig generates a configuration in the wg-quick format
+// that the peer can use to connect to this device. The WireGuard
+// mobile apps can import it directly or from a QR code. If the
+// private key of the peer is unknown, it is left out and has to
+// be added by the peer itself.
+func (w *WireGuard) clientConfig(p *Peer) (string, error) {
+	// the keys change when they are rotated
+	w.peersMu.RLock()
+	serverPublicKey, presharedKey := w.publicKey, p.PresharedKey
+	w.peersMu.RUnlock()
+	return w.clientConfigWithKeys(p, serverPublicKey, presharedKey)
+}
+
+// clientConfigWithKeys generates the client configuration of the
+// peer with the given public key of this device and preshared key.
+func (w *WireGuard) clientConfigWithKeys(p *Peer, serverPublicKey, presharedKey string) (string, error) {
+	if w.Endpoint == "" {
+		return "", fmt.Errorf("endpoint of the WireGuard app is not configured")
+	}
+	if p.expired(time.Now()) {
+		return "", fmt.Errorf("peer %s has expired", p.PublicKey)
+	}
+
+	var b strings.Builder
+	b.WriteString("[Interface]\n")
+	if p.PrivateKey != "" {
+		fmt.Fprintf(&b, "PrivateKey = %s\n", p.PrivateKey)
+	}
+	if addrs := p.addresses(); len(addrs) > 0 {
+		fmt.Fprintf(&b, "Address = %s\n", strings.Join(addrs, ", "))
+	}
+	if len(w.DNS) > 0 {
+		fmt.Fprintf(&b, "DNS = %s\n", strings.Join(w.DNS, ", "))
+	}
+	fmt.Fprintf(&b, "MTU = %d\n", w.MTU)
+	b.WriteString("\n[Peer]\n")
+	fmt.Fprintf(&b, "PublicKey = %s\n", serverPublicKey)
+	if presharedKey != "" {
+		fmt.Fprintf(&b, "PresharedKey = %s\n", presharedKey)
+	}
+	allowedIPs := hostPrefixes(w.addresses)
+	if w.ExitNode != nil {
+		allowedIPs = append(allowedIPs, w.ExitNode.ExitRoutes...)
+	}
+	fmt.Fprintf(&b, "AllowedIPs = %s\n", strings.Join(allowedIPs, ", "))
+	fmt.Fprintf(&b, "Endpoint = %s\n", w.Endpoint)
+	if p.PersistentKeepalive > 0 {
+		fmt.Fprintf(&b, "PersistentKeepalive = %d\n", time.Duration(p.PersistentKeepalive)/time.Second)
+	}
+
+	return b.String(), nil
+}
+
+// renderClientConfig renders a client configuration in the given format.
+func renderClientConfig(config, format string) ([]byte, error) {
+	switch format {
+	case "", formatConf:
+		return []byte(config), nil
+	case formatPNG:
+		return qrcode.Encode(config, qrcode.Medium, qrCodePNGSize)
+	case formatTerminal:
+		q, err := qrcode.New(config, qrcode.Medium)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(q.ToSmallString(false)), nil
+	default:
+		return nil, fmt.Errorf("unsupported format: %s", format)
+	}
+}
+
+// hostPrefixes returns the IPs as single host prefixes in CIDR notation.
+func hostPrefixes(ips []net.IP) []string {
+	prefixes := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		prefixes = append(prefixes, hostPrefix(ip))
+	}
+	return prefixes
+}
+
+// hostPrefix returns the IP as a single host prefix in CIDR notation.
+func hostPrefix(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.String() + "/32"
+	}
+	return ip.String() + "/128"
+}
@@ -0,0 +1,141 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestClientConfig(t *testing.T) {
+	const (
+		serverKey = "SERVERPUBLICKEY"
+		psk       = "PRESHAREDKEY"
+	)
+	newApp := func() *WireGuard {
+		return &WireGuard{
+			MTU:       1420,
+			Endpoint:  "vpn.example.com:51820",
+			addresses: []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		app     func(w *WireGuard)
+		peer    Peer
+		psk     string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "minimal",
+			peer: Peer{PublicKey: "PEERKEY"},
+			want: "[Interface]\n" +
+				"MTU = 1420\n" +
+				"\n[Peer]\n" +
+				"PublicKey = SERVERPUBLICKEY\n" +
+				"AllowedIPs = 10.0.0.1/32, fd00::1/128\n" +
+				"Endpoint = vpn.example.com:51820\n",
+		},
+		{
+			name: "complete",
+			app: func(w *WireGuard) {
+				w.DNS = []string{"10.0.0.1", "fd00::1"}
+				w.ExitNode = &ExitNode{ExitRoutes: []string{"0.0.0.0/0", "::/0"}}
+			},
+			peer: Peer{
+				PublicKey:           "PEERKEY",
+				PrivateKey:          "PEERPRIVATEKEY",
+				AllowedIPs:          []string{"10.0.0.2/32", "192.168.1.0/24", "fd00::2/128"},
+				PersistentKeepalive: caddy.Duration(25 * time.Second),
+			},
+			psk: psk,
+			want: "[Interface]\n" +
+				"PrivateKey = PEERPRIVATEKEY\n" +
+				"Address = 10.0.0.2/32, fd00::2/128\n" +
+				"DNS = 10.0.0.1, fd00::1\n" +
+				"MTU = 1420\n" +
+				"\n[Peer]\n" +
+				"PublicKey = SERVERPUBLICKEY\n" +
+				"PresharedKey = PRESHAREDKEY\n" +
+				"AllowedIPs = 10.0.0.1/32, fd00::1/128, 0.0.0.0/0, ::/0\n" +
+				"Endpoint = vpn.example.com:51820\n" +
+				"PersistentKeepalive = 25\n",
+		},
+		{
+			name:    "no endpoint",
+			app:     func(w *WireGuard) { w.Endpoint = "" },
+			peer:    Peer{PublicKey: "PEERKEY"},
+			wantErr: true,
+		},
+		{
+			name:    "expired peer",
+			peer:    Peer{PublicKey: "PEERKEY", ExpiresAt: time.Now().Add(-time.Minute)},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newApp()
+			if tt.app != nil {
+				tt.app(w)
+			}
+			p := tt.peer
+			got, err := w.clientConfigWithKeys(&p, serverKey, tt.psk)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("clientConfigWithKeys() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("clientConfigWithKeys() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderClientConfig(t *testing.T) {
+	const config = "[Interface]\nMTU = 1420\n"
+	pngMagic := []byte("\x89PNG\r\n\x1a\n")
+
+	tests := []struct {
+		format  string
+		check   func(out []byte) bool
+		wantErr bool
+	}{
+		{format: "", check: func(out []byte) bool { return string(out) == config }},
+		{format: formatConf, check: func(out []byte) bool { return string(out) == config }},
+		{format: formatPNG, check: func(out []byte) bool { return bytes.HasPrefix(out, pngMagic) }},
+		{format: formatTerminal, check: func(out []byte) bool {
+			return strings.ContainsAny(string(out), "█▀▄") && strings.Count(string(out), "\n") > 10
+		}},
+		{format: "svg", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			out, err := renderClientConfig(config, tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("renderClientConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.check != nil && !tt.check(out) {
+				t.Errorf("renderClientConfig() = %q, unexpected for format %q", out, tt.format)
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "wireguard",
+		Func:  cmdWireGuard,
+		Usage: "<subcommand> [flags]",
+		Short: "Interacts with the WireGuard app of a running Caddy instance",
+		Long: `
+Interacts with the WireGuard app of a running Caddy instance
+through its admin API. Available subcommands:
+
+	client-config --public-key <key> [--format conf|png|terminal] [--output <file>] [--next] [--address <admin>]
+		Prints the client configuration of a peer. The png and
+		terminal formats render the configuration as a QR code,
+		which can be scanned by the WireGuard mobile apps. With
+		--next, it has the keys published for the next rotation.
+
+	enroll-token [--ttl <duration>] [--address <admin>]
+		Creates a one-time token for the wireguard_enroll HTTP
+		handler, which expires after the optional ttl.
+
+	ping (--public-key <key> | --ip <ip>) [--count <n>] [--address <admin>]
+		Sends echo requests through the tunnel to the address of
+		a peer or to an IP address, and reports the round-trip
+		times and loss.
+`,
+	})
+}
+
+// subcommands are the subcommands of the wireguard command.
+var subcommands = map[string]func(args []string) (int, error){
+	"client-config": cmdClientConfig,
+	"enroll-token":  cmdEnrollToken,
+	"ping":          cmdPing,
+}
+
+// cmdWireGuard dispatches to the requested subcommand.
+func cmdWireGuard(fl caddycmd.Flags) (int, error) {
+	if fl.NArg() == 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("missing subcommand; available: %s", strings.Join(subcommandNames(), ", "))
+	}
+	cmd, ok := subcommands[fl.Arg(0)]
+	if !ok {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("unknown subcommand: %s", fl.Arg(0))
+	}
+	return cmd(fl.Args()[1:])
+}
+
+func cmdClientConfig(args []string) (int, error) {
+	fs := flag.NewFlagSet("client-config", flag.ContinueOnError)
+	publicKey := fs.String("public-key", "", "The public key of the peer")
+	format := fs.String("format", formatConf, "The output format: conf, png or terminal")
+	output := fs.String("output", "", "The file to write to instead of stdout")
+	next := fs.Bool("next", false, "Use the keys published for the next key rotation")
+	adminAddr := fs.String("address", "", "The address of the admin API")
+	if err := fs.Parse(args); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if *publicKey == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--public-key is required")
+	}
+
+	query := url.Values{}
+	query.Set("public_key", *publicKey)
+	query.Set("format", *format)
+	if *next {
+		query.Set("next", "true")
+	}
+	body, err := adminRequest(*adminAddr, http.MethodGet, "/wireguard/client-config?"+query.Encode(), nil)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	if *output != "" {
+		if err := ioutil.WriteFile(*output, body, 0600); err != nil {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("writing output: %v", err)
+		}
+		return caddy.ExitCodeSuccess, nil
+	}
+	if _, err := os.Stdout.Write(body); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdEnrollToken(args []string) (int, error) {
+	fs := flag.NewFlagSet("enroll-token", flag.ContinueOnError)
+	ttl := fs.String("ttl", "", "The duration after which the token expires")
+	adminAddr := fs.String("address", "", "The address of the admin API")
+	if err := fs.Parse(args); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	query := url.Values{}
+	if *ttl != "" {
+		query.Set("ttl", *ttl)
+	}
+	body, err := adminRequest(*adminAddr, http.MethodPost, "/wireguard/enroll-tokens?"+query.Encode(), nil)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("decoding response: %v", err)
+	}
+	fmt.Println(resp.Token)
+
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdPing(args []string) (int, error) {
+	fs := flag.NewFlagSet("ping", flag.ContinueOnError)
+	publicKey := fs.String("public-key", "", "The public key of the peer to ping")
+	ip := fs.String("ip", "", "The IP address to ping")
+	count := fs.Int("count", defaultPingCount, "The number of echo requests to send")
+	adminAddr := fs.String("address", "", "The address of the admin API")
+	if err := fs.Parse(args); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if (*publicKey == "") == (*ip == "") {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("either --public-key or --ip is required")
+	}
+
+	query := url.Values{}
+	if *publicKey != "" {
+		query.Set("public_key", *publicKey)
+	} else {
+		query.Set("ip", *ip)
+	}
+	query.Set("count", strconv.Itoa(*count))
+	body, err := adminRequest(*adminAddr, http.MethodGet, "/wireguard/ping?"+query.Encode(), nil)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	var result PingResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("decoding response: %v", err)
+	}
+	for _, rtt := range result.RTTs {
+		fmt.Printf("reply from %s: time=%v\n", result.Address, rtt)
+	}
+	fmt.Printf("%d packets transmitted, %d received, %.0f%% packet loss\n", result.Sent, result.Received, result.Loss)
+	if len(result.RTTs) > 0 {
+		min, max, sum := result.RTTs[0], result.RTTs[0], time.Duration(0)
+		for _, rtt := range result.RTTs {
+			if rtt < min {
+				min = rtt
+			}
+			if rtt > max {
+				max = rtt
+			}
+			sum += rtt
+		}
+		fmt.Printf("rtt min/avg/max = %v/%v/%v\n", min, sum/time.Duration(len(result.RTTs)), max)
+	}
+	if result.Received == 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("no replies from %s", result.Address)
+	}
+
+	return caddy.ExitCodeSuccess, nil
+}
+
+// adminRequest performs a request against the admin API listening
+// at adminAddr and returns the response body.
+func adminRequest(adminAddr, method, uri string, body io.Reader) ([]byte, error) {
+	if adminAddr == "" {
+		adminAddr = caddy.DefaultAdminListen
+	}
+	parsedAddr, err := caddy.ParseNetworkAddress(adminAddr)
+	if err != nil || parsedAddr.PortRangeSize() > 1 {
+		return nil, fmt.Errorf("invalid admin address %s: %v", adminAddr, err)
+	}
+	origin := parsedAddr.JoinHostPort(0)
+	if parsedAddr.IsUnixNetwork() {
+		origin = "unixsocket" // hack so that http.NewRequest() is happy
+	}
+
+	req, err := http.NewRequest(method, "http://"+origin+uri, body)
+	if err != nil {
+		return nil, fmt.Errorf("making request: %v", err)
+	}
+	if parsedAddr.IsUnixNetwork() {
+		// see the apiRequest function of the caddy command
+		req.URL.Host = " "
+		req.Host = ""
+	} else {
+		req.Header.Set("Origin", origin)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := http.Client{
+		Transport: &http.Transport{
+			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+				return net.Dial(parsedAddr.Network, parsedAddr.JoinHostPort(0))
+			},
+		},
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("performing request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %v", err)
+	}
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("caddy responded with error: HTTP %d: %s", resp.StatusCode, respBody)
+	}
+
+	return respBody, nil
+}
+
+// subcommandNames returns the sorted names of the subcommands.
+func subcommandNames() []string {
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
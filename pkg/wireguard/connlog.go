@@ -0,0 +1,330 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// connSweepInterval is the interval at which idle
+// connections are logged and forgotten.
+const connSweepInterval = 10 * time.Second
+
+// connShards is the number of shards of the tracked connections, which
+// have a lock of their own, so that the packets of different connections
+// are mostly tracked in parallel.
+const connShards = 16
+
+// Results of logged connections.
+const (
+	connClosed  = "closed"  // ended by both sides, or idle UDP
+	connReset   = "reset"   // reset after it was established
+	connRefused = "refused" // reset before it was established, like a closed port
+	connDropped = "dropped" // never established and packets were dropped
+	connTimeout = "timeout" // idle TCP
+)
+
+// Reasons for dropping packets.
+const (
+	dropBandwidthLimit = "bandwidth_limit"
+	dropFirewall       = "firewall"
+	dropHub            = "hub"
+	dropOversized      = "oversized"
+)
+
+// ConnectionLog logs the TCP and UDP connections that are exchanged
+// with peers, like connections to Caddy, forwarded connections of the
+// exit node and connections between peers in hub mode. A connection is
+// logged when it ends, with the peer, its addresses, its duration and
+// the bytes that each side sent. Connections to closed ports are logged
+// as refused, and packets that are dropped by the firewall, the hub
+// rules or bandwidth limits are counted and logged at debug level.
+//
+// The logs are emitted through the wireguard.connections logger, so
+// they can be routed with the logging config of Caddy.
+type ConnectionLog struct {
+	// The duration after which an idle TCP connection is
+	// logged as timed out. Default: 5m
+	TCPIdleTimeout caddy.Duration `json:"tcp_idle_timeout,omitempty"`
+
+	// The duration after which an idle UDP session is
+	// logged as closed. Default: 1m
+	UDPIdleTimeout caddy.Duration `json:"udp_idle_timeout,omitempty"`
+
+	// The maximum number of connections that are tracked. New
+	// connections aren't tracked while there are as many, and
+	// their number is logged. Default: 65536
+	MaxConnections int `json:"max_connections,omitempty"`
+
+	logger    *zap.Logger
+	shards    [connShards]connShard
+	untracked uint64 // accessed atomically
+}
+
+// connShard holds a part of the tracked connections.
+type connShard struct {
+	mu    sync.Mutex
+	conns map[connKey]*trackedConn
+	max   int
+}
+
+// connKey identifies a connection by its protocol and the
+// addresses of the side that initiated it and the other side.
+type connKey struct {
+	protocol         uint8
+	src, dst         [net.IPv6len]byte
+	srcPort, dstPort uint16
+}
+
+// trackedConn is a connection that is being tracked.
+type trackedConn struct {
+	peer        string
+	inbound     bool // initiated by the peer
+	src, dst    net.IP
+	start, last time.Time
+	srcBytes    uint64
+	dstBytes    uint64
+	dropped     uint64
+	established bool
+	srcFIN      bool
+	dstFIN      bool
+}
+
+// provision sets the defaults.
+func (l *ConnectionLog) provision(logger *zap.Logger) {
+	l.logger = logger
+	if l.MaxConnections == 0 {
+		l.MaxConnections = 65536
+	}
+	perShard := (l.MaxConnections + connShards - 1) / connShards
+	for i := range l.shards {
+		l.shards[i].conns = make(map[connKey]*trackedConn)
+		l.shards[i].max = perShard
+	}
+	if l.TCPIdleTimeout == 0 {
+		l.TCPIdleTimeout = caddy.Duration(5 * time.Minute)
+	}
+	if l.UDPIdleTimeout == 0 {
+		l.UDPIdleTimeout = caddy.Duration(time.Minute)
+	}
+}
+
+// shard returns the shard of the connection. Both directions of a
+// connection are in the same shard.
+func (l *ConnectionLog) shard(key connKey) *connShard {
+	h := uint32(key.protocol) ^ uint32(key.srcPort^key.dstPort)
+	for i := range key.src {
+		h = h*31 + uint32(key.src[i]^key.dst[i])
+	}
+	return &l.shards[h%connShards]
+}
+
+// track updates the connection of a TCP or UDP packet that is sent to
+// or received from a peer. New connections are tracked from the first
+// TCP SYN or UDP packet that isn't dropped. A non-empty dropReason means
+// that the packet was dropped.
+func (l *ConnectionLog) track(app *WireGuard, packet []byte, outbound bool, dropReason string) {
+	protocol, srcPort, dstPort, hasPorts := packetTransport(packet)
+	src, dst := packetAddrs(packet)
+	if dropReason != "" {
+		l.logger.Debug("packet dropped",
+			zap.String("reason", dropReason),
+			zap.Bool("outbound", outbound),
+			zap.String("protocol", protocolName(protocol)),
+			zap.Stringer("src", src),
+			zap.Stringer("dst", dst),
+			zap.Uint16("src_port", srcPort),
+			zap.Uint16("dst_port", dstPort),
+		)
+	}
+	if !hasPorts || src == nil {
+		return
+	}
+	flags, _ := tcpFlags(packet)
+
+	key := connKey{protocol: protocol, srcPort: srcPort, dstPort: dstPort}
+	copy(key.src[:], src.To16())
+	copy(key.dst[:], dst.To16())
+	reverse := connKey{protocol: protocol, src: key.dst, dst: key.src, srcPort: dstPort, dstPort: srcPort}
+
+	shard := l.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := time.Now()
+	c, fromSrc := shard.conns[key], true
+	if c == nil {
+		c, fromSrc = shard.conns[reverse], false
+	}
+	if c == nil {
+		// only the start of a connection is tracked, and only when it
+		// is accepted, so that denied traffic doesn't fill the log
+		if dropReason != "" {
+			return
+		}
+		if protocol == protocolTCP && (flags&tcpFlagSYN == 0 || flags&tcpFlagACK != 0) {
+			return
+		}
+		if len(shard.conns) >= shard.max {
+			atomic.AddUint64(&l.untracked, 1)
+			return
+		}
+		c = &trackedConn{
+			inbound: !outbound,
+			src:     append(net.IP(nil), src...),
+			dst:     append(net.IP(nil), dst...),
+			start:   now,
+		}
+		peerIP := dst
+		if c.inbound {
+			peerIP = src
+		}
+		if p := app.peerForIP(peerIP); p != nil {
+			c.peer = p.PublicKey
+		}
+		shard.conns[key] = c
+	} else if !fromSrc {
+		key = reverse
+	}
+
+	c.last = now
+	if dropReason != "" {
+		c.dropped++
+		return
+	}
+	if fromSrc {
+		c.srcBytes += uint64(len(packet))
+	} else {
+		c.dstBytes += uint64(len(packet))
+	}
+
+	if protocol != protocolTCP {
+		return
+	}
+	switch {
+	case flags&tcpFlagRST != 0:
+		if c.established {
+			l.end(shard, key, c, connReset)
+		} else {
+			l.end(shard, key, c, connRefused)
+		}
+	case !fromSrc && flags&tcpFlagSYN != 0 && flags&tcpFlagACK != 0:
+		c.established = true
+	case flags&tcpFlagFIN != 0:
+		if fromSrc {
+			c.srcFIN = true
+		} else {
+			c.dstFIN = true
+		}
+		if c.srcFIN && c.dstFIN {
+			l.end(shard, key, c, connClosed)
+		}
+	}
+}
+
+// sweep logs and forgets the connections that are idle, and logs the
+// number of connections that weren't tracked since the last sweep.
+func (l *ConnectionLog) sweep() {
+	now := time.Now()
+	for i := range l.shards {
+		shard := &l.shards[i]
+		shard.mu.Lock()
+		for key, c := range shard.conns {
+			switch {
+			case key.protocol == protocolUDP && now.Sub(c.last) > time.Duration(l.UDPIdleTimeout):
+				l.end(shard, key, c, connClosed)
+			case key.protocol == protocolTCP && !c.established && c.dropped > 0 && now.Sub(c.last) > connSweepInterval:
+				l.end(shard, key, c, connDropped)
+			case key.protocol == protocolTCP && now.Sub(c.last) > time.Duration(l.TCPIdleTimeout):
+				l.end(shard, key, c, connTimeout)
+			}
+		}
+		shard.mu.Unlock()
+	}
+
+	if n := atomic.SwapUint64(&l.untracked, 0); n > 0 {
+		l.logger.Warn("too many connections to track; new connections weren't logged",
+			zap.Uint64("untracked", n),
+			zap.Int("max_connections", l.MaxConnections),
+		)
+	}
+}
+
+// end logs and forgets the connection. The lock of the shard must be held.
+func (l *ConnectionLog) end(shard *connShard, key connKey, c *trackedConn, result string) {
+	delete(shard.conns, key)
+
+	direction := "outbound"
+	if c.inbound {
+		direction = "inbound"
+	}
+	l.logger.Info("connection",
+		zap.String("peer", c.peer),
+		zap.String("direction", direction),
+		zap.String("protocol", protocolName(key.protocol)),
+		zap.String("src", net.JoinHostPort(c.src.String(), strconv.Itoa(int(key.srcPort)))),
+		zap.String("dst", net.JoinHostPort(c.dst.String(), strconv.Itoa(int(key.dstPort)))),
+		zap.String("result", result),
+		zap.Duration("duration", c.last.Sub(c.start)),
+		zap.Uint64("src_bytes", c.srcBytes),
+		zap.Uint64("dst_bytes", c.dstBytes),
+		zap.Uint64("dropped_packets", c.dropped),
+	)
+}
+
+// trackConn updates the connection log, if configured, with a packet
+// that is sent to or received from a peer.
+func (w *WireGuard) trackConn(packet []byte, outbound bool, dropReason string) {
+	if w.ConnectionLog != nil {
+		w.ConnectionLog.track(w, packet, outbound, dropReason)
+	}
+}
+
+// sweepConnectionsPeriodically logs the idle connections
+// until the app is stopped.
+func (w *WireGuard) sweepConnectionsPeriodically() {
+	ticker := time.NewTicker(connSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-ticker.C:
+			w.ConnectionLog.sweep()
+		}
+	}
+}
+
+// protocolName returns the name of an IP protocol number.
+func protocolName(protocol uint8) string {
+	switch protocol {
+	case protocolTCP:
+		return "tcp"
+	case protocolUDP:
+		return "udp"
+	case protocolICMP:
+		return "icmp"
+	case protocolICMPv6:
+		return "icmpv6"
+	}
+	return strconv.Itoa(int(protocol))
+}
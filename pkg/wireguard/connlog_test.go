@@ -0,0 +1,84 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"net"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// tcpPacket returns a TCP packet from src to dst with the flags.
+func tcpPacket(src net.IP, srcPort uint16, dst net.IP, dstPort uint16, flags uint8) []byte {
+	p := ipv4Packet(src, dst, 12)
+	p[9] = protocolTCP
+	p[20], p[21] = byte(srcPort>>8), byte(srcPort)
+	p[22], p[23] = byte(dstPort>>8), byte(dstPort)
+	p[32] = 5 << 4
+	p[33] = flags
+	return p
+}
+
+// trackedConns returns the number of connections that l tracks.
+func trackedConns(l *ConnectionLog) int {
+	n := 0
+	for i := range l.shards {
+		n += len(l.shards[i].conns)
+	}
+	return n
+}
+
+func TestConnectionLogTrack(t *testing.T) {
+	peerIP, serverIP := net.IPv4(10, 0, 0, 1), net.IPv4(10, 255, 0, 1)
+	syn := func(port uint16) []byte { return tcpPacket(peerIP, port, serverIP, 443, tcpFlagSYN) }
+	var syns [][]byte
+	for port := uint16(40000); port < 40100; port++ {
+		syns = append(syns, syn(port))
+	}
+
+	tests := []struct {
+		name    string
+		max     int
+		packets [][]byte
+		drop    string
+		want    int
+	}{
+		{"accepted SYN", 0, [][]byte{syn(40000)}, "", 1},
+		{"dropped SYN", 0, [][]byte{syn(40000)}, dropFirewall, 0},
+		{"ACK without SYN", 0, [][]byte{tcpPacket(peerIP, 40000, serverIP, 443, tcpFlagACK)}, "", 0},
+		{"SYN and answer", 0, [][]byte{syn(40000), tcpPacket(serverIP, 443, peerIP, 40000, tcpFlagSYN|tcpFlagACK)}, "", 1},
+		{"refused", 0, [][]byte{syn(40000), tcpPacket(serverIP, 443, peerIP, 40000, tcpFlagRST|tcpFlagACK)}, "", 0},
+		{"at most max connections", connShards, syns, "", connShards},
+		{"UDP", 0, [][]byte{ipv4Packet(peerIP, serverIP, 10)}, "", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &ConnectionLog{MaxConnections: tt.max}
+			l.provision(zap.NewNop())
+			app := testApp(1)
+			for i, p := range tt.packets {
+				drop := ""
+				if i == 0 {
+					drop = tt.drop
+				}
+				l.track(app, p, false, drop)
+			}
+			if got := trackedConns(l); got != tt.want {
+				t.Errorf("tracked %d connections, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Timings of following endpoints with a hostname.
+const (
+	// resolveTimeout is the maximum duration of resolving an endpoint.
+	resolveTimeout = 10 * time.Second
+
+	// defaultResolveInterval is the default interval at
+	// which endpoints with a hostname are re-resolved.
+	defaultResolveInterval = time.Minute
+
+	// endpointCheckInterval is the interval at which is checked
+	// whether endpoints have to be re-resolved.
+	endpointCheckInterval = 15 * time.Second
+
+	// staleHandshakeAge is the age of the last handshake after which
+	// the endpoint of a peer is re-resolved at every check. WireGuard
+	// renews sessions every two minutes while there is traffic, so an
+	// older handshake means that handshakes are failing, or that
+	// there was no traffic.
+	staleHandshakeAge = 3 * time.Minute
+)
+
+// hasEndpointHostname reports whether the endpoint of
+// the peer has a hostname instead of an IP.
+func (p *Peer) hasEndpointHostname() bool {
+	if p.Endpoint == "" || isWebSocketURL(p.Endpoint) {
+		return false
+	}
+	host, _, err := net.SplitHostPort(p.Endpoint)
+	return err == nil && net.ParseIP(host) == nil
+}
+
+// endpoint returns the ip:port of the peer that is configured on the
+// device, which is the resolved endpoint for endpoints with a hostname.
+// The resolved endpoint is guarded by the peersMu of the app.
+func (p *Peer) endpoint() string {
+	if p.hasEndpointHostname() {
+		return p.resolved
+	}
+	return p.Endpoint
+}
+
+// resolveDue reports whether the endpoint of the peer has to be
+// re-resolved, because the resolve interval passed, or because
+// the last handshake is stale. peersMu must be held.
+func (p *Peer) resolveDue(now, lastHandshake time.Time) bool {
+	interval := time.Duration(p.ResolveInterval)
+	if interval == 0 {
+		interval = defaultResolveInterval
+	}
+	since := now.Sub(p.resolvedAt)
+	return since >= interval || (since >= endpointCheckInterval && now.Sub(lastHandshake) > staleHandshakeAge)
+}
+
+// resolveEndpoint resolves the endpoint of the peer into an ip:port,
+// preferring IPv4 addresses.
+func (p *Peer) resolveEndpoint(ctx context.Context) (string, error) {
+	host, port, err := net.SplitHostPort(p.Endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid endpoint: %v", err)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return net.JoinHostPort(ip.String(), port), nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("no addresses found for %s", host)
+	}
+	ip := addrs[0].IP
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			ip = a.IP
+			break
+		}
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+// resolveEndpoints resolves the endpoints with a hostname of all
+// peers before the device is configured. Peers of which the endpoint
+// can't be resolved are configured without one until it can be.
+func (w *WireGuard) resolveEndpoints() {
+	for _, p := range w.endpointPeers() {
+		resolvedAt := time.Now()
+		endpoint, err := p.resolveEndpoint(w.ctx)
+		w.peersMu.Lock()
+		p.resolvedAt = resolvedAt
+		if err == nil {
+			p.resolved = endpoint
+		}
+		w.peersMu.Unlock()
+		if err != nil {
+			w.logger.Error("resolving peer endpoint",
+				zap.String("public_key", p.PublicKey),
+				zap.String("endpoint", p.Endpoint),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+// endpointPeers returns the peers, including the remote server in
+// client mode, that have an endpoint with a hostname.
+func (w *WireGuard) endpointPeers() []*Peer {
+	w.peersMu.RLock()
+	defer w.peersMu.RUnlock()
+
+	var peers []*Peer
+	for _, p := range w.Peers {
+		if p.hasEndpointHostname() {
+			peers = append(peers, p)
+		}
+	}
+	if w.Client != nil && w.Client.peer.hasEndpointHostname() {
+		peers = append(peers, w.Client.peer)
+	}
+	return peers
+}
+
+// updateEndpoint re-resolves the endpoint of the peer and updates the
+// device when its address changed. A keepalive is sent right away, so
+// that the handshake doesn't wait for outgoing traffic. It returns the
+// resolved endpoint and whether the device was updated.
+func (w *WireGuard) updateEndpoint(p *Peer) (string, bool, error) {
+	w.peersMu.Lock()
+	p.resolvedAt = time.Now()
+	previous := p.resolved
+	w.peersMu.Unlock()
+
+	endpoint, err := p.resolveEndpoint(w.ctx)
+	if err != nil {
+		return "", false, fmt.Errorf("resolving endpoint %s: %v", p.Endpoint, err)
+	}
+	if endpoint == previous {
+		return endpoint, false, nil
+	}
+
+	publicKey, err := hexKey(p.PublicKey)
+	if err != nil {
+		return "", false, err
+	}
+	config := fmt.Sprintf("public_key=%s\nupdate_only=true\nendpoint=%s\n", publicKey, endpoint)
+	if err := w.dev.IpcSet(config); err != nil {
+		return "", false, fmt.Errorf("updating endpoint: %v", err)
+	}
+	w.peersMu.Lock()
+	p.resolved = endpoint
+	w.peersMu.Unlock()
+
+	if err := w.initiateHandshake(p.PublicKey); err != nil {
+		return "", false, err
+	}
+	return endpoint, true, nil
+}
+
+// followEndpoints re-resolves the endpoints with a hostname until the
+// app is stopped, so that the device follows peers with a dynamic
+// address. Endpoints are re-resolved at their resolve interval, and
+// sooner when the handshakes with the peer are failing.
+func (w *WireGuard) followEndpoints() {
+	ticker := time.NewTicker(endpointCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		handshakes, err := w.lastHandshakes()
+		if err != nil {
+			w.logger.Error("getting handshakes", zap.Error(err))
+			continue
+		}
+		now := time.Now()
+		for _, p := range w.endpointPeers() {
+			w.peersMu.RLock()
+			due := p.resolveDue(now, handshakes[p.PublicKey])
+			w.peersMu.RUnlock()
+			if !due {
+				continue
+			}
+			endpoint, updated, err := w.updateEndpoint(p)
+			if err != nil {
+				w.logger.Error("updating peer endpoint", zap.String("public_key", p.PublicKey), zap.Error(err))
+			} else if updated {
+				w.logger.Info("updated peer endpoint",
+					zap.String("public_key", p.PublicKey),
+					zap.String("endpoint", p.Endpoint),
+					zap.String("address", endpoint),
+				)
+			}
+		}
+	}
+}
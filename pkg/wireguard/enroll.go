@@ -0,0 +1,252 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(Enroll{})
+}
+
+// enrollTokensStoragePrefix is the prefix under
+// which enrollment tokens are persisted.
+const enrollTokensStoragePrefix = "wireguard/enroll_tokens"
+
+// errInvalidToken is returned for unknown, used and expired tokens.
+var errInvalidToken = errors.New("invalid enrollment token")
+
+// Enroll is an HTTP handler that lets clients enroll themselves
+// as peers of the WireGuard app. A client sends a POST request
+// with a JSON body containing a one-time enrollment token, its
+// public key and optionally a name. When the token is valid, the
+// public key is added as a new peer, which is assigned addresses
+// by the IPAM of the app, and the client configuration of the new
+// peer is returned. The configuration doesn't contain the private
+// key, which only the client knows.
+//
+// Enrollment tokens are created through the admin API or with
+// the `caddy wireguard enroll-token` command. The handler should
+// only be served over HTTPS.
+//
+// When JWT is configured, the request has to carry a JWT of the
+// IdP in its Authorization header instead of an enrollment token.
+// Like an enrollment token, a JWT enrolls a single peer. The subject,
+// groups and expiry of the JWT are stored with the peer, which is
+// removed again when the JWT expires.
+type Enroll struct {
+	// Authorizes enrollments with JWTs instead of enrollment tokens.
+	JWT *JWTAuth `json:"jwt,omitempty"`
+
+	// The duration after which enrolled peers expire and are
+	// removed. Default: never, or the expiry of the JWT
+	PeerTTL caddy.Duration `json:"peer_ttl,omitempty"`
+
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (Enroll) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.wireguard_enroll",
+		New: func() caddy.Module { return new(Enroll) },
+	}
+}
+
+// Provision sets up the handler.
+func (e *Enroll) Provision(ctx caddy.Context) error {
+	e.logger = ctx.Logger(e)
+	if e.JWT != nil {
+		if err := e.JWT.provision(); err != nil {
+			return fmt.Errorf("provisioning JWT: %v", err)
+		}
+	}
+	return nil
+}
+
+// enrollRequest is the body of an enrollment request.
+type enrollRequest struct {
+	Token     string `json:"token"`
+	PublicKey string `json:"public_key"`
+	Name      string `json:"name"`
+}
+
+// ServeHTTP enrolls the client as a new peer.
+func (e Enroll) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	if r.Method != http.MethodPost {
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+	}
+
+	app := running()
+	if app == nil {
+		return caddyhttp.Error(http.StatusServiceUnavailable, fmt.Errorf("WireGuard app is not running"))
+	}
+	if app.IPAM == nil {
+		return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("enrollment requires IPAM to be configured"))
+	}
+
+	var req enrollRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1024*10)).Decode(&req); err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("decoding request: %v", err))
+	}
+
+	p := &Peer{PublicKey: req.PublicKey, Name: req.Name, TTL: e.PeerTTL}
+	if err := p.validate(); err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	var err error
+	if e.JWT != nil {
+		p.Claims, err = e.JWT.verify(r)
+		if err != nil {
+			return caddyhttp.Error(http.StatusUnauthorized, err)
+		}
+		err = useJWT(r.Context(), app.ctx.Storage(), p.Claims, func() error {
+			return app.addPeer(p)
+		})
+	} else {
+		err = useEnrollToken(r.Context(), app.ctx.Storage(), req.Token, func() error {
+			return app.addPeer(p)
+		})
+	}
+	switch {
+	case err == errInvalidToken, err == errJWTUsed:
+		return caddyhttp.Error(http.StatusForbidden, err)
+	case err == errPeerExists, err == errPeerNameTaken:
+		return caddyhttp.Error(http.StatusConflict, err)
+	case err != nil:
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	fields := []zap.Field{
+		zap.String("public_key", p.PublicKey),
+		zap.String("name", p.Name),
+		zap.Strings("allowed_ips", p.AllowedIPs),
+		zap.String("remote_addr", r.RemoteAddr),
+	}
+	if p.Claims != nil {
+		fields = append(fields, zap.String("subject", p.Claims.Subject), zap.Strings("groups", p.Claims.Groups))
+	}
+	e.logger.Info("enrolled peer", fields...)
+
+	config, err := app.clientConfig(p)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err = io.WriteString(w, config)
+	return err
+}
+
+// enrollToken is the persisted state of an enrollment token.
+type enrollToken struct {
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// createEnrollToken creates a new one-time enrollment token, which
+// expires after ttl. A ttl of 0 means the token doesn't expire.
+func createEnrollToken(ctx context.Context, storage certmagic.Storage, ttl time.Duration) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating token: %v", err)
+	}
+	token := b64.RawURLEncoding.EncodeToString(b)
+
+	var t enrollToken
+	if ttl > 0 {
+		t.Expires = time.Now().Add(ttl)
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return "", fmt.Errorf("encoding token: %v", err)
+	}
+	if err := storage.Store(ctx, enrollTokenStorageKey(token), data); err != nil {
+		return "", fmt.Errorf("storing token: %v", err)
+	}
+
+	return token, nil
+}
+
+// useEnrollToken calls enroll if the token is valid and deletes
+// the token if enroll succeeds. The token is locked in the storage
+// while enroll is called, so that it can't be used twice, even if
+// the storage is shared by multiple Caddy instances.
+func useEnrollToken(ctx context.Context, storage certmagic.Storage, token string, enroll func() error) error {
+	if token == "" {
+		return errInvalidToken
+	}
+	key := enrollTokenStorageKey(token)
+	if err := storage.Lock(ctx, key); err != nil {
+		return fmt.Errorf("locking token: %v", err)
+	}
+	defer storage.Unlock(ctx, key)
+
+	if !storage.Exists(ctx, key) {
+		return errInvalidToken
+	}
+	data, err := storage.Load(ctx, key)
+	if err != nil {
+		return fmt.Errorf("loading token: %v", err)
+	}
+	var t enrollToken
+	if err := json.Unmarshal(data, &t); err != nil {
+		return fmt.Errorf("decoding token: %v", err)
+	}
+	if !t.Expires.IsZero() && time.Now().After(t.Expires) {
+		storage.Delete(ctx, key)
+		return errInvalidToken
+	}
+
+	if err := enroll(); err != nil {
+		return err
+	}
+
+	if err := storage.Delete(ctx, key); err != nil {
+		return fmt.Errorf("deleting token: %v", err)
+	}
+	return nil
+}
+
+// enrollTokenStorageKey returns the storage key of the token. Only
+// a hash of the token is used, so that tokens can't be read from
+// the storage.
+func enrollTokenStorageKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return path.Join(enrollTokensStoragePrefix, hex.EncodeToString(sum[:]))
+}
+
+// Interface guards
+var (
+	_ caddy.Module                = (*Enroll)(nil)
+	_ caddy.Provisioner           = (*Enroll)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Enroll)(nil)
+)
@@ -0,0 +1,399 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+
+	"github.com/hslatman/caddy-wireguard/pkg/netstack"
+)
+
+// exitMaxInFlight is the maximum number of TCP connections
+// that can be in the process of being set up at once.
+const exitMaxInFlight = 1024
+
+// specialNets are the networks of loopback, link-local, unspecified
+// and multicast addresses. Destinations in them are only reached
+// through the exit node when an exit route names them explicitly,
+// so that a route like 0.0.0.0/0 doesn't expose the services that
+// listen on the host itself, like the admin API.
+var specialNets = parseCIDRs(
+	"127.0.0.0/8", "::1/128", // loopback
+	"169.254.0.0/16", "fe80::/10", // link-local
+	"0.0.0.0/8", "::/128", // unspecified
+	"224.0.0.0/4", "ff00::/8", // multicast
+)
+
+// ExitNode lets peers use the host as a gateway to other networks.
+// TCP connections and UDP flows from peers to destinations within
+// the exit routes are accepted by the netstack and proxied through
+// sockets on the host, so no kernel routing or root is required.
+type ExitNode struct {
+	// The networks, in CIDR notation, that peers can reach
+	// through the host, like 0.0.0.0/0 for the internet.
+	ExitRoutes []string `json:"exit_routes,omitempty"`
+
+	// The destinations that peers are allowed to reach. A peer can
+	// reach a destination when one of the entries allows it. If
+	// empty, all peers can reach all exit routes.
+	Allow []*ExitAllow `json:"allow,omitempty"`
+
+	// How long to wait for a connection to a destination.
+	// Default: 10s
+	DialTimeout caddy.Duration `json:"dial_timeout,omitempty"`
+
+	// How long a UDP flow is kept open without traffic.
+	// Default: 1m
+	UDPIdleTimeout caddy.Duration `json:"udp_idle_timeout,omitempty"`
+
+	routes []*net.IPNet
+	logger *zap.Logger
+}
+
+// ExitAllow allows peers to reach destinations through the exit node.
+type ExitAllow struct {
+	// The peers that are allowed. Matches all peers if empty.
+	Peers *PeerSelector `json:"peers,omitempty"`
+
+	// The destinations in CIDR notation. Matches all
+	// exit routes if empty.
+	Destinations []string `json:"destinations,omitempty"`
+
+	destinations []*net.IPNet
+}
+
+// provision parses the routes and destinations.
+func (e *ExitNode) provision(logger *zap.Logger) error {
+	if len(e.ExitRoutes) == 0 {
+		return fmt.Errorf("no exit routes configured")
+	}
+	for _, r := range e.ExitRoutes {
+		_, ipnet, err := net.ParseCIDR(r)
+		if err != nil {
+			return fmt.Errorf("invalid exit route: %v", err)
+		}
+		e.routes = append(e.routes, ipnet)
+	}
+	for i, a := range e.Allow {
+		for _, d := range a.Destinations {
+			_, ipnet, err := net.ParseCIDR(d)
+			if err != nil {
+				return fmt.Errorf("allow %d: invalid destination: %v", i, err)
+			}
+			a.destinations = append(a.destinations, ipnet)
+		}
+	}
+	if e.DialTimeout == 0 {
+		e.DialTimeout = caddy.Duration(10 * time.Second)
+	}
+	if e.UDPIdleTimeout == 0 {
+		e.UDPIdleTimeout = caddy.Duration(time.Minute)
+	}
+	e.logger = logger
+	return nil
+}
+
+// start installs the TCP and UDP forwarders on the stack. The NIC
+// accepts packets for any address and is allowed to send packets
+// from any address, so that it can act on behalf of the destinations.
+func (e *ExitNode) start(app *WireGuard, s *stack.Stack) error {
+	if err := s.SetPromiscuousMode(netstack.NICID, true); err != nil {
+		return fmt.Errorf("enabling promiscuous mode: %v", err)
+	}
+	if err := s.SetSpoofing(netstack.NICID, true); err != nil {
+		return fmt.Errorf("enabling spoofing: %v", err)
+	}
+
+	tcpForwarder := tcp.NewForwarder(s, 0, exitMaxInFlight, func(r *tcp.ForwarderRequest) {
+		e.forwardTCP(app, r)
+	})
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+
+	udpForwarder := udp.NewForwarder(s, func(r *udp.ForwarderRequest) {
+		e.forwardUDP(app, s, r)
+	})
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+
+	return nil
+}
+
+// allowed returns the peer that owns src if it is
+// allowed to reach dst through the exit node.
+func (e *ExitNode) allowed(app *WireGuard, src, dst net.IP) (*Peer, bool) {
+	for _, a := range app.addresses {
+		if a.Equal(dst) {
+			return nil, false
+		}
+	}
+	if !e.routed(dst) {
+		return nil, false
+	}
+	peer := app.peerForIP(src)
+	if peer == nil {
+		return nil, false
+	}
+	if len(e.Allow) == 0 {
+		return peer, true
+	}
+	for _, a := range e.Allow {
+		if !a.Peers.matches(peer) {
+			continue
+		}
+		if len(a.destinations) == 0 || containsIP(a.destinations, dst) {
+			return peer, true
+		}
+	}
+	return peer, false
+}
+
+// routed reports whether dst is within the exit routes. Special
+// destinations are only routed when an exit route contains them that
+// is at least as specific as their special network, like 127.0.0.0/8
+// or 127.0.0.1/32 for the loopback address 127.0.0.1.
+func (e *ExitNode) routed(dst net.IP) bool {
+	for _, special := range specialNets {
+		if !special.Contains(dst) {
+			continue
+		}
+		specialOnes, _ := special.Mask.Size()
+		for _, r := range e.routes {
+			if ones, _ := r.Mask.Size(); ones >= specialOnes && r.Contains(dst) {
+				return true
+			}
+		}
+		return false
+	}
+	return containsIP(e.routes, dst)
+}
+
+// forwardTCP proxies a TCP connection from a peer to its destination.
+// The connection is only accepted by the netstack after the connection
+// to the destination succeeds; otherwise it is reset.
+func (e *ExitNode) forwardTCP(app *WireGuard, r *tcp.ForwarderRequest) {
+	id := r.ID()
+	src := net.IP(id.RemoteAddress)
+	dst := net.IP(id.LocalAddress)
+	source := net.JoinHostPort(src.String(), strconv.Itoa(int(id.RemotePort)))
+	destination := net.JoinHostPort(dst.String(), strconv.Itoa(int(id.LocalPort)))
+	logger := e.logger.With(
+		zap.String("protocol", "tcp"),
+		zap.String("source", source),
+		zap.String("destination", destination),
+	)
+
+	peer, ok := e.allowed(app, src, dst)
+	if !ok {
+		if peer != nil {
+			logger.Info("connection denied", zap.String("peer", peer.PublicKey))
+		}
+		r.Complete(true)
+		return
+	}
+	logger = logger.With(zap.String("peer", peer.PublicKey))
+
+	upstream, err := net.DialTimeout("tcp", destination, time.Duration(e.DialTimeout))
+	if err != nil {
+		logger.Info("connection failed", zap.Error(err))
+		r.Complete(true)
+		return
+	}
+
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		logger.Error("creating endpoint", zap.String("error", tcpErr.String()))
+		upstream.Close()
+		r.Complete(true)
+		return
+	}
+	r.Complete(false)
+	conn := gonet.NewTCPConn(&wq, ep)
+
+	start := time.Now()
+	sent, received := proxyTCP(conn, upstream)
+	logger.Info("connection closed",
+		zap.Int64("bytes_sent", sent),
+		zap.Int64("bytes_received", received),
+		zap.Duration("duration", time.Since(start)),
+	)
+}
+
+// forwardUDP proxies a UDP flow from a peer to its destination. Flows
+// that are not allowed are dropped.
+func (e *ExitNode) forwardUDP(app *WireGuard, s *stack.Stack, r *udp.ForwarderRequest) {
+	id := r.ID()
+	src := net.IP(id.RemoteAddress)
+	dst := net.IP(id.LocalAddress)
+	source := net.JoinHostPort(src.String(), strconv.Itoa(int(id.RemotePort)))
+	destination := net.JoinHostPort(dst.String(), strconv.Itoa(int(id.LocalPort)))
+	logger := e.logger.With(
+		zap.String("protocol", "udp"),
+		zap.String("source", source),
+		zap.String("destination", destination),
+	)
+
+	peer, ok := e.allowed(app, src, dst)
+	if !ok {
+		if peer != nil {
+			logger.Info("connection denied", zap.String("peer", peer.PublicKey))
+		}
+		return
+	}
+	logger = logger.With(zap.String("peer", peer.PublicKey))
+
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		logger.Error("creating endpoint", zap.String("error", tcpErr.String()))
+		return
+	}
+	conn := gonet.NewUDPConn(s, &wq, ep)
+
+	// The forwarder expects the handler to return quickly, so the
+	// flow is set up and proxied in the background.
+	go func() {
+		upstream, err := net.DialTimeout("udp", destination, time.Duration(e.DialTimeout))
+		if err != nil {
+			logger.Info("connection failed", zap.Error(err))
+			conn.Close()
+			return
+		}
+
+		start := time.Now()
+		sent, received := proxyUDP(conn, upstream, time.Duration(e.UDPIdleTimeout))
+		logger.Info("connection closed",
+			zap.Int64("bytes_sent", sent),
+			zap.Int64("bytes_received", received),
+			zap.Duration("duration", time.Since(start)),
+		)
+	}()
+}
+
+// proxyTCP copies data between the peer and upstream connections until
+// both directions are done, and returns the number of bytes sent by the
+// peer and received from upstream.
+func proxyTCP(peer, upstream net.Conn) (sent, received int64) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		received, _ = io.Copy(peer, upstream)
+		closeWrite(peer)
+	}()
+	sent, _ = io.Copy(upstream, peer)
+	closeWrite(upstream)
+	wg.Wait()
+
+	peer.Close()
+	upstream.Close()
+	return sent, received
+}
+
+// proxyUDP copies datagrams between the peer and upstream connections
+// until no datagram was copied in either direction for the idle timeout,
+// and returns the number of bytes sent by the peer and received from
+// upstream.
+func proxyUDP(peer, upstream net.Conn, idle time.Duration) (sent, received int64) {
+	var lastActive int64
+	atomic.StoreInt64(&lastActive, time.Now().UnixNano())
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		received = copyDatagrams(peer, upstream, idle, &lastActive)
+		peer.Close()
+	}()
+	sent = copyDatagrams(upstream, peer, idle, &lastActive)
+	upstream.Close()
+	wg.Wait()
+
+	peer.Close()
+	return sent, received
+}
+
+// copyDatagrams copies datagrams from src to dst until the flow has been
+// idle for the timeout or one of the connections fails, and returns the
+// number of bytes copied. lastActive holds the time of the last datagram
+// copied in either direction.
+func copyDatagrams(dst, src net.Conn, idle time.Duration, lastActive *int64) int64 {
+	var n int64
+	buf := make([]byte, maxPacketSize)
+	for {
+		deadline := time.Unix(0, atomic.LoadInt64(lastActive)).Add(idle)
+		src.SetReadDeadline(deadline)
+		nr, err := src.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() &&
+				time.Unix(0, atomic.LoadInt64(lastActive)).Add(idle).After(time.Now()) {
+				continue
+			}
+			return n
+		}
+		if _, err := dst.Write(buf[:nr]); err != nil {
+			return n
+		}
+		n += int64(nr)
+		atomic.StoreInt64(lastActive, time.Now().UnixNano())
+	}
+}
+
+// closeWrite closes the write side of a connection, if supported,
+// so that the other end sees EOF while data can still be read.
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	c.Close()
+}
+
+// containsIP reports whether one of the networks contains ip.
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs parses the networks in CIDR notation,
+// which are known to be valid.
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
@@ -0,0 +1,56 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"net"
+	"testing"
+)
+
+func TestExitNodeRouted(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes []string
+		dst    string
+		want   bool
+	}{
+		{"internet", []string{"0.0.0.0/0"}, "93.184.216.34", true},
+		{"outside the routes", []string{"10.0.0.0/8"}, "93.184.216.34", false},
+		{"loopback", []string{"0.0.0.0/0"}, "127.0.0.1", false},
+		{"loopback named", []string{"0.0.0.0/0", "127.0.0.0/8"}, "127.0.0.1", true},
+		{"loopback host named", []string{"127.0.0.1/32"}, "127.0.0.1", true},
+		{"loopback other host", []string{"127.0.0.1/32"}, "127.0.0.2", false},
+		{"loopback less specific", []string{"96.0.0.0/3"}, "127.0.0.1", false},
+		{"link-local", []string{"0.0.0.0/0"}, "169.254.169.254", false},
+		{"link-local named", []string{"169.254.169.254/32"}, "169.254.169.254", true},
+		{"unspecified", []string{"0.0.0.0/0"}, "0.0.0.0", false},
+		{"multicast", []string{"0.0.0.0/0"}, "224.0.0.251", false},
+		{"IPv6 internet", []string{"::/0"}, "2001:db8::1", true},
+		{"IPv6 loopback", []string{"::/0"}, "::1", false},
+		{"IPv6 loopback named", []string{"::/0", "::1/128"}, "::1", true},
+		{"IPv6 link-local", []string{"::/0"}, "fe80::1", false},
+		{"IPv6 unspecified", []string{"::/0"}, "::", false},
+		{"IPv6 multicast", []string{"::/0"}, "ff02::1", false},
+		{"IPv4-mapped loopback", []string{"0.0.0.0/0"}, "::ffff:127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &ExitNode{routes: parseCIDRs(tt.routes...)}
+			if got := e.routed(net.ParseIP(tt.dst)); got != tt.want {
+				t.Errorf("routed(%s) = %v, want %v", tt.dst, got, tt.want)
+			}
+		})
+	}
+}
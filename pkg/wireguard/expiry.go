@@ -0,0 +1,210 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// peerExpiryInterval is the interval at which
+// expired peers are removed from the device.
+const peerExpiryInterval = 30 * time.Second
+
+// peerExpiryStorageKey is the key under which the expiry
+// of peers with a TTL and the removals are stored.
+const peerExpiryStorageKey = "wireguard/peer-expiry.json"
+
+// expiredPeerRetention is how long the removal of an
+// expired peer that isn't configured anymore is kept.
+const expiredPeerRetention = 30 * 24 * time.Hour
+
+// peerExpiry is the stored expiry of a peer. The expiry of a peer with
+// a TTL is stored when the peer is first configured, so that the TTL
+// doesn't start over when Caddy is reloaded.
+type peerExpiry struct {
+	ExpiresAt time.Time `json:"expires_at"`
+	RemovedAt time.Time `json:"removed_at,omitempty"`
+}
+
+// expiry returns the time at which the peer expires, which is the
+// earliest of its expires_at, its TTL and the expiry of its claims,
+// or the zero time if it doesn't expire.
+func (p *Peer) expiry() time.Time {
+	var expiry time.Time
+	for _, t := range []time.Time{p.ExpiresAt, p.ttlExpiry, p.claimsExpiry()} {
+		if !t.IsZero() && (expiry.IsZero() || t.Before(expiry)) {
+			expiry = t
+		}
+	}
+	return expiry
+}
+
+// claimsExpiry returns the expiry of the claims of the peer, if any.
+func (p *Peer) claimsExpiry() time.Time {
+	if p.Claims == nil {
+		return time.Time{}
+	}
+	return p.Claims.Expires
+}
+
+// expired reports whether the peer has expired.
+func (p *Peer) expired(now time.Time) bool {
+	expiry := p.expiry()
+	return !expiry.IsZero() && now.After(expiry)
+}
+
+// provisionPeerExpiry starts the TTL of peers that are configured for
+// the first time, and leaves out the peers that have expired, so that
+// they are not configured on the device and have no client config.
+// Expired peers that were added at runtime are deleted from the
+// storage, so that they aren't restored again.
+func (w *WireGuard) provisionPeerExpiry() error {
+	records, err := w.loadPeerExpiry()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	configured := make(map[string]bool, len(w.Peers))
+	peers := w.Peers[:0]
+	for _, p := range w.Peers {
+		configured[p.PublicKey] = true
+		if p.TTL > 0 {
+			r, ok := records[p.PublicKey]
+			if !ok {
+				r = peerExpiry{ExpiresAt: now.Add(time.Duration(p.TTL))}
+				records[p.PublicKey] = r
+			}
+			p.ttlExpiry = r.ExpiresAt
+		}
+		if p.expired(now) {
+			w.logger.Debug("leaving out expired peer",
+				zap.String("public_key", p.PublicKey),
+				zap.Time("expired_at", p.expiry()),
+			)
+			if err := deleteStoredPeer(w.ctx, w.ctx.Storage(), p); err != nil {
+				return err
+			}
+			continue
+		}
+		peers = append(peers, p)
+	}
+	w.Peers = peers
+
+	for publicKey, r := range records {
+		if configured[publicKey] {
+			continue
+		}
+		// the TTL starts over when the peer is configured again
+		if r.RemovedAt.IsZero() || now.Sub(r.RemovedAt) > expiredPeerRetention {
+			delete(records, publicKey)
+		}
+	}
+	return w.savePeerExpiry(records)
+}
+
+// loadPeerExpiry loads the stored expiry of the peers by public key.
+func (w *WireGuard) loadPeerExpiry() (map[string]peerExpiry, error) {
+	records := make(map[string]peerExpiry)
+	storage := w.ctx.Storage()
+	if !storage.Exists(w.ctx, peerExpiryStorageKey) {
+		return records, nil
+	}
+	data, err := storage.Load(w.ctx, peerExpiryStorageKey)
+	if err != nil {
+		return nil, fmt.Errorf("loading peer expiry: %v", err)
+	}
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("decoding peer expiry: %v", err)
+	}
+	return records, nil
+}
+
+// savePeerExpiry persists the expiry of the peers.
+func (w *WireGuard) savePeerExpiry(records map[string]peerExpiry) error {
+	data, err := json.Marshal(records)
+	if err != nil {
+		return fmt.Errorf("encoding peer expiry: %v", err)
+	}
+	if err := w.ctx.Storage().Store(w.ctx, peerExpiryStorageKey, data); err != nil {
+		return fmt.Errorf("storing peer expiry: %v", err)
+	}
+	return nil
+}
+
+// storePeerExpiry stores the expiry of a peer.
+func (w *WireGuard) storePeerExpiry(publicKey string, r peerExpiry) error {
+	records, err := w.loadPeerExpiry()
+	if err != nil {
+		return err
+	}
+	records[publicKey] = r
+	return w.savePeerExpiry(records)
+}
+
+// expirePeers periodically removes the peers that have expired,
+// until the app is stopped. Their open connections on the netstack
+// are closed, and their removal is logged and recorded.
+func (w *WireGuard) expirePeers() {
+	ticker := time.NewTicker(peerExpiryInterval)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		var expired []*Peer
+		w.peersMu.RLock()
+		for _, p := range w.Peers {
+			if p.expired(now) {
+				expired = append(expired, p)
+			}
+		}
+		w.peersMu.RUnlock()
+
+		for _, p := range expired {
+			w.removeExpiredPeer(p, now)
+		}
+
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// removeExpiredPeer removes the expired peer and closes its connections.
+func (w *WireGuard) removeExpiredPeer(p *Peer, now time.Time) {
+	ips, _ := parsePrefixIPs(p.addresses())
+	if err := w.removePeer(p.PublicKey); err != nil {
+		w.logger.Error("removing expired peer", zap.String("public_key", p.PublicKey), zap.Error(err))
+		return
+	}
+	closed := 0
+	if w.tnet != nil {
+		closed = w.tnet.AbortConnections(ips)
+	}
+	if err := w.storePeerExpiry(p.PublicKey, peerExpiry{ExpiresAt: p.expiry(), RemovedAt: now}); err != nil {
+		w.logger.Error("recording expired peer", zap.String("public_key", p.PublicKey), zap.Error(err))
+	}
+	w.logger.Info("removed expired peer",
+		zap.String("public_key", p.PublicKey),
+		zap.String("name", p.Name),
+		zap.Time("expired_at", p.expiry()),
+		zap.Int("closed_connections", closed),
+	)
+}
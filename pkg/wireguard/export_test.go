@@ -0,0 +1,37 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import "time"
+
+// CreateEnrollToken is exported for the tests that run
+// the app with the wgtest harness, in package wireguard_test.
+var CreateEnrollToken = createEnrollToken
+
+// RotatePrivateKey rotates the private key of the running app as if the
+// rotation was due, and returns the new public key of the app.
+func RotatePrivateKey() (string, error) {
+	activeAppMu.RLock()
+	app := activeApp
+	activeAppMu.RUnlock()
+	app.KeyRotation.mu.Lock()
+	defer app.KeyRotation.mu.Unlock()
+	if err := app.rotatePrivateKey(time.Now()); err != nil {
+		return "", err
+	}
+	app.peersMu.RLock()
+	defer app.peersMu.RUnlock()
+	return app.publicKey, nil
+}
@@ -0,0 +1,241 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Firewall filters the packets that peers send to the netstack,
+// so that peers can be restricted to specific services. Packets
+// that the hub routes to other peers are not filtered.
+type Firewall struct {
+	// The rules that decide whether a packet is accepted. They are
+	// evaluated in order and the first rule that matches is applied.
+	Rules []*FirewallRule `json:"rules,omitempty"`
+
+	// Whether packets that match none of the rules are dropped.
+	// Default: false
+	DefaultDeny bool `json:"default_deny,omitempty"`
+
+	// whether a rule matches protocols or ports, which makes
+	// packets that can't be parsed that far be dropped
+	inspectsTransport bool
+}
+
+// FirewallRule accepts or drops packets. A packet matches the rule
+// when it matches all of the configured criteria.
+type FirewallRule struct {
+	// The number of packets and bytes that matched the rule.
+	// These are accessed atomically, so they come first.
+	packets uint64
+	bytes   uint64
+
+	// The peers that sent the packet. Matches all peers if empty.
+	Peers *PeerSelector `json:"peers,omitempty"`
+
+	// The transport protocols of the packet: tcp, udp or icmp.
+	// Matches all protocols if empty.
+	Protocols []string `json:"protocols,omitempty"`
+
+	// The destination addresses of the packet in CIDR notation.
+	// Matches all addresses if empty.
+	Destinations []string `json:"destinations,omitempty"`
+
+	// The destination ports of the packet, either a single port
+	// or a range like 8000-8080. Matches all ports if empty.
+	Ports []string `json:"ports,omitempty"`
+
+	// Either "allow" or "deny".
+	Action string `json:"action,omitempty"`
+
+	protocols    []uint8
+	destinations []*net.IPNet
+	ports        []portRange
+}
+
+// portRange is an inclusive range of ports.
+type portRange struct {
+	from, to uint16
+}
+
+// FirewallRuleStats are the counters of a firewall rule.
+type FirewallRuleStats struct {
+	Rule    *FirewallRule `json:"rule"`
+	Packets uint64        `json:"packets"`
+	Bytes   uint64        `json:"bytes"`
+}
+
+// provision parses the rules.
+func (f *Firewall) provision() error {
+	for i, r := range f.Rules {
+		if err := r.provision(); err != nil {
+			return fmt.Errorf("rule %d: %v", i, err)
+		}
+		if len(r.protocols) > 0 || len(r.ports) > 0 {
+			f.inspectsTransport = true
+		}
+	}
+	return nil
+}
+
+// accept reports whether the packet, which was received from a peer,
+// is allowed to reach the netstack. When a rule matches protocols or
+// ports, packets of which those can't be parsed are dropped, so that
+// malformed headers can't slip past the rules.
+func (f *Firewall) accept(app *WireGuard, packet []byte) bool {
+	if f.inspectsTransport && !transportParseable(packet) {
+		return false
+	}
+	src, dst := packetAddrs(packet)
+	if dst == nil {
+		return !f.DefaultDeny
+	}
+	protocol, _, dstPort, hasPorts := packetTransport(packet)
+
+	var (
+		peer       *Peer
+		peerLookup bool
+	)
+	for _, r := range f.Rules {
+		if r.Peers != nil && !peerLookup {
+			peer = app.peerForIP(src)
+			peerLookup = true
+		}
+		if !r.matches(peer, protocol, dst, dstPort, hasPorts) {
+			continue
+		}
+		atomic.AddUint64(&r.packets, 1)
+		atomic.AddUint64(&r.bytes, uint64(len(packet)))
+		return r.Action == actionAllow
+	}
+
+	return !f.DefaultDeny
+}
+
+// stats returns the counters of all rules.
+func (f *Firewall) stats() []FirewallRuleStats {
+	stats := make([]FirewallRuleStats, 0, len(f.Rules))
+	for _, r := range f.Rules {
+		stats = append(stats, FirewallRuleStats{
+			Rule:    r,
+			Packets: atomic.LoadUint64(&r.packets),
+			Bytes:   atomic.LoadUint64(&r.bytes),
+		})
+	}
+	return stats
+}
+
+// provision parses the criteria of the rule.
+func (r *FirewallRule) provision() error {
+	if r.Action != actionAllow && r.Action != actionDeny {
+		return fmt.Errorf("invalid action: %s", r.Action)
+	}
+	for _, p := range r.Protocols {
+		switch strings.ToLower(p) {
+		case "tcp":
+			r.protocols = append(r.protocols, protocolTCP)
+		case "udp":
+			r.protocols = append(r.protocols, protocolUDP)
+		case "icmp":
+			r.protocols = append(r.protocols, protocolICMP, protocolICMPv6)
+		default:
+			return fmt.Errorf("unsupported protocol: %s", p)
+		}
+	}
+	for _, d := range r.Destinations {
+		_, ipnet, err := net.ParseCIDR(d)
+		if err != nil {
+			return fmt.Errorf("invalid destination: %v", err)
+		}
+		r.destinations = append(r.destinations, ipnet)
+	}
+	for _, p := range r.Ports {
+		pr, err := parsePortRange(p)
+		if err != nil {
+			return err
+		}
+		r.ports = append(r.ports, pr)
+	}
+	return nil
+}
+
+// matches reports whether a packet with the given properties matches the rule.
+func (r *FirewallRule) matches(peer *Peer, protocol uint8, dst net.IP, dstPort uint16, hasPorts bool) bool {
+	if r.Peers != nil && (peer == nil || !r.Peers.matches(peer)) {
+		return false
+	}
+	if len(r.protocols) > 0 {
+		found := false
+		for _, p := range r.protocols {
+			if p == protocol {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.destinations) > 0 {
+		found := false
+		for _, d := range r.destinations {
+			if d.Contains(dst) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.ports) > 0 {
+		if !hasPorts {
+			return false
+		}
+		found := false
+		for _, pr := range r.ports {
+			if dstPort >= pr.from && dstPort <= pr.to {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// parsePortRange parses a single port or a range of ports like 8000-8080.
+func parsePortRange(s string) (portRange, error) {
+	parts := strings.SplitN(s, "-", 2)
+	from, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port: %s", s)
+	}
+	to := from
+	if len(parts) == 2 {
+		to, err = strconv.ParseUint(parts[1], 10, 16)
+		if err != nil || to < from {
+			return portRange{}, fmt.Errorf("invalid port range: %s", s)
+		}
+	}
+	return portRange{from: uint16(from), to: uint16(to)}, nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    portRange
+		wantErr bool
+	}{
+		{"443", portRange{443, 443}, false},
+		{"8000-8080", portRange{8000, 8080}, false},
+		{"0-65535", portRange{0, 65535}, false},
+		{"22-22", portRange{22, 22}, false},
+		{"8080-8000", portRange{}, true},
+		{"65536", portRange{}, true},
+		{"1-65536", portRange{}, true},
+		{"-1", portRange{}, true},
+		{"80-", portRange{}, true},
+		{"http", portRange{}, true},
+		{"", portRange{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := parsePortRange(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePortRange(%q) error = %v, wantErr %v", tt.s, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parsePortRange(%q) = %v, want %v", tt.s, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFirewallAccept(t *testing.T) {
+	peerIP, serverIP := net.IPv4(10, 0, 0, 1), net.IPv4(10, 255, 0, 1)
+	udp := ipv4Packet(peerIP, serverIP, 0) // to port 9000
+	truncatedV4 := udp[:22]
+	truncatedV6 := ipv6Packet(ipv6HopByHop, extHeader(protocolUDP, 1)[:12])
+	ports := []byte{0x9c, 0x40, 0x23, 0x28, 0, 8, 0, 0}
+	udpV6 := ipv6Packet(ipv6HopByHop, extHeader(ipv6DestOptions, 0), extHeader(protocolUDP, 0), ports)
+
+	denyPort := FirewallRule{Protocols: []string{"udp"}, Ports: []string{"9000"}, Action: actionDeny}
+	allowPort := FirewallRule{Protocols: []string{"udp"}, Ports: []string{"9000"}, Action: actionAllow}
+	allowDst := FirewallRule{Destinations: []string{"10.255.0.1/32"}, Action: actionAllow}
+
+	tests := []struct {
+		name        string
+		rules       []FirewallRule
+		defaultDeny bool
+		packet      []byte
+		want        bool
+	}{
+		{"denied port", []FirewallRule{denyPort}, false, udp, false},
+		{"denied port behind IPv6 extension headers", []FirewallRule{denyPort}, false, udpV6, false},
+		{"allowed port", []FirewallRule{allowPort}, true, udp, true},
+		{"allowed port behind IPv6 extension headers", []FirewallRule{allowPort}, true, udpV6, true},
+		{"truncated ports with a port rule", []FirewallRule{denyPort}, false, truncatedV4, false},
+		{"truncated extension header with a port rule", []FirewallRule{denyPort}, false, truncatedV6, false},
+		{"truncated ports without transport rules", []FirewallRule{allowDst}, false, truncatedV4, true},
+		{"not IP with a port rule", []FirewallRule{denyPort}, false, []byte{0x10, 0, 0, 0}, false},
+		{"not IP without rules", nil, false, []byte{0x10, 0, 0, 0}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &Firewall{DefaultDeny: tt.defaultDeny}
+			for _, r := range tt.rules {
+				r := r
+				f.Rules = append(f.Rules, &r)
+			}
+			if err := f.provision(); err != nil {
+				t.Fatal(err)
+			}
+			if got := f.accept(nil, tt.packet); got != tt.want {
+				t.Errorf("accept() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	b64 "encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lastHandshakes returns the time of the last handshake with each
+// peer of the device by base64 encoded public key. Peers that never
+// completed a handshake have the zero time.
+func (w *WireGuard) lastHandshakes() (map[string]time.Time, error) {
+	if w.dev == nil {
+		return nil, fmt.Errorf("device not started")
+	}
+	config, err := w.dev.IpcGet()
+	if err != nil {
+		return nil, fmt.Errorf("getting device configuration: %v", err)
+	}
+
+	handshakes := make(map[string]time.Time)
+	var (
+		publicKey string
+		secs      int64
+	)
+	for _, line := range strings.Split(config, "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := parts[0], parts[1]
+		switch key {
+		case "public_key":
+			k, err := hex.DecodeString(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid public key: %v", err)
+			}
+			publicKey = b64.StdEncoding.EncodeToString(k)
+			handshakes[publicKey] = time.Time{}
+		case "last_handshake_time_sec":
+			secs, _ = strconv.ParseInt(value, 10, 64)
+		case "last_handshake_time_nsec":
+			nsecs, _ := strconv.ParseInt(value, 10, 64)
+			if publicKey != "" && (secs != 0 || nsecs != 0) {
+				handshakes[publicKey] = time.Unix(secs, nsecs)
+			}
+		}
+	}
+	return handshakes, nil
+}
+
+// lastHandshake returns the time of the last handshake with the peer,
+// which is the zero time if it never completed a handshake.
+func (w *WireGuard) lastHandshake(publicKey string) (time.Time, error) {
+	handshakes, err := w.lastHandshakes()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return handshakes[publicKey], nil
+}
+
+// initiateHandshake makes the device send a keepalive to the peer,
+// which starts a handshake if there is no current session.
+func (w *WireGuard) initiateHandshake(publicKey string) error {
+	pk, err := noisePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	if peer := w.dev.LookupPeer(pk); peer != nil {
+		peer.SendKeepalive()
+	}
+	return nil
+}
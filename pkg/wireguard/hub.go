@@ -0,0 +1,106 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"fmt"
+)
+
+// Hub routes traffic between peers through the app. Without it,
+// packets from one peer addressed to another peer end up in the
+// netstack, which drops them. In hub mode, these packets are sent
+// to the peer that owns the destination address instead, if the
+// rules allow it.
+type Hub struct {
+	// The rules that decide whether traffic between two peers is
+	// routed. They are evaluated in order and the first rule that
+	// matches is applied.
+	Rules []*HubRule `json:"rules,omitempty"`
+
+	// Whether traffic that matches none of the rules is routed.
+	// Default: false
+	DefaultAllow bool `json:"default_allow,omitempty"`
+}
+
+// HubRule allows or denies traffic between peers.
+type HubRule struct {
+	// The peers the traffic originates from. Matches all peers if empty.
+	From *PeerSelector `json:"from,omitempty"`
+
+	// The peers the traffic is destined for. Matches all peers if empty.
+	To *PeerSelector `json:"to,omitempty"`
+
+	// Either "allow" or "deny".
+	Action string `json:"action,omitempty"`
+}
+
+// Actions of rules.
+const (
+	actionAllow = "allow"
+	actionDeny  = "deny"
+)
+
+// validate checks the rules of the hub.
+func (h *Hub) validate() error {
+	for i, r := range h.Rules {
+		if r.Action != actionAllow && r.Action != actionDeny {
+			return fmt.Errorf("rule %d: invalid action: %s", i, r.Action)
+		}
+	}
+	return nil
+}
+
+// allowed reports whether traffic from one peer to another is routed.
+func (h *Hub) allowed(from, to *Peer) bool {
+	for _, r := range h.Rules {
+		if r.From.matches(from) && r.To.matches(to) {
+			return r.Action == actionAllow
+		}
+	}
+	return h.DefaultAllow
+}
+
+// route hands the packet, which was received from a peer, to inject
+// if it is destined for another peer and the rules allow it. It
+// reports whether the packet was handled, which is also the case
+// when it was dropped because the rules deny it, and whether it was
+// handed to inject. Packets that are not destined for another peer
+// are left for the netstack.
+func (h *Hub) route(app *WireGuard, packet []byte, inject func([]byte)) (handled, routed bool) {
+	src, dst := packetAddrs(packet)
+	if dst == nil {
+		return false, false
+	}
+	for _, a := range app.addresses {
+		if a.Equal(dst) {
+			return false, false
+		}
+	}
+
+	to := app.peerForIP(dst)
+	if to == nil {
+		return false, false
+	}
+	from := app.peerForIP(src)
+	if from == nil || from == to {
+		return false, false
+	}
+
+	if !h.allowed(from, to) {
+		return true, false
+	}
+	inject(packet)
+	return true, true
+}
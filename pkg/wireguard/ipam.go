@@ -0,0 +1,257 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// ipamStorageKey is the key under which address
+// assignments are persisted in the Caddy storage.
+const ipamStorageKey = "wireguard/ipam.json"
+
+// IPAM assigns tunnel addresses to peers that don't have an address
+// configured. Assignments are persisted in the Caddy storage, so that
+// peers keep their addresses when Caddy is restarted.
+type IPAM struct {
+	// The subnets, in CIDR notation, to assign addresses from. Every
+	// peer is assigned a single host address (a /32 or /128) from each
+	// subnet. The addresses of the WireGuard interface itself are
+	// never assigned.
+	Subnets []string `json:"subnets,omitempty"`
+
+	subnets  []*net.IPNet
+	reserved []net.IP
+	ctx      context.Context
+	storage  certmagic.Storage
+
+	mu       sync.Mutex
+	assigned map[string][]string // public key -> addresses
+}
+
+// provision parses the subnets and loads the persisted assignments.
+// The reserved addresses are never assigned to peers. The static
+// addresses are the addresses that are configured on peers, by the
+// public key of the peer; they are reserved too, and assignments of
+// other peers that collide with them are dropped, so that those peers
+// are assigned new addresses.
+func (i *IPAM) provision(ctx context.Context, storage certmagic.Storage, reserved []net.IP, static map[string]string) error {
+	for _, s := range i.Subnets {
+		_, subnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return fmt.Errorf("invalid subnet: %v", err)
+		}
+		i.subnets = append(i.subnets, subnet)
+	}
+	i.reserved = append([]net.IP(nil), reserved...)
+	for a := range static {
+		i.reserved = append(i.reserved, net.ParseIP(a))
+	}
+	i.ctx = ctx
+	i.storage = storage
+	i.assigned = make(map[string][]string)
+
+	if !storage.Exists(ctx, ipamStorageKey) {
+		return nil
+	}
+	data, err := storage.Load(ctx, ipamStorageKey)
+	if err != nil {
+		return fmt.Errorf("loading address assignments: %v", err)
+	}
+	if err := json.Unmarshal(data, &i.assigned); err != nil {
+		return fmt.Errorf("decoding address assignments: %v", err)
+	}
+
+	// drop assignments that became invalid because the subnets or
+	// interface addresses changed, or that collide with an address
+	// that is configured on another peer
+	for key, addrs := range i.assigned {
+		for _, a := range addrs {
+			ip, _, err := net.ParseCIDR(a)
+			if err != nil || i.subnetOf(ip) == nil {
+				delete(i.assigned, key)
+				break
+			}
+			if owner, ok := static[ip.String()]; ok {
+				if owner != key {
+					delete(i.assigned, key)
+					break
+				}
+				continue
+			}
+			if i.isReserved(ip) {
+				delete(i.assigned, key)
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// reserve prevents the addresses from being assigned to peers. It is
+// used for addresses that are configured statically on peers.
+func (i *IPAM) reserve(ips ...net.IP) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.reserved = append(i.reserved, ips...)
+}
+
+// assign returns the addresses assigned to the peer with the
+// public key, assigning new addresses if it has none yet.
+func (i *IPAM) assign(publicKey string) ([]string, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if addrs, ok := i.assigned[publicKey]; ok {
+		return addrs, nil
+	}
+
+	var addrs []string
+	for _, subnet := range i.subnets {
+		ip, err := i.nextFree(subnet)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, hostPrefix(ip))
+	}
+	i.assigned[publicKey] = addrs
+
+	if err := i.save(); err != nil {
+		delete(i.assigned, publicKey)
+		return nil, err
+	}
+
+	return addrs, nil
+}
+
+// release returns the addresses of the peer with the public key
+// to the pool, so that they can be assigned to other peers.
+func (i *IPAM) release(publicKey string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if _, ok := i.assigned[publicKey]; !ok {
+		return nil
+	}
+	delete(i.assigned, publicKey)
+
+	return i.save()
+}
+
+// reclaim releases the addresses of all peers with
+// a public key for which keep returns false.
+func (i *IPAM) reclaim(keep func(publicKey string) bool) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	changed := false
+	for key := range i.assigned {
+		if !keep(key) {
+			delete(i.assigned, key)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	return i.save()
+}
+
+// nextFree returns the lowest address in the subnet that is
+// not reserved and not assigned to a peer.
+func (i *IPAM) nextFree(subnet *net.IPNet) (net.IP, error) {
+	inUse := make(map[string]bool)
+	for _, addrs := range i.assigned {
+		for _, a := range addrs {
+			ip, _, _ := net.ParseCIDR(a)
+			inUse[ip.String()] = true
+		}
+	}
+
+	broadcast := lastIP(subnet)
+	for ip := nextIP(subnet.IP.Mask(subnet.Mask)); subnet.Contains(ip); ip = nextIP(ip) {
+		if ip.To4() != nil && ip.Equal(broadcast) {
+			break
+		}
+		if i.isReserved(ip) || inUse[ip.String()] {
+			continue
+		}
+		return ip, nil
+	}
+
+	return nil, fmt.Errorf("no free addresses left in subnet %s", subnet)
+}
+
+// isReserved reports whether ip is reserved.
+func (i *IPAM) isReserved(ip net.IP) bool {
+	for _, r := range i.reserved {
+		if r.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// subnetOf returns the subnet that contains ip, if any.
+func (i *IPAM) subnetOf(ip net.IP) *net.IPNet {
+	for _, s := range i.subnets {
+		if s.Contains(ip) {
+			return s
+		}
+	}
+	return nil
+}
+
+// save persists the assignments in the storage.
+func (i *IPAM) save() error {
+	data, err := json.Marshal(i.assigned)
+	if err != nil {
+		return fmt.Errorf("encoding address assignments: %v", err)
+	}
+	if err := i.storage.Store(i.ctx, ipamStorageKey, data); err != nil {
+		return fmt.Errorf("storing address assignments: %v", err)
+	}
+	return nil
+}
+
+// nextIP returns the address following ip.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for j := len(next) - 1; j >= 0; j-- {
+		next[j]++
+		if next[j] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// lastIP returns the last address in the subnet.
+func lastIP(subnet *net.IPNet) net.IP {
+	last := make(net.IP, len(subnet.IP))
+	for j := range subnet.IP {
+		last[j] = subnet.IP[j] | ^subnet.Mask[j]
+	}
+	return last
+}
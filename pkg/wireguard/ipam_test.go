@@ -0,0 +1,172 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// testIPAM provisions an IPAM with the subnets and the stored assignments.
+func testIPAM(t *testing.T, subnets []string, stored map[string][]string, reserved []string, static map[string]string) *IPAM {
+	t.Helper()
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	if stored != nil {
+		data, err := json.Marshal(stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Store(context.Background(), ipamStorageKey, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var ips []net.IP
+	for _, r := range reserved {
+		ips = append(ips, net.ParseIP(r))
+	}
+	i := &IPAM{Subnets: subnets}
+	if err := i.provision(context.Background(), storage, ips, static); err != nil {
+		t.Fatal(err)
+	}
+	return i
+}
+
+func TestIPAMNextFree(t *testing.T) {
+	tests := []struct {
+		name     string
+		subnet   string
+		assigned map[string][]string
+		reserved []string
+		want     string
+		wantErr  bool
+	}{
+		{"first", "10.0.0.0/24", nil, nil, "10.0.0.1", false},
+		{"skips reserved", "10.0.0.0/24", nil, []string{"10.0.0.1"}, "10.0.0.2", false},
+		{"skips assigned", "10.0.0.0/24", map[string][]string{"a": {"10.0.0.1/32"}, "b": {"10.0.0.2/32"}}, nil, "10.0.0.3", false},
+		{"fills gaps", "10.0.0.0/24", map[string][]string{"a": {"10.0.0.1/32"}, "b": {"10.0.0.3/32"}}, nil, "10.0.0.2", false},
+		{"last before broadcast", "10.0.0.0/30", map[string][]string{"a": {"10.0.0.1/32"}}, nil, "10.0.0.2", false},
+		{"full", "10.0.0.0/30", map[string][]string{"a": {"10.0.0.1/32"}}, []string{"10.0.0.2"}, "", true},
+		{"IPv6", "fd00::/64", nil, []string{"fd00::1"}, "fd00::2", false},
+		{"IPv6 without broadcast", "fd00::/126", map[string][]string{"a": {"fd00::1/128"}, "b": {"fd00::2/128"}}, nil, "fd00::3", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := testIPAM(t, []string{tt.subnet}, tt.assigned, tt.reserved, nil)
+			got, err := i.nextFree(i.subnets[0])
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("nextFree() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.String() != tt.want {
+				t.Errorf("nextFree() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPAMProvision(t *testing.T) {
+	tests := []struct {
+		name     string
+		stored   map[string][]string
+		reserved []string
+		static   map[string]string
+		want     map[string][]string
+	}{
+		{
+			name:   "kept",
+			stored: map[string][]string{"a": {"10.0.0.2/32"}},
+			want:   map[string][]string{"a": {"10.0.0.2/32"}},
+		},
+		{
+			name:   "outside the subnets",
+			stored: map[string][]string{"a": {"10.1.0.2/32"}, "b": {"10.0.0.3/32"}},
+			want:   map[string][]string{"b": {"10.0.0.3/32"}},
+		},
+		{
+			name:     "interface address",
+			stored:   map[string][]string{"a": {"10.0.0.1/32"}},
+			reserved: []string{"10.0.0.1"},
+			want:     map[string][]string{},
+		},
+		{
+			name:   "configured on another peer",
+			stored: map[string][]string{"a": {"10.0.0.2/32"}, "b": {"10.0.0.3/32"}},
+			static: map[string]string{"10.0.0.2": "c"},
+			want:   map[string][]string{"b": {"10.0.0.3/32"}},
+		},
+		{
+			name:   "configured on the same peer",
+			stored: map[string][]string{"a": {"10.0.0.2/32"}},
+			static: map[string]string{"10.0.0.2": "a"},
+			want:   map[string][]string{"a": {"10.0.0.2/32"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := testIPAM(t, []string{"10.0.0.0/24"}, tt.stored, tt.reserved, tt.static)
+			if !reflect.DeepEqual(i.assigned, tt.want) {
+				t.Errorf("assigned = %v, want %v", i.assigned, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPAMAssignReclaim(t *testing.T) {
+	i := testIPAM(t, []string{"10.0.0.0/24", "fd00::/64"}, nil, []string{"10.0.0.1", "fd00::1"}, map[string]string{"10.0.0.2": "c"})
+
+	for _, tt := range []struct {
+		key  string
+		want []string
+	}{
+		{"a", []string{"10.0.0.3/32", "fd00::2/128"}},
+		{"b", []string{"10.0.0.4/32", "fd00::3/128"}},
+		{"a", []string{"10.0.0.3/32", "fd00::2/128"}},
+	} {
+		got, err := i.assign(tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("assign(%s) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+
+	if err := i.reclaim(func(key string) bool { return key == "b" }); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := i.assigned["a"]; ok {
+		t.Error("addresses of a weren't reclaimed")
+	}
+	got, err := i.assign("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.3/32", "fd00::2/128"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("assign(d) = %v, want reclaimed %v", got, want)
+	}
+
+	// the assignments are restored from the storage
+	restored := &IPAM{Subnets: i.Subnets}
+	if err := restored.provision(context.Background(), i.storage, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored.assigned, i.assigned) {
+		t.Errorf("restored %v, want %v", restored.assigned, i.assigned)
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// usedJWTsStoragePrefix is the prefix under which the
+// JWTs that peers were enrolled with are persisted.
+const usedJWTsStoragePrefix = "wireguard/enroll_jwts"
+
+// errJWTUsed is returned for JWTs that a peer was enrolled with before.
+var errJWTUsed = errors.New("token was already used to enroll a peer")
+
+// JWTAuth authorizes requests with a JWT in the Authorization header,
+// which is verified against the JSON Web Key Set of an IdP. The JWT
+// must have an expiry, and can only be used to enroll a single peer.
+type JWTAuth struct {
+	// The path to a file containing the JSON Web Key Set
+	// with the public keys of the IdP. Required.
+	JWKSFile string `json:"jwks_file,omitempty"`
+
+	// The issuer that is expected in the iss claim. Optional.
+	Issuer string `json:"issuer,omitempty"`
+
+	// The audience that is expected in the aud claim. Optional.
+	Audience string `json:"audience,omitempty"`
+
+	// The claim that holds the groups of the subject.
+	// Default: groups
+	GroupsClaim string `json:"groups_claim,omitempty"`
+
+	keys *jose.JSONWebKeySet
+}
+
+// PeerClaims are the claims of the JWT a peer was enrolled with.
+type PeerClaims struct {
+	// The subject (sub claim) that enrolled the peer.
+	Subject string `json:"subject,omitempty"`
+
+	// The groups of the subject.
+	Groups []string `json:"groups,omitempty"`
+
+	// The expiry (exp claim) of the JWT. The peer is removed
+	// from the device when it expires.
+	Expires time.Time `json:"expires,omitempty"`
+
+	// id identifies the JWT, which is its jti claim
+	// or a hash of the token if it has none.
+	id string
+}
+
+// provision loads the JSON Web Key Set.
+func (j *JWTAuth) provision() error {
+	if j.JWKSFile == "" {
+		return fmt.Errorf("jwks_file is required")
+	}
+	if j.GroupsClaim == "" {
+		j.GroupsClaim = "groups"
+	}
+
+	data, err := ioutil.ReadFile(j.JWKSFile)
+	if err != nil {
+		return fmt.Errorf("reading JWKS: %v", err)
+	}
+	j.keys = new(jose.JSONWebKeySet)
+	if err := json.Unmarshal(data, j.keys); err != nil {
+		return fmt.Errorf("decoding JWKS: %v", err)
+	}
+	if len(j.keys.Keys) == 0 {
+		return fmt.Errorf("JWKS contains no keys")
+	}
+
+	return nil
+}
+
+// verify verifies the JWT carried by the request and returns its claims.
+func (j *JWTAuth) verify(r *http.Request) (*PeerClaims, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, fmt.Errorf("missing bearer token")
+	}
+
+	raw := strings.TrimPrefix(auth, "Bearer ")
+	tok, err := jwt.ParseSigned(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parsing token: %v", err)
+	}
+
+	var claims jwt.Claims
+	custom := make(map[string]interface{})
+	if err := tok.Claims(j.keys, &claims, &custom); err != nil {
+		return nil, fmt.Errorf("verifying token: %v", err)
+	}
+
+	expected := jwt.Expected{Issuer: j.Issuer, Time: time.Now()}
+	if j.Audience != "" {
+		expected.Audience = jwt.Audience{j.Audience}
+	}
+	if err := claims.Validate(expected); err != nil {
+		return nil, fmt.Errorf("validating token: %v", err)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("token has no subject")
+	}
+	// a token without an expiry would enroll peers that never expire
+	if claims.Expiry == nil {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+
+	pc := &PeerClaims{
+		Subject: claims.Subject,
+		Groups:  stringsClaim(custom[j.GroupsClaim]),
+		Expires: claims.Expiry.Time(),
+		id:      claims.ID,
+	}
+	if pc.id == "" {
+		sum := sha256.Sum256([]byte(raw))
+		pc.id = hex.EncodeToString(sum[:])
+	}
+
+	return pc, nil
+}
+
+// usedJWT is the persisted record of a JWT that a peer was enrolled with.
+type usedJWT struct {
+	Subject string    `json:"subject"`
+	Expires time.Time `json:"expires"`
+}
+
+// useJWT calls enroll if no peer was enrolled with the JWT of the
+// claims before, and records the JWT as used if enroll succeeds. Like
+// enrollment tokens, the JWT is locked in the storage while enroll is
+// called, so that it can't be used twice.
+func useJWT(ctx context.Context, storage certmagic.Storage, claims *PeerClaims, enroll func() error) error {
+	key := usedJWTStorageKey(claims.id)
+	if err := storage.Lock(ctx, key); err != nil {
+		return fmt.Errorf("locking token: %v", err)
+	}
+	defer storage.Unlock(ctx, key)
+
+	if storage.Exists(ctx, key) {
+		return errJWTUsed
+	}
+
+	if err := enroll(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(usedJWT{Subject: claims.Subject, Expires: claims.Expires})
+	if err != nil {
+		return fmt.Errorf("encoding token: %v", err)
+	}
+	if err := storage.Store(ctx, key, data); err != nil {
+		return fmt.Errorf("storing token: %v", err)
+	}
+	return nil
+}
+
+// usedJWTStorageKey returns the storage key of the JWT with the ID.
+// Only a hash of the ID is used, because it is chosen by the IdP.
+func usedJWTStorageKey(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return path.Join(usedJWTsStoragePrefix, hex.EncodeToString(sum[:]))
+}
+
+// stringsClaim returns the value of a claim that is
+// either a single string or a list of strings.
+func stringsClaim(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var s []string
+		for _, e := range v {
+			if str, ok := e.(string); ok {
+				s = append(s, str)
+			}
+		}
+		return s
+	}
+	return nil
+}
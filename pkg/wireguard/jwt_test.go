@@ -0,0 +1,188 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// testJWTSigner returns a signer for JWTs, and writes the
+// JWKS with its public key to a file in dir.
+func testJWTSigner(t *testing.T, dir string) (jose.Signer, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk := jose.JSONWebKey{Key: key, KeyID: "test", Algorithm: string(jose.ES256)}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: jwk}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{jwk.Public()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "jwks.json")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return signer, path
+}
+
+func TestJWTAuthVerify(t *testing.T) {
+	dir := t.TempDir()
+	signer, jwksFile := testJWTSigner(t, dir)
+	other, _ := testJWTSigner(t, t.TempDir())
+
+	now := time.Now()
+	expiry := now.Add(time.Hour).Truncate(time.Second)
+	valid := jwt.Claims{
+		Subject:  "alice",
+		Issuer:   "https://idp.example.com",
+		Audience: jwt.Audience{"wireguard"},
+		Expiry:   jwt.NewNumericDate(expiry),
+	}
+	with := func(change func(c *jwt.Claims)) jwt.Claims {
+		c := valid
+		change(&c)
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		signer  jose.Signer
+		claims  jwt.Claims
+		custom  map[string]interface{}
+		header  string
+		want    *PeerClaims
+		wantErr bool
+	}{
+		{
+			name:   "valid",
+			claims: valid,
+			custom: map[string]interface{}{"groups": []string{"staff", "devices"}},
+			want:   &PeerClaims{Subject: "alice", Groups: []string{"staff", "devices"}, Expires: expiry},
+		},
+		{
+			name:   "single group",
+			claims: valid,
+			custom: map[string]interface{}{"groups": "staff"},
+			want:   &PeerClaims{Subject: "alice", Groups: []string{"staff"}, Expires: expiry},
+		},
+		{
+			name:   "jwt id",
+			claims: with(func(c *jwt.Claims) { c.ID = "jti-1" }),
+			want:   &PeerClaims{Subject: "alice", Expires: expiry, id: "jti-1"},
+		},
+		{name: "no expiry", claims: with(func(c *jwt.Claims) { c.Expiry = nil }), wantErr: true},
+		{name: "expired", claims: with(func(c *jwt.Claims) { c.Expiry = jwt.NewNumericDate(now.Add(-time.Hour)) }), wantErr: true},
+		{name: "not yet valid", claims: with(func(c *jwt.Claims) { c.NotBefore = jwt.NewNumericDate(now.Add(time.Hour)) }), wantErr: true},
+		{name: "other issuer", claims: with(func(c *jwt.Claims) { c.Issuer = "https://evil.example.com" }), wantErr: true},
+		{name: "other audience", claims: with(func(c *jwt.Claims) { c.Audience = jwt.Audience{"other"} }), wantErr: true},
+		{name: "no subject", claims: with(func(c *jwt.Claims) { c.Subject = "" }), wantErr: true},
+		{name: "other key", signer: other, claims: valid, wantErr: true},
+		{name: "no bearer token", header: "Basic YWxpY2U6c2VjcmV0", wantErr: true},
+		{name: "malformed token", header: "Bearer not.a.jwt", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := &JWTAuth{JWKSFile: jwksFile, Issuer: "https://idp.example.com", Audience: "wireguard"}
+			if err := j.provision(); err != nil {
+				t.Fatal(err)
+			}
+
+			header := tt.header
+			if header == "" {
+				s := tt.signer
+				if s == nil {
+					s = signer
+				}
+				token, err := jwt.Signed(s).Claims(tt.claims).Claims(tt.custom).CompactSerialize()
+				if err != nil {
+					t.Fatal(err)
+				}
+				header = "Bearer " + token
+			}
+			r, err := http.NewRequest(http.MethodPost, "/enroll", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Header.Set("Authorization", header)
+
+			got, err := j.verify(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.Subject != tt.want.Subject || !reflect.DeepEqual(got.Groups, tt.want.Groups) || !got.Expires.Equal(tt.want.Expires) {
+				t.Errorf("verify() = %+v, want %+v", got, tt.want)
+			}
+			if got.id == "" || (tt.want.id != "" && got.id != tt.want.id) {
+				t.Errorf("verify() id = %q, want %q or a hash of the token", got.id, tt.want.id)
+			}
+		})
+	}
+}
+
+func TestUseJWT(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	ctx := context.Background()
+	alice := &PeerClaims{Subject: "alice", Expires: time.Now().Add(time.Hour), id: "token-1"}
+
+	enrolled := 0
+	enroll := func() error {
+		enrolled++
+		return nil
+	}
+	if err := useJWT(ctx, storage, alice, enroll); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := useJWT(ctx, storage, alice, enroll); err != errJWTUsed {
+		t.Errorf("second use: error = %v, want %v", err, errJWTUsed)
+	}
+	// another token of the same subject enrolls another peer
+	if err := useJWT(ctx, storage, &PeerClaims{Subject: "alice", id: "token-2"}, enroll); err != nil {
+		t.Errorf("other token: %v", err)
+	}
+	if enrolled != 2 {
+		t.Errorf("enrolled %d peers, want 2", enrolled)
+	}
+
+	// a token isn't used up when enrolling fails
+	bob := &PeerClaims{Subject: "bob", id: "token-3"}
+	if err := useJWT(ctx, storage, bob, func() error { return errPeerExists }); err != errPeerExists {
+		t.Errorf("failed enrollment: error = %v, want %v", err, errPeerExists)
+	}
+	if err := useJWT(ctx, storage, bob, enroll); err != nil {
+		t.Errorf("use after failed enrollment: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"crypto/rand"
+	b64 "encoding/base64"
+	"encoding/hex"
+	"fmt"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// decodeKey decodes a base64 encoded WireGuard key.
+func decodeKey(key string) ([]byte, error) {
+	k, err := b64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(k) != device.NoisePublicKeySize {
+		return nil, fmt.Errorf("key should be %d bytes; got %d", device.NoisePublicKeySize, len(k))
+	}
+	return k, nil
+}
+
+// hexKey converts a base64 encoded key into
+// the hex encoding used by the UAPI.
+func hexKey(key string) (string, error) {
+	k, err := decodeKey(key)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(k), nil
+}
+
+// publicKey derives the base64 encoded public key
+// from a base64 encoded private key.
+func publicKey(privateKey string) (string, error) {
+	k, err := decodeKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	pub, err := curve25519.X25519(k, curve25519.Basepoint)
+	if err != nil {
+		return "", err
+	}
+	return b64.StdEncoding.EncodeToString(pub), nil
+}
+
+// GenerateKeyPair generates a new WireGuard key pair and returns
+// the base64 encoded private and public keys.
+func GenerateKeyPair() (privateKey, publicKey string, err error) {
+	k := make([]byte, device.NoisePrivateKeySize)
+	if _, err := rand.Read(k); err != nil {
+		return "", "", fmt.Errorf("generating private key: %v", err)
+	}
+	// clamp the key like wg genkey does
+	k[0] &= 248
+	k[31] = (k[31] & 127) | 64
+	pub, err := curve25519.X25519(k, curve25519.Basepoint)
+	if err != nil {
+		return "", "", err
+	}
+	return b64.StdEncoding.EncodeToString(k), b64.StdEncoding.EncodeToString(pub), nil
+}
+
+// noisePublicKey converts a base64 encoded public
+// key into the type used by the device.
+func noisePublicKey(key string) (device.NoisePublicKey, error) {
+	var pk device.NoisePublicKey
+	k, err := decodeKey(key)
+	if err != nil {
+		return pk, err
+	}
+	copy(pk[:], k)
+	return pk, nil
+}
@@ -0,0 +1,231 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// listenBind is the base Bind of the device when listen addresses are
+// configured. It sends and receives the datagrams of the device on
+// sockets bound to those addresses only, instead of on all interfaces.
+// The sockets are shared with the device of the next config when Caddy
+// is reloaded, like the socket of the UDP mux.
+type listenBind struct {
+	addrs []string
+
+	mu      sync.Mutex
+	conns   []net.PacketConn
+	mark    uint32
+	stopped *int32 // set when the sockets that were opened last are closed
+}
+
+// newListenBind returns a Bind that listens on addrs.
+func newListenBind(addrs []string) *listenBind {
+	return &listenBind{addrs: addrs}
+}
+
+// Open opens a socket on every listen address. The port is
+// ignored, as the listen addresses have ports of their own;
+// the port of the first listen address is reported back.
+func (b *listenBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conns != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+
+	var conns []net.PacketConn
+	closeAll := func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+	for _, addr := range b.addrs {
+		c, err := caddy.ListenPacket("udp", addr)
+		if err != nil {
+			closeAll()
+			return nil, 0, fmt.Errorf("listening on %s: %v", addr, err)
+		}
+		conns = append(conns, c)
+		if b.mark != 0 {
+			if err := setMark(c, b.mark); err != nil {
+				closeAll()
+				return nil, 0, fmt.Errorf("setting firewall mark on %s: %v", addr, err)
+			}
+		}
+	}
+
+	stopped := new(int32)
+	fns := make([]conn.ReceiveFunc, len(conns))
+	for i, c := range conns {
+		fns[i] = receiveFrom(c, stopped)
+	}
+	b.conns = conns
+	b.stopped = stopped
+
+	if addr, ok := conns[0].LocalAddr().(*net.UDPAddr); ok {
+		port = uint16(addr.Port)
+	}
+	return fns, port, nil
+}
+
+// receiveFrom returns the function that receives the datagrams of c
+// until stopped is set. The shared socket isn't really closed when the
+// bind is closed, so reads time out to notice it.
+func receiveFrom(c net.PacketConn, stopped *int32) conn.ReceiveFunc {
+	return func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		for atomic.LoadInt32(stopped) == 0 {
+			c.SetReadDeadline(time.Now().Add(muxReadTimeout))
+			n, addr, err := c.ReadFrom(packets[0])
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					continue
+				}
+				return 0, err
+			}
+			udpAddr, ok := addr.(*net.UDPAddr)
+			if !ok {
+				continue
+			}
+			sizes[0] = n
+			eps[0] = &listenEndpoint{dst: udpAddr.AddrPort(), conn: c}
+			return 1, nil
+		}
+		return 0, net.ErrClosed
+	}
+}
+
+// Close closes the sockets and stops receiving on them.
+func (b *listenBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conns == nil {
+		return nil
+	}
+	atomic.StoreInt32(b.stopped, 1)
+	var firstErr error
+	for _, c := range b.conns {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	b.conns = nil
+	return firstErr
+}
+
+// SetMark sets the firewall mark on the sockets, and
+// on the sockets that are opened later.
+func (b *listenBind) SetMark(mark uint32) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mark = mark
+	for _, c := range b.conns {
+		if err := setMark(c, mark); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Send sends the datagrams from the socket that the endpoint was
+// received on, or else from the first socket of the same address
+// family, like for the endpoints of configured peers.
+func (b *listenBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	le, ok := ep.(*listenEndpoint)
+	if !ok {
+		return conn.ErrWrongEndpointType
+	}
+	c := b.conn(le)
+	if c == nil {
+		return fmt.Errorf("no socket to send to %s from", le.dst)
+	}
+	addr := net.UDPAddrFromAddrPort(le.dst)
+	for _, buf := range bufs {
+		if _, err := c.WriteTo(buf, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// conn returns the open socket to send to ep from.
+func (b *listenBind) conn(ep *listenEndpoint) net.PacketConn {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range b.conns {
+		if c == ep.conn {
+			return c
+		}
+	}
+	is4 := ep.dst.Addr().Unmap().Is4()
+	for _, c := range b.conns {
+		addr, ok := c.LocalAddr().(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		ip, _ := netip.AddrFromSlice(addr.IP)
+		if ip.IsUnspecified() || ip.Unmap().Is4() == is4 {
+			return c
+		}
+	}
+	return nil
+}
+
+// ParseEndpoint parses the ip:port endpoint of a peer.
+func (b *listenBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	dst, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+	return &listenEndpoint{dst: dst}, nil
+}
+
+// BatchSize returns the number of datagrams that are received at once.
+func (b *listenBind) BatchSize() int {
+	return 1
+}
+
+// listenEndpoint is the endpoint of a peer, with the socket
+// that its datagrams were received on, if any.
+type listenEndpoint struct {
+	dst  netip.AddrPort
+	conn net.PacketConn
+}
+
+func (e *listenEndpoint) ClearSrc()           {}
+func (e *listenEndpoint) SrcToString() string { return "" }
+func (e *listenEndpoint) DstToString() string { return e.dst.String() }
+func (e *listenEndpoint) DstIP() netip.Addr   { return e.dst.Addr() }
+func (e *listenEndpoint) SrcIP() netip.Addr   { return netip.Addr{} }
+
+func (e *listenEndpoint) DstToBytes() []byte {
+	b, _ := e.dst.MarshalBinary()
+	return b
+}
+
+// Interface guards
+var (
+	_ conn.Bind     = (*listenBind)(nil)
+	_ conn.Endpoint = (*listenEndpoint)(nil)
+)
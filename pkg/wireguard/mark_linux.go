@@ -0,0 +1,63 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package wireguard
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"syscall"
+)
+
+// setMark sets the firewall mark on the socket of c.
+func setMark(c net.PacketConn, mark uint32) error {
+	sc, ok := syscallConn(c)
+	if !ok {
+		return fmt.Errorf("socket of %s can't be marked", c.LocalAddr())
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var opErr error
+	err = raw.Control(func(fd uintptr) {
+		opErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(mark))
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
+
+// syscallConn returns the socket of c. The sockets returned by
+// caddy.ListenPacket are wrapped, so that they can be shared
+// between configs; the socket is their PacketConn field.
+func syscallConn(c net.PacketConn) (syscall.Conn, bool) {
+	if sc, ok := c.(syscall.Conn); ok {
+		return sc, true
+	}
+	v := reflect.Indirect(reflect.ValueOf(c))
+	if v.Kind() != reflect.Struct {
+		return nil, false
+	}
+	f := v.FieldByName("PacketConn")
+	if !f.IsValid() || !f.CanInterface() {
+		return nil, false
+	}
+	sc, ok := f.Interface().(syscall.Conn)
+	return sc, ok
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(MatchPeer{})
+}
+
+// MatchPeer matches requests that peers send through the tunnel,
+// by the public key, name, groups or tags of the peer, like:
+//
+//	"match": [{"wireguard_peer": {"groups": ["staff"]}}]
+//
+// Requests that don't come from a peer don't match: only requests on
+// connections that were accepted on the tunnel match, from the own
+// addresses of the peer.
+type MatchPeer struct {
+	PeerSelector
+}
+
+// CaddyModule returns the Caddy module information.
+func (MatchPeer) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.wireguard_peer",
+		New: func() caddy.Module { return new(MatchPeer) },
+	}
+}
+
+// Match returns true if the request comes from a selected peer.
+func (m MatchPeer) Match(r *http.Request) bool {
+	p, ok := PeerFromRequest(r)
+	return ok && m.Selects(p)
+}
+
+// Interface guards
+var (
+	_ caddy.Module             = (*MatchPeer)(nil)
+	_ caddyhttp.RequestMatcher = (*MatchPeer)(nil)
+)
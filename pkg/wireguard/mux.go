@@ -0,0 +1,291 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// Timings and limits of the UDP mux.
+const (
+	// muxReadTimeout bounds the reads of the shared socket, so that
+	// the mux of a previous config stops reading soon after a reload.
+	muxReadTimeout = time.Second
+
+	muxSweepInterval = 10 * time.Second
+	maxMuxSessions   = 4096
+)
+
+// UDPMux shares a UDP port between WireGuard and HTTP/3, so that both
+// can use UDP 443 and WireGuard passes networks that only allow 443.
+// It reads the first byte of each datagram: WireGuard messages are
+// handed to the device, which answers from the shared socket, and
+// QUIC packets are relayed to the HTTP/3 listener of Caddy over
+// loopback, from a socket per client. When there are too many QUIC
+// clients, the socket of the least recently active one is closed.
+//
+// The HTTP/3 listener has to listen on another address, like the
+// loopback address of the HTTP server in the example below. Caddy
+// advertises HTTP/3 at the port of that server, so the Alt-Svc header
+// has to be set to the shared port instead.
+type UDPMux struct {
+	// The address to listen on, like :443.
+	Listen string `json:"listen,omitempty"`
+
+	// The address of the HTTP/3 listener to relay QUIC packets to,
+	// like 127.0.0.1:8443. QUIC packets are dropped if it's empty.
+	QUICUpstream string `json:"quic_upstream,omitempty"`
+
+	// The duration after which the socket of an idle QUIC
+	// client is closed. Default: 3m
+	IdleTimeout caddy.Duration `json:"idle_timeout,omitempty"`
+
+	logger       *zap.Logger
+	quicUpstream *net.UDPAddr
+	conn         net.PacketConn
+	mu           sync.Mutex
+	maxSessions  int
+	sessions     map[string]*muxSession
+	endpoints    map[string]*transportEndpoint
+	stopped      int32 // accessed atomically
+}
+
+// muxSession relays the datagrams of a QUIC client to the upstream.
+type muxSession struct {
+	upstream *net.UDPConn
+	last     int64 // unix nanoseconds, accessed atomically
+}
+
+// provision sets the defaults and checks the configuration.
+func (m *UDPMux) provision(logger *zap.Logger) error {
+	m.logger = logger
+	m.maxSessions = maxMuxSessions
+	m.sessions = make(map[string]*muxSession)
+	m.endpoints = make(map[string]*transportEndpoint)
+	if m.Listen == "" {
+		return fmt.Errorf("listen address is required")
+	}
+	if m.IdleTimeout == 0 {
+		m.IdleTimeout = caddy.Duration(3 * time.Minute)
+	}
+	if m.QUICUpstream != "" {
+		var err error
+		m.quicUpstream, err = net.ResolveUDPAddr("udp", m.QUICUpstream)
+		if err != nil {
+			return fmt.Errorf("invalid QUIC upstream: %v", err)
+		}
+	}
+	return nil
+}
+
+// start opens the shared socket and hands the WireGuard messages
+// to the device through bind until the app is stopped. The socket
+// is shared with the mux of the next config when Caddy is reloaded.
+func (m *UDPMux) start(app *WireGuard, bind *appBind) error {
+	conn, err := caddy.ListenPacket("udp", m.Listen)
+	if err != nil {
+		return fmt.Errorf("listening on %s: %v", m.Listen, err)
+	}
+	m.conn = conn
+
+	go m.serve(app, bind)
+	go m.sweepPeriodically(app)
+	return nil
+}
+
+// serve reads the datagrams of the shared socket and
+// relays them, until the app is stopped.
+func (m *UDPMux) serve(app *WireGuard, bind *appBind) {
+	defer m.conn.Close()
+	buf := make([]byte, maxPacketSize)
+	// the shared socket isn't really closed when the app stops, as it's
+	// shared with the next config, so reads time out to notice it
+	for app.ctx.Err() == nil && atomic.LoadInt32(&m.stopped) == 0 {
+		m.conn.SetReadDeadline(time.Now().Add(muxReadTimeout))
+		n, addr, err := m.conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			if app.ctx.Err() == nil && atomic.LoadInt32(&m.stopped) == 0 {
+				m.logger.Error("reading shared socket", zap.Error(err))
+			}
+			return
+		}
+
+		datagram := buf[:n]
+		switch {
+		case isWireGuardMessage(datagram):
+			bind.deliver(append([]byte(nil), datagram...), m.endpoint(addr))
+		case isQUICPacket(datagram) && m.quicUpstream != nil:
+			s, err := m.session(addr)
+			if err != nil {
+				m.logger.Debug("relaying datagram", zap.String("remote_addr", addr.String()), zap.Error(err))
+				continue
+			}
+			atomic.StoreInt64(&s.last, time.Now().UnixNano())
+			s.upstream.Write(datagram)
+		}
+	}
+}
+
+// endpoint returns the endpoint of a WireGuard client on the device,
+// on which the device answers from the shared socket. Endpoints are
+// cached, so that every datagram doesn't need one of its own.
+func (m *UDPMux) endpoint(client net.Addr) *transportEndpoint {
+	key := client.String()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ep, ok := m.endpoints[key]; ok {
+		return ep
+	}
+	if len(m.endpoints) >= m.maxSessions {
+		// endpoints that the device still uses keep working
+		m.endpoints = make(map[string]*transportEndpoint)
+	}
+	conn := m.conn
+	ep := newTransportEndpoint(key, func(b []byte) error {
+		_, err := conn.WriteTo(b, client)
+		return err
+	})
+	m.endpoints[key] = ep
+	return ep
+}
+
+// session returns the session of the QUIC client, which is created
+// if there is none. The datagrams that the upstream sends back to the
+// session are sent to the client from the shared socket. When there
+// are too many sessions, the least recently active one is closed.
+func (m *UDPMux) session(client net.Addr) (*muxSession, error) {
+	key := client.String()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sessions[key]; ok {
+		return s, nil
+	}
+	if len(m.sessions) >= m.maxSessions {
+		m.evictOldest()
+	}
+
+	conn, err := net.DialUDP("udp", nil, m.quicUpstream)
+	if err != nil {
+		return nil, err
+	}
+	s := &muxSession{upstream: conn, last: time.Now().UnixNano()}
+	m.sessions[key] = s
+
+	go func() {
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				// closed when idle
+				return
+			}
+			atomic.StoreInt64(&s.last, time.Now().UnixNano())
+			m.conn.WriteTo(buf[:n], client)
+		}
+	}()
+	return s, nil
+}
+
+// evictOldest closes the least recently active session.
+// It's called with the lock held.
+func (m *UDPMux) evictOldest() {
+	var (
+		oldestKey string
+		oldest    *muxSession
+	)
+	for key, s := range m.sessions {
+		if oldest == nil || atomic.LoadInt64(&s.last) < atomic.LoadInt64(&oldest.last) {
+			oldestKey, oldest = key, s
+		}
+	}
+	if oldest != nil {
+		oldest.upstream.Close()
+		delete(m.sessions, oldestKey)
+	}
+}
+
+// sweepPeriodically closes the sessions of idle
+// clients, and all sessions when the app is stopped.
+func (m *UDPMux) sweepPeriodically(app *WireGuard) {
+	ticker := time.NewTicker(muxSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-app.ctx.Done():
+			m.sweep(time.Time{})
+			return
+		case <-ticker.C:
+			m.sweep(time.Now().Add(-time.Duration(m.IdleTimeout)))
+		}
+	}
+}
+
+// sweep closes the sessions without activity since idleSince,
+// which closes all sessions for the zero time.
+func (m *UDPMux) sweep(idleSince time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, s := range m.sessions {
+		if idleSince.IsZero() || time.Unix(0, atomic.LoadInt64(&s.last)).Before(idleSince) {
+			s.upstream.Close()
+			delete(m.sessions, key)
+		}
+	}
+}
+
+// stop stops relaying and closes all sessions. The
+// shared socket is closed when serve notices it.
+func (m *UDPMux) stop() {
+	atomic.StoreInt32(&m.stopped, 1)
+	m.sweep(time.Time{})
+}
+
+// isWireGuardMessage reports whether the datagram looks like a
+// WireGuard message: a type from 1 to 4, three reserved zero bytes
+// and the size of the type.
+func isWireGuardMessage(b []byte) bool {
+	if len(b) < 4 || b[1] != 0 || b[2] != 0 || b[3] != 0 {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(b) {
+	case device.MessageInitiationType:
+		return len(b) == device.MessageInitiationSize
+	case device.MessageResponseType:
+		return len(b) == device.MessageResponseSize
+	case device.MessageCookieReplyType:
+		return len(b) == device.MessageCookieReplySize
+	case device.MessageTransportType:
+		return len(b) >= device.MessageTransportSize
+	}
+	return false
+}
+
+// isQUICPacket reports whether the datagram looks like a QUIC packet,
+// which has the fixed bit set in both long and short headers.
+func isQUICPacket(b []byte) bool {
+	return len(b) > 0 && b[0]&0x40 != 0
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+func TestIsWireGuardMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		want bool
+	}{
+		{"initiation", wireGuardMessage(device.MessageInitiationType, device.MessageInitiationSize), true},
+		{"response", wireGuardMessage(device.MessageResponseType, device.MessageResponseSize), true},
+		{"cookie reply", wireGuardMessage(device.MessageCookieReplyType, device.MessageCookieReplySize), true},
+		{"keepalive", wireGuardMessage(device.MessageTransportType, device.MessageTransportSize), true},
+		{"transport", wireGuardMessage(device.MessageTransportType, device.MessageTransportSize+1280), true},
+		{"short initiation", wireGuardMessage(device.MessageInitiationType, device.MessageInitiationSize-1), false},
+		{"long response", wireGuardMessage(device.MessageResponseType, device.MessageResponseSize+1), false},
+		{"short transport", wireGuardMessage(device.MessageTransportType, device.MessageTransportSize-1), false},
+		{"unknown type", wireGuardMessage(5, 64), false},
+		{"reserved bytes", append([]byte{1, 0, 1, 0}, make([]byte, device.MessageInitiationSize-4)...), false},
+		{"empty", nil, false},
+		{"QUIC", append([]byte{0xc0, 0, 0, 1}, make([]byte, 1196)...), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isWireGuardMessage(tt.b); got != tt.want {
+				t.Errorf("isWireGuardMessage() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsQUICPacket(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		want bool
+	}{
+		{"long header", []byte{0xc3, 0, 0, 0, 1}, true},
+		{"short header", []byte{0x43, 1, 2, 3}, true},
+		{"fixed bit unset", []byte{0x80, 0, 0, 0, 1}, false},
+		{"WireGuard initiation", wireGuardMessage(device.MessageInitiationType, device.MessageInitiationSize), false},
+		{"empty", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isQUICPacket(tt.b); got != tt.want {
+				t.Errorf("isQUICPacket() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUDPMuxEvictsOldestSession(t *testing.T) {
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+
+	m := &UDPMux{Listen: "127.0.0.1:0", QUICUpstream: upstream.LocalAddr().String()}
+	if err := m.provision(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	m.maxSessions = 4
+	defer m.stop()
+
+	now := time.Now().UnixNano()
+	var first net.Addr
+	for i := 0; i < m.maxSessions; i++ {
+		client := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1024 + i}
+		s, err := m.session(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the first client is the least recently active one
+		s.last = now + int64(i)
+		if i == 0 {
+			first = client
+		}
+	}
+
+	if _, err := m.session(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1024}); err != nil {
+		t.Fatalf("new client with the maximum number of sessions: %v", err)
+	}
+	if len(m.sessions) != m.maxSessions {
+		t.Errorf("%d sessions, want %d", len(m.sessions), m.maxSessions)
+	}
+	if _, ok := m.sessions[first.String()]; ok {
+		t.Error("least recently active session wasn't evicted")
+	}
+}
@@ -0,0 +1,363 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// Limits of the overlap device. The handshake indexes of the overlap
+// device and the addresses of the peers that use it are forgotten when
+// there are too many; they are learned again from the next handshake
+// and the next packet.
+const (
+	maxOverlapIndexes = 1 << 16
+	maxOverlapOwners  = 1 << 16
+)
+
+// overlapDevice is the device with the keys from before a rotation,
+// which keeps serving the peers that haven't switched to the new keys
+// during the overlap window. It shares the Bind and the netstack of the
+// device of the app: the Bind splits off the datagrams for the overlap
+// device, and the TUN device hands it the packets for the peers that
+// last sent their packets through it.
+type overlapDevice struct {
+	dev  *device.Device
+	bind *overlapBind
+	tun  *overlapTUN
+}
+
+// startOverlap starts the overlap device with the previous keys of the
+// rotation, replacing the overlap device that is running, if any. The
+// overlap device only answers peers; it has no endpoints to initiate
+// handshakes with. peersMu must be held.
+func (w *WireGuard) startOverlap() error {
+	w.stopOverlap()
+
+	state := w.KeyRotation.state
+	privateKey := state.PreviousPrivateKey
+	if privateKey == "" {
+		privateKey = w.PrivateKey
+	}
+	privateKeyHex, err := hexKey(privateKey)
+	if err != nil {
+		return err
+	}
+	previousPublicKey, err := publicKey(privateKey)
+	if err != nil {
+		return err
+	}
+	pk, err := noisePublicKey(previousPublicKey)
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "private_key=%s\n", privateKeyHex)
+	for _, p := range w.Peers {
+		publicKey, err := hexKey(p.PublicKey)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "public_key=%s\n", publicKey)
+		psk, ok := state.PreviousPresharedKeys[p.PublicKey]
+		if !ok {
+			psk = p.PresharedKey
+		}
+		if psk != "" {
+			presharedKey, err := hexKey(psk)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(&b, "preshared_key=%s\n", presharedKey)
+		}
+		for _, a := range p.AllowedIPs {
+			fmt.Fprintf(&b, "allowed_ip=%s\n", a)
+		}
+	}
+
+	bind := newOverlapBind(w.bind, pk, privateKey == w.PrivateKey)
+	tun := newOverlapTUN(w.tunDev)
+	logger := log.New(os.Stderr, "overlap: ", log.LstdFlags)
+	dev := device.NewDevice(tun, bind, &device.Logger{Verbosef: logger.Printf, Errorf: logger.Printf})
+	if err := dev.IpcSet(b.String()); err != nil {
+		dev.Close()
+		return fmt.Errorf("configuring overlap device: %v", err)
+	}
+	if err := dev.Up(); err != nil {
+		dev.Close()
+		return fmt.Errorf("starting overlap device: %v", err)
+	}
+	w.bind.setOverlap(bind)
+	w.tunDev.setOverlap(tun)
+	w.overlap = &overlapDevice{dev: dev, bind: bind, tun: tun}
+	return nil
+}
+
+// stopOverlap stops the overlap device, if it is running.
+// peersMu must be held.
+func (w *WireGuard) stopOverlap() {
+	if w.overlap == nil {
+		return
+	}
+	w.bind.setOverlap(nil)
+	w.tunDev.setOverlap(nil)
+	w.overlap.dev.Close()
+	w.overlap = nil
+}
+
+// overlapBind is the Bind of the overlap device. It receives the
+// datagrams that the Bind of the app splits off for it, and sends
+// through the Bind of the app.
+type overlapBind struct {
+	app      *appBind
+	checker  device.CookieChecker // checks that initiations are for the previous key
+	sameKey  bool                 // only the preshared keys were rotated
+	incoming chan overlapDatagram
+
+	mu      sync.Mutex
+	closed  chan struct{} // nil when the bind isn't open
+	indexes map[uint32]struct{}
+}
+
+// overlapDatagram is a datagram for the overlap device.
+type overlapDatagram struct {
+	data []byte
+	ep   conn.Endpoint
+}
+
+// newOverlapBind returns the Bind of an overlap device with the
+// public key, which sends and receives through app.
+func newOverlapBind(app *appBind, publicKey device.NoisePublicKey, sameKey bool) *overlapBind {
+	b := &overlapBind{
+		app:      app,
+		sameKey:  sameKey,
+		incoming: make(chan overlapDatagram, transportQueueLen),
+		indexes:  make(map[uint32]struct{}),
+	}
+	b.checker.Init(publicKey)
+	return b
+}
+
+// route reports whether a datagram that the Bind of the app received
+// is for the overlap device, for the device of the app, or for both.
+// Initiations are for the overlap device when they were made for its
+// public key; when only the preshared keys were rotated, both devices
+// answer them, and the peer accepts the answer with its preshared
+// key. Other messages are for the overlap device when they are
+// addressed to one of its handshake indexes.
+func (b *overlapBind) route(msg []byte) (overlap, app bool) {
+	if !isWireGuardMessage(msg) {
+		return false, true
+	}
+	if binary.LittleEndian.Uint32(msg) == device.MessageInitiationType {
+		if b.sameKey {
+			return true, true
+		}
+		if b.checker.CheckMAC1(msg) {
+			return true, false
+		}
+		return false, true
+	}
+	b.mu.Lock()
+	_, ok := b.indexes[binary.LittleEndian.Uint32(msg[4:8])]
+	b.mu.Unlock()
+	return ok, !ok
+}
+
+// deliver queues a datagram for the overlap device. The bind takes
+// ownership of data. Datagrams are dropped when the bind is closed or
+// when the queue is full.
+func (b *overlapBind) deliver(data []byte, ep conn.Endpoint) {
+	b.mu.Lock()
+	open := b.closed != nil
+	b.mu.Unlock()
+	if !open {
+		return
+	}
+	select {
+	case b.incoming <- overlapDatagram{data: data, ep: ep}:
+	default:
+	}
+}
+
+// Open starts receiving the datagrams that are split off for the
+// overlap device. The port is only reported back.
+func (b *overlapBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+	closed := make(chan struct{})
+	b.closed = closed
+	receive := func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		select {
+		case d := <-b.incoming:
+			sizes[0] = copy(packets[0], d.data)
+			eps[0] = d.ep
+			return 1, nil
+		case <-closed:
+			return 0, net.ErrClosed
+		}
+	}
+	return []conn.ReceiveFunc{receive}, port, nil
+}
+
+// Close stops receiving datagrams. The Bind of the app stays open.
+func (b *overlapBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed != nil {
+		close(b.closed)
+		b.closed = nil
+	}
+	return nil
+}
+
+// SetMark does nothing, as the Bind of the app has the mark.
+func (b *overlapBind) SetMark(mark uint32) error {
+	return nil
+}
+
+// Send remembers the handshake indexes of the overlap device, so that
+// the answers of peers are routed to it, and sends the datagrams
+// through the Bind of the app.
+func (b *overlapBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	for _, buf := range bufs {
+		if !isWireGuardMessage(buf) {
+			continue
+		}
+		switch binary.LittleEndian.Uint32(buf) {
+		case device.MessageInitiationType, device.MessageResponseType:
+			b.mu.Lock()
+			if len(b.indexes) >= maxOverlapIndexes {
+				b.indexes = make(map[uint32]struct{})
+			}
+			b.indexes[binary.LittleEndian.Uint32(buf[4:8])] = struct{}{}
+			b.mu.Unlock()
+		}
+	}
+	return b.app.Send(bufs, ep)
+}
+
+// ParseEndpoint parses the endpoint with the Bind of the app.
+func (b *overlapBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	return b.app.ParseEndpoint(s)
+}
+
+// BatchSize returns the number of datagrams that are received at once.
+func (b *overlapBind) BatchSize() int {
+	return 1
+}
+
+// overlapTUN is the TUN device of the overlap device. It reads the
+// packets that the TUN device of the app hands it, and writes the
+// packets it receives to the netstack through the TUN device of the
+// app, so that they are filtered and counted like any other packets.
+type overlapTUN struct {
+	app      *tunDevice
+	outbound chan *packetBuffer
+	events   chan tun.Event
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newOverlapTUN returns the TUN device of an overlap device.
+func newOverlapTUN(app *tunDevice) *overlapTUN {
+	return &overlapTUN{
+		app:      app,
+		outbound: make(chan *packetBuffer, tunQueueLen),
+		events:   make(chan tun.Event),
+		done:     make(chan struct{}),
+	}
+}
+
+// hand queues a packet for the overlap device, or drops it when
+// the queue is full. The overlap device takes ownership of b.
+func (t *overlapTUN) hand(b *packetBuffer) {
+	select {
+	case t.outbound <- b:
+	default:
+		t.app.putBuffer(b)
+	}
+}
+
+func (t *overlapTUN) File() *os.File           { return nil }
+func (t *overlapTUN) MTU() (int, error)        { return t.app.MTU() }
+func (t *overlapTUN) Name() (string, error)    { return "overlap", nil }
+func (t *overlapTUN) Events() <-chan tun.Event { return t.events }
+func (t *overlapTUN) BatchSize() int           { return 1 }
+func (t *overlapTUN) Write(bufs [][]byte, offset int) (int, error) {
+	return t.app.write(bufs, offset, true)
+}
+
+// Read reads the next packet to be sent to a peer.
+func (t *overlapTUN) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	select {
+	case b := <-t.outbound:
+		sizes[0] = copy(bufs[0][offset:], b.packet())
+		t.app.putBuffer(b)
+		return 1, nil
+	case <-t.done:
+		return 0, os.ErrClosed
+	}
+}
+
+// Close closes the TUN device. The netstack stays open.
+func (t *overlapTUN) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.done)
+		close(t.events)
+	})
+	return nil
+}
+
+// overlapOwners are the tunnel addresses of the peers that last sent
+// their packets through the overlap device, to which the packets for
+// them are sent.
+type overlapOwners map[netip.Addr]struct{}
+
+// packetSource returns the source address of the packet.
+func packetSource(packet []byte) (netip.Addr, bool) {
+	src, _ := packetAddrs(packet)
+	ip, ok := netip.AddrFromSlice(src)
+	return ip.Unmap(), ok
+}
+
+// packetDestination returns the destination address of the packet.
+func packetDestination(packet []byte) (netip.Addr, bool) {
+	_, dst := packetAddrs(packet)
+	ip, ok := netip.AddrFromSlice(dst)
+	return ip.Unmap(), ok
+}
+
+// Interface guards
+var (
+	_ conn.Bind  = (*overlapBind)(nil)
+	_ tun.Device = (*overlapTUN)(nil)
+)
@@ -0,0 +1,179 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"net"
+)
+
+// Offsets of the fields in IPv4 and IPv6 headers.
+const (
+	ipv4SrcOffset = 12
+	ipv4DstOffset = 16
+	ipv4MinLen    = 20
+	ipv6SrcOffset = 8
+	ipv6DstOffset = 24
+	ipv6MinLen    = 40
+)
+
+// packetAddrs returns the source and destination addresses of
+// an IP packet. It returns nil addresses for invalid packets.
+func packetAddrs(packet []byte) (src, dst net.IP) {
+	if len(packet) == 0 {
+		return nil, nil
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < ipv4MinLen {
+			return nil, nil
+		}
+		return net.IP(packet[ipv4SrcOffset : ipv4SrcOffset+net.IPv4len]),
+			net.IP(packet[ipv4DstOffset : ipv4DstOffset+net.IPv4len])
+	case 6:
+		if len(packet) < ipv6MinLen {
+			return nil, nil
+		}
+		return net.IP(packet[ipv6SrcOffset : ipv6SrcOffset+net.IPv6len]),
+			net.IP(packet[ipv6DstOffset : ipv6DstOffset+net.IPv6len])
+	}
+	return nil, nil
+}
+
+// IP protocol numbers.
+const (
+	protocolICMP   = 1
+	protocolTCP    = 6
+	protocolUDP    = 17
+	protocolICMPv6 = 58
+)
+
+// packetTransport returns the transport protocol of an IP packet and,
+// for TCP and UDP, its source and destination ports. The ports are
+// only valid when hasPorts is true, which isn't the case for fragments
+// other than the first one.
+func packetTransport(packet []byte) (protocol uint8, srcPort, dstPort uint16, hasPorts bool) {
+	protocol, hdr, _ := transportHeader(packet)
+	if (protocol != protocolTCP && protocol != protocolUDP) || len(hdr) < 4 {
+		return protocol, 0, 0, false
+	}
+	srcPort = uint16(hdr[0])<<8 | uint16(hdr[1])
+	dstPort = uint16(hdr[2])<<8 | uint16(hdr[3])
+	return protocol, srcPort, dstPort, true
+}
+
+// TCP flags.
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagACK = 0x10
+)
+
+// tcpFlags returns the flags of a TCP packet. The flags are
+// only valid when ok is true.
+func tcpFlags(packet []byte) (flags uint8, ok bool) {
+	protocol, hdr, _ := transportHeader(packet)
+	if protocol != protocolTCP || len(hdr) < 14 {
+		return 0, false
+	}
+	return hdr[13], true
+}
+
+// IPv6 extension headers that are followed to the transport header.
+const (
+	ipv6HopByHop     = 0
+	ipv6Routing      = 43
+	ipv6Fragment     = 44
+	ipv6ESP          = 50
+	ipv6AH           = 51
+	ipv6NoNextHeader = 59
+	ipv6DestOptions  = 60
+)
+
+// transportHeader returns the transport protocol of an IP packet and
+// the part of the packet that starts with its transport header, which
+// is nil for fragments other than the first one. The extension headers
+// of IPv6 packets are followed; the protocol of packets with an ESP
+// header or without a next header is that header, without a transport
+// header. It reports whether the packet could be parsed up to its
+// transport header, which isn't the case for truncated packets.
+func transportHeader(packet []byte) (protocol uint8, hdr []byte, ok bool) {
+	switch {
+	case len(packet) >= ipv4MinLen && packet[0]>>4 == 4:
+		protocol = packet[9]
+		offset := int(packet[0]&0x0f) * 4
+		if fragOffset := (uint16(packet[6])<<8 | uint16(packet[7])) & 0x1fff; fragOffset != 0 {
+			return protocol, nil, true
+		}
+		if offset < ipv4MinLen || len(packet) < offset {
+			return protocol, nil, false
+		}
+		return protocol, packet[offset:], true
+	case len(packet) >= ipv6MinLen && packet[0]>>4 == 6:
+		return ipv6TransportHeader(packet[6], packet[ipv6MinLen:])
+	}
+	return 0, nil, false
+}
+
+// ipv6TransportHeader follows the IPv6 extension headers in
+// payload, starting with the header of type next.
+func ipv6TransportHeader(next uint8, payload []byte) (protocol uint8, hdr []byte, ok bool) {
+	for {
+		var length int
+		switch next {
+		case ipv6HopByHop, ipv6Routing, ipv6DestOptions:
+			if len(payload) < 2 {
+				return next, nil, false
+			}
+			length = (int(payload[1]) + 1) * 8
+		case ipv6AH:
+			if len(payload) < 2 {
+				return next, nil, false
+			}
+			length = (int(payload[1]) + 2) * 4
+		case ipv6Fragment:
+			if len(payload) < 8 {
+				return next, nil, false
+			}
+			if fragOffset := (uint16(payload[2])<<8 | uint16(payload[3])) >> 3; fragOffset != 0 {
+				return payload[0], nil, true
+			}
+			length = 8
+		case ipv6ESP, ipv6NoNextHeader:
+			return next, nil, true
+		default:
+			return next, payload, true
+		}
+		if len(payload) < length {
+			return next, nil, false
+		}
+		next = payload[0]
+		payload = payload[length:]
+	}
+}
+
+// transportParseable reports whether the protocol of an IP packet can
+// be determined and, for the first fragment of TCP and UDP packets,
+// whether the ports are complete.
+func transportParseable(packet []byte) bool {
+	protocol, hdr, ok := transportHeader(packet)
+	if !ok {
+		return false
+	}
+	if (protocol == protocolTCP || protocol == protocolUDP) && hdr != nil && len(hdr) < 4 {
+		return false
+	}
+	return true
+}
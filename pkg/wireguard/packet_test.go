@@ -0,0 +1,97 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// ipv6Packet returns an IPv6 packet with the next header and payload,
+// which starts with the extension headers, if any.
+func ipv6Packet(next uint8, payload ...[]byte) []byte {
+	p := make([]byte, ipv6MinLen)
+	p[0] = 0x60
+	p[6] = next
+	copy(p[ipv6SrcOffset:], net.ParseIP("fd00::1"))
+	copy(p[ipv6DstOffset:], net.ParseIP("fd00::2"))
+	for _, b := range payload {
+		p = append(p, b...)
+	}
+	return p
+}
+
+// extHeader returns an extension header with the next header
+// and the length in 8 byte units, not including the first.
+func extHeader(next uint8, length int) []byte {
+	h := make([]byte, (length+1)*8)
+	h[0] = next
+	h[1] = byte(length)
+	return h
+}
+
+// fragmentHeader returns a fragment header with the next
+// header and the fragment offset in 8 byte units.
+func fragmentHeader(next uint8, offset uint16) []byte {
+	return []byte{next, 0, byte(offset >> 5), byte(offset << 3), 0, 0, 0, 1}
+}
+
+func TestTransportHeader(t *testing.T) {
+	ports := []byte{0x9c, 0x40, 0x01, 0xbb, 0, 8, 0, 0}
+	ah := make([]byte, 16) // 16 bytes: (payload length 2 + 2) * 4
+	ah[0], ah[1] = protocolUDP, 2
+
+	fragment := ipv4Packet(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), 0)
+	fragment[6], fragment[7] = 0, 1
+	options := ipv4Packet(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), 4)
+	options[0] = 0x46
+	badIHL := ipv4Packet(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), 0)
+	badIHL[0] = 0x4f
+
+	tests := []struct {
+		name     string
+		packet   []byte
+		protocol uint8
+		hdr      []byte
+		ok       bool
+	}{
+		{"IPv4", ipv4Packet(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), 0), protocolUDP, []byte{0x9c, 0x40, 0x23, 0x28, 0, 8, 0, 0}, true},
+		{"IPv4 options", options, protocolUDP, options[24:], true},
+		{"IPv4 fragment", fragment, protocolUDP, nil, true},
+		{"IPv4 header longer than packet", badIHL, protocolUDP, nil, false},
+		{"IPv6", ipv6Packet(protocolTCP, ports), protocolTCP, ports, true},
+		{"hop-by-hop", ipv6Packet(ipv6HopByHop, extHeader(protocolUDP, 0), ports), protocolUDP, ports, true},
+		{"routing and destination options", ipv6Packet(ipv6Routing, extHeader(ipv6DestOptions, 2), extHeader(protocolTCP, 0), ports), protocolTCP, ports, true},
+		{"first fragment", ipv6Packet(ipv6Fragment, fragmentHeader(protocolUDP, 0), ports), protocolUDP, ports, true},
+		{"later fragment", ipv6Packet(ipv6Fragment, fragmentHeader(protocolUDP, 185), ports), protocolUDP, nil, true},
+		{"authentication header", ipv6Packet(ipv6AH, ah, ports), protocolUDP, ports, true},
+		{"ESP", ipv6Packet(ipv6ESP, ports), ipv6ESP, nil, true},
+		{"no next header", ipv6Packet(ipv6HopByHop, extHeader(ipv6NoNextHeader, 0)), ipv6NoNextHeader, nil, true},
+		{"truncated extension header", ipv6Packet(ipv6HopByHop, extHeader(protocolUDP, 1)[:12]), ipv6HopByHop, nil, false},
+		{"truncated fragment header", ipv6Packet(ipv6Fragment, []byte{protocolUDP, 0, 0}), ipv6Fragment, nil, false},
+		{"missing extension header", ipv6Packet(ipv6DestOptions), ipv6DestOptions, nil, false},
+		{"not IP", []byte{0x10, 0, 0, 0}, 0, nil, false},
+		{"empty", nil, 0, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			protocol, hdr, ok := transportHeader(tt.packet)
+			if protocol != tt.protocol || !bytes.Equal(hdr, tt.hdr) || ok != tt.ok {
+				t.Errorf("transportHeader() = %d, %x, %v, want %d, %x, %v", protocol, hdr, ok, tt.protocol, tt.hdr, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// Block types, options and values of the pcapng format
+// (https://www.ietf.org/archive/id/draft-tuexen-opsawg-pcapng-02.html).
+const (
+	pcapngSectionHeaderBlock        = 0x0a0d0d0a
+	pcapngInterfaceDescriptionBlock = 0x00000001
+	pcapngEnhancedPacketBlock       = 0x00000006
+
+	pcapngByteOrderMagic = 0x1a2b3c4d
+
+	pcapngOptEndOfOpt = 0
+	pcapngOptIfName   = 2
+	pcapngOptEPBFlags = 2
+
+	pcapngFlagInbound  = 1
+	pcapngFlagOutbound = 2
+
+	// linkTypeRaw is the link type of packets
+	// that start with an IPv4 or IPv6 header.
+	linkTypeRaw = 101
+)
+
+// pcapngWriter writes IP packets in the pcapng format, which can
+// be opened in Wireshark. It writes a single section with a single
+// interface with timestamps in microseconds.
+type pcapngWriter struct {
+	w io.Writer
+}
+
+// newPcapngWriter writes the section header and the description of
+// the interface with the name to w and returns a writer for packets.
+func newPcapngWriter(w io.Writer, name string, snapLen int) (*pcapngWriter, error) {
+	pw := &pcapngWriter{w: w}
+
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1)                  // major version
+	binary.LittleEndian.PutUint16(shb[6:], 0)                  // minor version
+	binary.LittleEndian.PutUint64(shb[8:], 0xffffffffffffffff) // unknown section length
+	if err := pw.writeBlock(pcapngSectionHeaderBlock, shb); err != nil {
+		return nil, err
+	}
+
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], linkTypeRaw)
+	binary.LittleEndian.PutUint32(idb[4:], uint32(snapLen))
+	idb = appendOption(idb, pcapngOptIfName, []byte(name))
+	idb = appendOption(idb, pcapngOptEndOfOpt, nil)
+	if err := pw.writeBlock(pcapngInterfaceDescriptionBlock, idb); err != nil {
+		return nil, err
+	}
+
+	return pw, nil
+}
+
+// writePacket writes a packet that was captured at t. The original
+// length is the length of the packet before it was truncated.
+func (pw *pcapngWriter) writePacket(t time.Time, packet []byte, origLen int, outbound bool) error {
+	ts := uint64(t.UnixNano() / int64(time.Microsecond))
+	epb := make([]byte, 20, 20+len(packet)+16)
+	binary.LittleEndian.PutUint32(epb[0:], 0) // interface ID
+	binary.LittleEndian.PutUint32(epb[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(epb[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(epb[12:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(epb[16:], uint32(origLen))
+	epb = append(epb, packet...)
+	epb = append(epb, make([]byte, pad(len(packet)))...)
+
+	flags := make([]byte, 4)
+	if outbound {
+		binary.LittleEndian.PutUint32(flags, pcapngFlagOutbound)
+	} else {
+		binary.LittleEndian.PutUint32(flags, pcapngFlagInbound)
+	}
+	epb = appendOption(epb, pcapngOptEPBFlags, flags)
+	epb = appendOption(epb, pcapngOptEndOfOpt, nil)
+
+	return pw.writeBlock(pcapngEnhancedPacketBlock, epb)
+}
+
+// writeBlock writes a block with the type and body, which
+// has to be padded to 32 bits already.
+func (pw *pcapngWriter) writeBlock(blockType uint32, body []byte) error {
+	length := 12 + len(body)
+	b := make([]byte, length)
+	binary.LittleEndian.PutUint32(b[0:], blockType)
+	binary.LittleEndian.PutUint32(b[4:], uint32(length))
+	copy(b[8:], body)
+	binary.LittleEndian.PutUint32(b[length-4:], uint32(length))
+	_, err := pw.w.Write(b)
+	return err
+}
+
+// appendOption appends an option with the code and value, padded
+// to 32 bits, to b.
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	header := make([]byte, 4)
+	binary.LittleEndian.PutUint16(header[0:], code)
+	binary.LittleEndian.PutUint16(header[2:], uint16(len(value)))
+	b = append(b, header...)
+	b = append(b, value...)
+	return append(b, make([]byte, pad(len(value)))...)
+}
+
+// pad returns the number of bytes needed to pad n bytes to 32 bits.
+func pad(n int) int {
+	return (4 - n%4) % 4
+}
@@ -0,0 +1,143 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// pcapngBlock is a block that was read back from the pcapng output.
+type pcapngBlock struct {
+	blockType uint32
+	body      []byte
+}
+
+// readPcapngBlocks splits the pcapng output into blocks, checking
+// that the lengths at both ends of the blocks match.
+func readPcapngBlocks(t *testing.T, b []byte) []pcapngBlock {
+	t.Helper()
+	var blocks []pcapngBlock
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("truncated block: %x", b)
+		}
+		length := int(binary.LittleEndian.Uint32(b[4:]))
+		if length%4 != 0 || length < 12 || length > len(b) {
+			t.Fatalf("invalid block length %d", length)
+		}
+		if trailer := int(binary.LittleEndian.Uint32(b[length-4:])); trailer != length {
+			t.Fatalf("block length %d, trailing length %d", length, trailer)
+		}
+		blocks = append(blocks, pcapngBlock{
+			blockType: binary.LittleEndian.Uint32(b),
+			body:      b[8 : length-4],
+		})
+		b = b[length:]
+	}
+	return blocks
+}
+
+func TestPcapngWriter(t *testing.T) {
+	var buf bytes.Buffer
+	pw, err := newPcapngWriter(&buf, "wg0", 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := readPcapngBlocks(t, buf.Bytes())
+	if len(blocks) != 2 {
+		t.Fatalf("got %d header blocks, want 2", len(blocks))
+	}
+
+	shb := blocks[0]
+	if shb.blockType != pcapngSectionHeaderBlock {
+		t.Errorf("first block type = %#x, want a section header block", shb.blockType)
+	}
+	if magic := binary.LittleEndian.Uint32(shb.body); magic != pcapngByteOrderMagic {
+		t.Errorf("byte order magic = %#x", magic)
+	}
+	if major, minor := binary.LittleEndian.Uint16(shb.body[4:]), binary.LittleEndian.Uint16(shb.body[6:]); major != 1 || minor != 0 {
+		t.Errorf("version = %d.%d, want 1.0", major, minor)
+	}
+
+	idb := blocks[1]
+	if idb.blockType != pcapngInterfaceDescriptionBlock {
+		t.Errorf("second block type = %#x, want an interface description block", idb.blockType)
+	}
+	if linkType := binary.LittleEndian.Uint16(idb.body); linkType != linkTypeRaw {
+		t.Errorf("link type = %d, want %d", linkType, linkTypeRaw)
+	}
+	if snapLen := binary.LittleEndian.Uint32(idb.body[4:]); snapLen != 256 {
+		t.Errorf("snap length = %d, want 256", snapLen)
+	}
+	wantName := []byte{pcapngOptIfName, 0, 3, 0, 'w', 'g', '0', 0, 0, 0, 0, 0}
+	if !bytes.Equal(idb.body[8:], wantName) {
+		t.Errorf("interface options = %x, want %x", idb.body[8:], wantName)
+	}
+
+	captured := time.Unix(1600000000, 123456789)
+	tests := []struct {
+		name     string
+		packet   []byte
+		origLen  int
+		outbound bool
+	}{
+		{"empty", []byte{}, 0, false},
+		{"one byte", []byte{0x45}, 1, true},
+		{"three bytes", []byte{0x45, 0, 0}, 3, false},
+		{"four bytes", []byte{0x45, 0, 0, 4}, 4, true},
+		{"truncated", bytes.Repeat([]byte{0x60}, 5), 1280, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			if err := pw.writePacket(captured, tt.packet, tt.origLen, tt.outbound); err != nil {
+				t.Fatal(err)
+			}
+			blocks := readPcapngBlocks(t, buf.Bytes())
+			if len(blocks) != 1 || blocks[0].blockType != pcapngEnhancedPacketBlock {
+				t.Fatalf("got %+v, want a single enhanced packet block", blocks)
+			}
+			epb := blocks[0].body
+
+			ts := uint64(binary.LittleEndian.Uint32(epb[4:]))<<32 | uint64(binary.LittleEndian.Uint32(epb[8:]))
+			if want := uint64(captured.UnixNano() / int64(time.Microsecond)); ts != want {
+				t.Errorf("timestamp = %d, want %d", ts, want)
+			}
+			capLen := int(binary.LittleEndian.Uint32(epb[12:]))
+			if capLen != len(tt.packet) {
+				t.Errorf("captured length = %d, want %d", capLen, len(tt.packet))
+			}
+			if origLen := int(binary.LittleEndian.Uint32(epb[16:])); origLen != tt.origLen {
+				t.Errorf("original length = %d, want %d", origLen, tt.origLen)
+			}
+			if !bytes.Equal(epb[20:20+capLen], tt.packet) {
+				t.Errorf("packet = %x, want %x", epb[20:20+capLen], tt.packet)
+			}
+
+			options := epb[20+capLen+pad(capLen):]
+			flags := uint32(pcapngFlagInbound)
+			if tt.outbound {
+				flags = pcapngFlagOutbound
+			}
+			wantOptions := []byte{pcapngOptEPBFlags, 0, 4, 0, byte(flags), 0, 0, 0, 0, 0, 0, 0}
+			if !bytes.Equal(options, wantOptions) {
+				t.Errorf("options = %x, want %x", options, wantOptions)
+			}
+		})
+	}
+}
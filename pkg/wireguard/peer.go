@@ -0,0 +1,520 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+)
+
+// peersStoragePrefix is the prefix under which peers
+// that are added at runtime are persisted.
+const peersStoragePrefix = "wireguard/peers"
+
+// Errors returned when adding and removing peers.
+var (
+	errPeerExists    = errors.New("peer already exists")
+	errPeerNotFound  = errors.New("peer not found")
+	errPeerNameTaken = errors.New("peer name already taken")
+)
+
+// peerNameRegexp matches valid peer names, which are DNS labels,
+// so that they can be used in hostnames.
+var peerNameRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Peer is a WireGuard peer that is allowed to connect to the device.
+type Peer struct {
+	// The base64 encoded public key of the peer.
+	PublicKey string `json:"public_key,omitempty"`
+
+	// An optional unique name of the peer, which must be a
+	// lowercase DNS label, like laptop-alice. It is used to
+	// publish the peer at <name>.<domain>.
+	Name string `json:"name,omitempty"`
+
+	// The base64 encoded private key of the peer. It is not used by
+	// the device itself; it is only needed to generate a complete
+	// client configuration for the peer, e.g. for mobile onboarding.
+	PrivateKey string `json:"private_key,omitempty"`
+
+	// An optional base64 encoded preshared key.
+	PresharedKey string `json:"preshared_key,omitempty"`
+
+	// The IP ranges, in CIDR notation, that are routed to the peer.
+	// The host addresses (/32 or /128) among them are used as the
+	// interface addresses in generated client configurations.
+	AllowedIPs []string `json:"allowed_ips,omitempty"`
+
+	// The host:port at which the peer can be reached, if known. The
+	// host can be a hostname, which is re-resolved periodically and
+	// when handshakes with the peer fail, so that peers with a
+	// dynamic address can be followed.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// The interval at which an endpoint with a hostname
+	// is re-resolved. Default: 1m
+	ResolveInterval caddy.Duration `json:"resolve_interval,omitempty"`
+
+	// The interval at which keepalive packets are sent to
+	// the peer. Default: 0 (disabled)
+	PersistentKeepalive caddy.Duration `json:"persistent_keepalive,omitempty"`
+
+	// The groups of the peer, like staff or ci, which can be used
+	// to select peers. Enrolled peers are also members of the
+	// groups in the claims of their JWT.
+	Groups []string `json:"groups,omitempty"`
+
+	// Tags of the peer, like app=api, which can be used
+	// to select peers.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// The time at which the peer expires. Expired peers are removed
+	// from the device and their connections are closed. Default: never
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+
+	// The duration after which the peer expires, counted from when
+	// it is first configured or added. Default: never
+	TTL caddy.Duration `json:"ttl,omitempty"`
+
+	// The claims of the JWT the peer was enrolled with, if any.
+	// The peer is removed from the device when they expire.
+	Claims *PeerClaims `json:"claims,omitempty"`
+
+	// Limits the throughput of the peer. Default: the
+	// peer limit of the app, if any
+	Limit *BandwidthLimit `json:"limit,omitempty"`
+
+	allowedNets []*net.IPNet
+	traffic     *peerTraffic
+	resolved    string
+	resolvedAt  time.Time
+	ttlExpiry   time.Time
+}
+
+// PeerSelector selects peers by their public key, name, group or
+// tags. A peer is selected when it matches any of the keys, names or
+// groups, or when it has all of the tags. An empty selector selects
+// all peers.
+type PeerSelector struct {
+	// The base64 encoded public keys of the peers to select.
+	PublicKeys []string `json:"public_keys,omitempty"`
+
+	// The names of the peers to select.
+	Names []string `json:"names,omitempty"`
+
+	// The groups of the peers to select.
+	Groups []string `json:"groups,omitempty"`
+
+	// The tags that the peers to select have.
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// Selects reports whether the selector selects the peer.
+func (s *PeerSelector) Selects(p PeerInfo) bool {
+	return s.selects(p.PublicKey, p.Name, p.Groups, p.Tags)
+}
+
+// matches reports whether the selector selects the peer.
+func (s *PeerSelector) matches(p *Peer) bool {
+	return s.selects(p.PublicKey, p.Name, p.groups(), p.Tags)
+}
+
+// selects reports whether the selector selects
+// the peer with the attributes.
+func (s *PeerSelector) selects(publicKey, name string, groups []string, tags map[string]string) bool {
+	if s == nil || (len(s.PublicKeys) == 0 && len(s.Names) == 0 && len(s.Groups) == 0 && len(s.Tags) == 0) {
+		return true
+	}
+	if len(s.Tags) > 0 {
+		hasTags := true
+		for k, v := range s.Tags {
+			if pv, ok := tags[k]; !ok || pv != v {
+				hasTags = false
+				break
+			}
+		}
+		if hasTags {
+			return true
+		}
+	}
+	for _, k := range s.PublicKeys {
+		if k == publicKey {
+			return true
+		}
+	}
+	if name != "" {
+		for _, n := range s.Names {
+			if n == name {
+				return true
+			}
+		}
+	}
+	for _, g := range groups {
+		for _, sg := range s.Groups {
+			if g == sg {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validate checks the configuration of the peer
+// and parses its allowed IPs.
+func (p *Peer) validate() error {
+	if _, err := decodeKey(p.PublicKey); err != nil {
+		return fmt.Errorf("invalid public key: %v", err)
+	}
+	if p.Name != "" && !peerNameRegexp.MatchString(p.Name) {
+		return fmt.Errorf("invalid name %q: must be a lowercase DNS label", p.Name)
+	}
+	if p.PrivateKey != "" {
+		pub, err := publicKey(p.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("invalid private key: %v", err)
+		}
+		if pub != p.PublicKey {
+			return fmt.Errorf("private key does not match public key")
+		}
+	}
+	if p.PresharedKey != "" {
+		if _, err := decodeKey(p.PresharedKey); err != nil {
+			return fmt.Errorf("invalid preshared key: %v", err)
+		}
+	}
+	if err := p.parseAllowedIPs(); err != nil {
+		return err
+	}
+	if p.Endpoint != "" {
+		if _, _, err := net.SplitHostPort(p.Endpoint); err != nil {
+			return fmt.Errorf("invalid endpoint: %v", err)
+		}
+	}
+	if p.Limit != nil {
+		if err := p.Limit.validate(); err != nil {
+			return err
+		}
+	}
+	for _, g := range p.Groups {
+		if g == "" {
+			return fmt.Errorf("group names must not be empty")
+		}
+	}
+	if p.TTL < 0 {
+		return fmt.Errorf("ttl must not be negative")
+	}
+	return nil
+}
+
+// writeUAPI writes the configuration of the peer
+// in the format expected by device.IpcSet to out.
+func (p *Peer) writeUAPI(out io.Writer) error {
+	publicKey, err := hexKey(p.PublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %v", err)
+	}
+	fmt.Fprintf(out, "public_key=%s\n", publicKey)
+	if p.PresharedKey != "" {
+		presharedKey, err := hexKey(p.PresharedKey)
+		if err != nil {
+			return fmt.Errorf("invalid preshared key: %v", err)
+		}
+		fmt.Fprintf(out, "preshared_key=%s\n", presharedKey)
+	}
+	if endpoint := p.endpoint(); endpoint != "" {
+		fmt.Fprintf(out, "endpoint=%s\n", endpoint)
+	}
+	if p.PersistentKeepalive > 0 {
+		fmt.Fprintf(out, "persistent_keepalive_interval=%d\n", time.Duration(p.PersistentKeepalive)/time.Second)
+	}
+	for _, a := range p.AllowedIPs {
+		fmt.Fprintf(out, "allowed_ip=%s\n", a)
+	}
+	return nil
+}
+
+// parseAllowedIPs parses the allowed IPs of the peer.
+func (p *Peer) parseAllowedIPs() error {
+	nets := make([]*net.IPNet, 0, len(p.AllowedIPs))
+	for _, a := range p.AllowedIPs {
+		_, ipnet, err := net.ParseCIDR(a)
+		if err != nil {
+			return fmt.Errorf("invalid allowed IP: %v", err)
+		}
+		nets = append(nets, ipnet)
+	}
+	p.allowedNets = nets
+	return nil
+}
+
+// groups returns the groups the peer is a member of: its configured
+// groups and the groups in its claims.
+func (p *Peer) groups() []string {
+	if p.Claims == nil || len(p.Claims.Groups) == 0 {
+		return p.Groups
+	}
+	if len(p.Groups) == 0 {
+		return p.Claims.Groups
+	}
+	groups := make([]string, 0, len(p.Groups)+len(p.Claims.Groups))
+	groups = append(groups, p.Groups...)
+	return append(groups, p.Claims.Groups...)
+}
+
+// addresses returns the host addresses among the allowed IPs
+// of the peer, which are the addresses of the peer itself.
+func (p *Peer) addresses() []string {
+	var addrs []string
+	for _, a := range p.AllowedIPs {
+		_, ipnet, err := net.ParseCIDR(a)
+		if err != nil {
+			continue
+		}
+		if ones, bits := ipnet.Mask.Size(); ones == bits {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+// addPeer adds a peer to the running device. The peer is persisted
+// in the storage, so that it is restored when Caddy is restarted.
+func (w *WireGuard) addPeer(p *Peer) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	if p.TTL > 0 {
+		p.ttlExpiry = time.Now().Add(time.Duration(p.TTL))
+	}
+	var resolved string
+	var resolvedAt time.Time
+	if p.hasEndpointHostname() {
+		resolvedAt = time.Now()
+		endpoint, err := p.resolveEndpoint(w.ctx)
+		if err != nil {
+			return fmt.Errorf("resolving endpoint: %v", err)
+		}
+		resolved = endpoint
+	}
+
+	w.peersMu.Lock()
+	defer w.peersMu.Unlock()
+
+	p.resolved, p.resolvedAt = resolved, resolvedAt
+
+	for _, existing := range w.Peers {
+		if existing.PublicKey == p.PublicKey {
+			return errPeerExists
+		}
+		if p.Name != "" && existing.Name == p.Name {
+			return errPeerNameTaken
+		}
+	}
+
+	assigned := false
+	if len(p.addresses()) == 0 && w.IPAM != nil {
+		assigned = true
+		addrs, err := w.IPAM.assign(p.PublicKey)
+		if err != nil {
+			return fmt.Errorf("assigning addresses: %v", err)
+		}
+		p.AllowedIPs = append(p.AllowedIPs, addrs...)
+		if err := p.parseAllowedIPs(); err != nil {
+			return err
+		}
+	}
+
+	err := func() error {
+		var b strings.Builder
+		if err := p.writeUAPI(&b); err != nil {
+			return err
+		}
+		if err := w.dev.IpcSet(b.String()); err != nil {
+			return fmt.Errorf("adding peer to device: %v", err)
+		}
+		err := storePeer(w.ctx, w.ctx.Storage(), p)
+		if err == nil && p.TTL > 0 {
+			err = w.storePeerExpiry(p.PublicKey, peerExpiry{ExpiresAt: p.ttlExpiry})
+		}
+		if err != nil {
+			// the peer isn't added, so it mustn't be able to connect
+			if pk, keyErr := noisePublicKey(p.PublicKey); keyErr == nil {
+				w.dev.RemovePeer(pk)
+			}
+			deleteStoredPeer(w.ctx, w.ctx.Storage(), p)
+			return err
+		}
+		return nil
+	}()
+	if err != nil {
+		if w.IPAM != nil {
+			w.IPAM.release(p.PublicKey)
+		}
+		return err
+	}
+	if w.IPAM != nil && !assigned {
+		// addresses configured on the peer are never assigned to others
+		ips, _ := parsePrefixIPs(p.addresses())
+		w.IPAM.reserve(ips...)
+	}
+	w.initTraffic(p)
+	w.Peers = append(w.Peers, p)
+	w.routes = newPeerRoutes(w.Peers)
+
+	return nil
+}
+
+// peerForIP returns the peer that the IP is routed to, which is the
+// peer with the most specific allowed IP that contains it, or nil.
+func (w *WireGuard) peerForIP(ip net.IP) *Peer {
+	w.peersMu.RLock()
+	defer w.peersMu.RUnlock()
+	return w.routes.lookup(ip)
+}
+
+// peerByName returns the peer with the name, or nil.
+func (w *WireGuard) peerByName(name string) *Peer {
+	if name == "" {
+		return nil
+	}
+	w.peersMu.RLock()
+	defer w.peersMu.RUnlock()
+	for _, p := range w.Peers {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// removePeer removes the peer with the public key from the running
+// device and from the storage and releases its addresses.
+func (w *WireGuard) removePeer(publicKey string) error {
+	w.peersMu.Lock()
+	defer w.peersMu.Unlock()
+
+	idx := -1
+	for i, p := range w.Peers {
+		if p.PublicKey == publicKey {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return errPeerNotFound
+	}
+	p := w.Peers[idx]
+
+	pk, err := noisePublicKey(p.PublicKey)
+	if err != nil {
+		return err
+	}
+	w.dev.RemovePeer(pk)
+	if w.overlap != nil {
+		w.overlap.dev.RemovePeer(pk)
+	}
+	w.Peers = append(w.Peers[:idx], w.Peers[idx+1:]...)
+	w.routes = newPeerRoutes(w.Peers)
+	delete(w.storedTraffic, p.PublicKey)
+
+	if err := deleteStoredPeer(w.ctx, w.ctx.Storage(), p); err != nil {
+		return err
+	}
+	if w.IPAM != nil {
+		if err := w.IPAM.release(p.PublicKey); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadPeers loads the peers that were added at runtime from the storage.
+func loadPeers(ctx context.Context, storage certmagic.Storage) ([]*Peer, error) {
+	if !storage.Exists(ctx, peersStoragePrefix) {
+		return nil, nil
+	}
+	keys, err := storage.List(ctx, peersStoragePrefix, false)
+	if err != nil {
+		return nil, fmt.Errorf("listing stored peers: %v", err)
+	}
+
+	peers := make([]*Peer, 0, len(keys))
+	for _, key := range keys {
+		data, err := storage.Load(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("loading stored peer: %v", err)
+		}
+		var p Peer
+		if err := json.Unmarshal(data, &p); err != nil {
+			return nil, fmt.Errorf("decoding stored peer %s: %v", key, err)
+		}
+		peers = append(peers, &p)
+	}
+
+	return peers, nil
+}
+
+// storePeer persists the peer in the storage.
+func storePeer(ctx context.Context, storage certmagic.Storage, p *Peer) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("encoding peer: %v", err)
+	}
+	key, err := peerStorageKey(p)
+	if err != nil {
+		return err
+	}
+	if err := storage.Store(ctx, key, data); err != nil {
+		return fmt.Errorf("storing peer: %v", err)
+	}
+	return nil
+}
+
+// deleteStoredPeer deletes the peer from the storage, if it is stored.
+func deleteStoredPeer(ctx context.Context, storage certmagic.Storage, p *Peer) error {
+	key, err := peerStorageKey(p)
+	if err != nil {
+		return err
+	}
+	if !storage.Exists(ctx, key) {
+		return nil
+	}
+	if err := storage.Delete(ctx, key); err != nil {
+		return fmt.Errorf("deleting stored peer: %v", err)
+	}
+	return nil
+}
+
+// peerStorageKey returns the storage key of the peer. The public
+// key is hex encoded, because base64 may contain slashes.
+func peerStorageKey(p *Peer) (string, error) {
+	publicKey, err := hexKey(p.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(peersStoragePrefix, publicKey+".json"), nil
+}
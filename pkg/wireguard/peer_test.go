@@ -0,0 +1,103 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPeerSelectorSelects(t *testing.T) {
+	peer := PeerInfo{
+		PublicKey: "PEERKEY",
+		Name:      "laptop",
+		Groups:    []string{"staff", "devices"},
+		Tags:      map[string]string{"role": "dev", "os": "linux"},
+	}
+
+	tests := []struct {
+		name     string
+		selector *PeerSelector
+		peer     PeerInfo
+		want     bool
+	}{
+		{name: "nil selector", selector: nil, peer: peer, want: true},
+		{name: "empty selector", selector: &PeerSelector{}, peer: peer, want: true},
+		{name: "public key", selector: &PeerSelector{PublicKeys: []string{"OTHERKEY", "PEERKEY"}}, peer: peer, want: true},
+		{name: "other public key", selector: &PeerSelector{PublicKeys: []string{"OTHERKEY"}}, peer: peer, want: false},
+		{name: "name", selector: &PeerSelector{Names: []string{"laptop"}}, peer: peer, want: true},
+		{name: "other name", selector: &PeerSelector{Names: []string{"phone"}}, peer: peer, want: false},
+		{name: "empty name", selector: &PeerSelector{Names: []string{""}}, peer: PeerInfo{PublicKey: "PEERKEY"}, want: false},
+		{name: "group", selector: &PeerSelector{Groups: []string{"admins", "devices"}}, peer: peer, want: true},
+		{name: "other group", selector: &PeerSelector{Groups: []string{"admins"}}, peer: peer, want: false},
+		{name: "all tags", selector: &PeerSelector{Tags: map[string]string{"role": "dev", "os": "linux"}}, peer: peer, want: true},
+		{name: "some tags", selector: &PeerSelector{Tags: map[string]string{"role": "dev", "os": "macos"}}, peer: peer, want: false},
+		{name: "missing tag", selector: &PeerSelector{Tags: map[string]string{"team": "ops"}}, peer: peer, want: false},
+		{name: "any of", selector: &PeerSelector{Names: []string{"phone"}, Groups: []string{"staff"}}, peer: peer, want: true},
+		{name: "none of", selector: &PeerSelector{Names: []string{"phone"}, Tags: map[string]string{"role": "ops"}}, peer: peer, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.selector.Selects(tt.peer); got != tt.want {
+				t.Errorf("Selects() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandlePeers(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	app := &WireGuard{
+		peersMu: new(sync.RWMutex),
+		Peers: []*Peer{
+			{PublicKey: "PERMANENT", AllowedIPs: []string{"10.0.0.1/32"}},
+			{PublicKey: "EXPIRING", AllowedIPs: []string{"10.0.0.2/32"}, ExpiresAt: expiresAt},
+			{PublicKey: "EXPIRED", AllowedIPs: []string{"10.0.0.3/32"}, ExpiresAt: time.Now().Add(-time.Minute)},
+		},
+	}
+	activeAppMu.Lock()
+	activeApp = app
+	activeAppMu.Unlock()
+	defer func() {
+		activeAppMu.Lock()
+		activeApp = nil
+		activeAppMu.Unlock()
+	}()
+
+	rec := httptest.NewRecorder()
+	if err := (adminAPI{}).handlePeers(rec, httptest.NewRequest(http.MethodGet, "/wireguard/peers", nil)); err != nil {
+		t.Fatal(err)
+	}
+	var peers []PeerInfo
+	if err := json.NewDecoder(rec.Body).Decode(&peers); err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 || peers[0].PublicKey != "PERMANENT" || peers[1].PublicKey != "EXPIRING" {
+		t.Fatalf("handlePeers() = %+v, want the peers that haven't expired", peers)
+	}
+	if peers[0].ExpiresAt != nil {
+		t.Errorf("expires_at of permanent peer = %v, want none", peers[0].ExpiresAt)
+	}
+	if peers[1].ExpiresAt == nil || !peers[1].ExpiresAt.Equal(expiresAt) {
+		t.Errorf("expires_at of expiring peer = %v, want %v", peers[1].ExpiresAt, expiresAt)
+	}
+	if len(peers[1].Addresses) != 1 || peers[1].Addresses[0].String() != "10.0.0.2" {
+		t.Errorf("addresses of expiring peer = %v, want [10.0.0.2]", peers[1].Addresses)
+	}
+}
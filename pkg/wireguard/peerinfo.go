@@ -0,0 +1,185 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// PeerInfo describes a peer of the running WireGuard app, so that
+// other Caddy modules, like matchers, handlers and transports, can
+// make decisions based on its name, groups and tags instead of its
+// public key. It is a copy, which doesn't change with the peer.
+type PeerInfo struct {
+	// The base64 encoded public key of the peer.
+	PublicKey string `json:"public_key"`
+
+	// The name of the peer, if any.
+	Name string `json:"name,omitempty"`
+
+	// The groups of the peer, including the
+	// groups in the claims of its JWT.
+	Groups []string `json:"groups,omitempty"`
+
+	// The tags of the peer.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// The addresses of the peer on the tunnel.
+	Addresses []net.IP `json:"addresses,omitempty"`
+
+	// The time at which the peer expires, if it does.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// InGroup reports whether the peer is a member of the group.
+func (i PeerInfo) InGroup(group string) bool {
+	for _, g := range i.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// Peers returns the peers of the running WireGuard app that
+// haven't expired, or nil if the app isn't running.
+func Peers() []PeerInfo {
+	app := running()
+	if app == nil {
+		return nil
+	}
+	return app.peerInfos(time.Now())
+}
+
+// peerInfos returns the peers of the app, without the peers that
+// have expired but weren't removed by the expiry routine yet.
+func (w *WireGuard) peerInfos(now time.Time) []PeerInfo {
+	w.peersMu.RLock()
+	defer w.peersMu.RUnlock()
+
+	peers := make([]PeerInfo, 0, len(w.Peers))
+	for _, p := range w.Peers {
+		if !p.expired(now) {
+			peers = append(peers, p.info())
+		}
+	}
+	return peers
+}
+
+// LookupPeer returns the peer of the running WireGuard app that
+// the IP is routed to, like the remote address of a connection
+// on the tunnel. It reports whether there is such a peer.
+func LookupPeer(ip net.IP) (PeerInfo, bool) {
+	app := running()
+	if app == nil {
+		return PeerInfo{}, false
+	}
+	app.peersMu.RLock()
+	defer app.peersMu.RUnlock()
+	p := app.routes.lookup(ip)
+	if p == nil {
+		return PeerInfo{}, false
+	}
+	return p.info(), true
+}
+
+// LookupPeerByPublicKey returns the peer of the running WireGuard
+// app with the base64 encoded public key, and reports whether
+// there is such a peer.
+func LookupPeerByPublicKey(publicKey string) (PeerInfo, bool) {
+	app := running()
+	if app == nil {
+		return PeerInfo{}, false
+	}
+	app.peersMu.RLock()
+	defer app.peersMu.RUnlock()
+	for _, p := range app.Peers {
+		if p.PublicKey == publicKey {
+			return p.info(), true
+		}
+	}
+	return PeerInfo{}, false
+}
+
+// LookupPeerByName returns the peer of the running WireGuard
+// app with the name, and reports whether there is such a peer.
+func LookupPeerByName(name string) (PeerInfo, bool) {
+	app := running()
+	if app == nil || name == "" {
+		return PeerInfo{}, false
+	}
+	app.peersMu.RLock()
+	defer app.peersMu.RUnlock()
+	for _, p := range app.Peers {
+		if p.Name == name {
+			return p.info(), true
+		}
+	}
+	return PeerInfo{}, false
+}
+
+// tunnelConnKey is the context key of the app that accepted a
+// connection on the tunnel.
+type tunnelConnKey struct{}
+
+// PeerFromRequest returns the peer that sent the request through the
+// tunnel, and reports whether there is such a peer. Only requests on
+// connections that were accepted on the tunnel have a peer, and only
+// when their remote address is one of the own addresses of the peer,
+// not an address in a network that is routed to it.
+func PeerFromRequest(r *http.Request) (PeerInfo, bool) {
+	app, ok := r.Context().Value(tunnelConnKey{}).(*WireGuard)
+	if !ok {
+		return PeerInfo{}, false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return PeerInfo{}, false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return PeerInfo{}, false
+	}
+	app.peersMu.RLock()
+	defer app.peersMu.RUnlock()
+	p := app.routes.host(ip)
+	if p == nil {
+		return PeerInfo{}, false
+	}
+	return p.info(), true
+}
+
+// info returns a copy of the attributes of the peer.
+func (p *Peer) info() PeerInfo {
+	ips, _ := parsePrefixIPs(p.addresses())
+	tags := make(map[string]string, len(p.Tags))
+	for k, v := range p.Tags {
+		tags[k] = v
+	}
+	var expiresAt *time.Time
+	if expiry := p.expiry(); !expiry.IsZero() {
+		expiresAt = &expiry
+	}
+	return PeerInfo{
+		PublicKey: p.PublicKey,
+		Name:      p.Name,
+		Groups:    append([]string(nil), p.groups()...),
+		Tags:      tags,
+		Addresses: ips,
+		ExpiresAt: expiresAt,
+	}
+}
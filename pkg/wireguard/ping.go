@@ -0,0 +1,134 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// Defaults and limits for pinging through the tunnel.
+const (
+	defaultPingCount = 4
+	maxPingCount     = 100
+	pingInterval     = time.Second
+	pingTimeout      = 2 * time.Second
+	pingPayloadSize  = 56
+)
+
+// PingResult is the result of sending echo requests
+// to an address through the tunnel.
+type PingResult struct {
+	// The address that was pinged.
+	Address string `json:"address"`
+
+	// The number of echo requests sent.
+	Sent int `json:"sent"`
+
+	// The number of echo replies received.
+	Received int `json:"received"`
+
+	// The percentage of echo requests that were not answered.
+	Loss float64 `json:"loss"`
+
+	// The round-trip times of the echo replies.
+	RTTs []time.Duration `json:"rtts,omitempty"`
+}
+
+// ping sends count echo requests to ip through the tunnel, one per
+// interval, and waits for the replies. It stops early when ctx is done.
+func (w *WireGuard) ping(ctx context.Context, ip net.IP, count int) (*PingResult, error) {
+	if w.tnet == nil {
+		return nil, fmt.Errorf("device not started")
+	}
+	conn, err := w.tnet.DialPing(ip)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	result := &PingResult{Address: ip.String()}
+	v6 := ip.To4() == nil
+	buf := make([]byte, maxPacketSize)
+
+	for seq := 0; seq < count; seq++ {
+		if seq > 0 {
+			select {
+			case <-ctx.Done():
+				return result, nil
+			case <-time.After(pingInterval):
+			}
+		}
+
+		start := time.Now()
+		if _, err := conn.Write(echoRequest(v6, uint16(seq))); err != nil {
+			return nil, fmt.Errorf("sending echo request: %v", err)
+		}
+		result.Sent++
+
+		if err := conn.SetReadDeadline(start.Add(pingTimeout)); err != nil {
+			return nil, err
+		}
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				// no reply before the deadline
+				break
+			}
+			if isEchoReply(v6, buf[:n], uint16(seq)) {
+				result.Received++
+				result.RTTs = append(result.RTTs, time.Since(start))
+				break
+			}
+		}
+		result.Loss = float64(result.Sent-result.Received) / float64(result.Sent) * 100
+	}
+
+	return result, nil
+}
+
+// echoRequest returns an ICMP echo request with the sequence number.
+// The identifier and checksum are set by the stack.
+func echoRequest(v6 bool, seq uint16) []byte {
+	b := make([]byte, header.ICMPv4MinimumSize+pingPayloadSize)
+	if v6 {
+		h := header.ICMPv6(b)
+		h.SetType(header.ICMPv6EchoRequest)
+		h.SetSequence(seq)
+		return b
+	}
+	h := header.ICMPv4(b)
+	h.SetType(header.ICMPv4Echo)
+	h.SetSequence(seq)
+	return b
+}
+
+// isEchoReply reports whether b is the echo reply
+// for the request with the sequence number.
+func isEchoReply(v6 bool, b []byte, seq uint16) bool {
+	if len(b) < header.ICMPv4MinimumSize {
+		return false
+	}
+	if v6 {
+		h := header.ICMPv6(b)
+		return h.Type() == header.ICMPv6EchoReply && h.Sequence() == seq
+	}
+	h := header.ICMPv4(b)
+	return h.Type() == header.ICMPv4EchoReply && h.Sequence() == seq
+}
@@ -0,0 +1,362 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(Proxy{})
+}
+
+// Proxy is an HTTP handler that reverse proxies to peers of the
+// WireGuard app. The upstreams are the peers that are selected and
+// had a recent handshake, at a port on their tunnel address. They are
+// kept up to date as peers come and go, so there is no need to list
+// tunnel addresses and to reload the config.
+//
+// Peers that don't send traffic on their own don't have recent
+// handshakes, so they should have a persistent keepalive.
+type Proxy struct {
+	// The peers to proxy to. Default: all peers
+	Peers *PeerSelector `json:"peers,omitempty"`
+
+	// The port on the tunnel addresses of the peers to proxy to.
+	Port int `json:"port,omitempty"`
+
+	// The maximum age of the last handshake with a peer for it
+	// to be an upstream. Default: 3m
+	MaxHandshakeAge caddy.Duration `json:"max_handshake_age,omitempty"`
+
+	// The interval at which the upstreams are updated. Default: 10s
+	RefreshInterval caddy.Duration `json:"refresh_interval,omitempty"`
+
+	// The configuration of the reverse_proxy handler, like its load
+	// balancing and health checks, without upstreams. The transport
+	// defaults to the wireguard transport.
+	ReverseProxy json.RawMessage `json:"reverse_proxy,omitempty"`
+
+	ctx          caddy.Context
+	logger       *zap.Logger
+	handler      *reverseproxy.Handler
+	healthChecks *reverseproxy.HealthChecks
+
+	mu      *sync.RWMutex
+	pool    reverseproxy.UpstreamPool
+	current map[string]*proxyUpstream
+}
+
+// proxyUpstream is an upstream of the handler. It is provisioned by a
+// reverse proxy handler of its own, which gets the shared state of the
+// upstream, like its passive health, and runs its active health checks.
+// It is kept for as long as the peer is an upstream, so that its health
+// is kept when other peers come and go.
+type proxyUpstream struct {
+	upstream *reverseproxy.Upstream
+	handler  *reverseproxy.Handler
+	cancel   context.CancelFunc
+}
+
+// CaddyModule returns the Caddy module information.
+func (Proxy) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.wireguard_proxy",
+		New: func() caddy.Module { return new(Proxy) },
+	}
+}
+
+// Provision sets up the handler and starts updating its upstreams.
+func (p *Proxy) Provision(ctx caddy.Context) error {
+	p.ctx = ctx
+	p.logger = ctx.Logger(p)
+	p.mu = new(sync.RWMutex)
+	p.current = make(map[string]*proxyUpstream)
+
+	if p.Port <= 0 || p.Port > 65535 {
+		return fmt.Errorf("invalid port: %d", p.Port)
+	}
+	if p.MaxHandshakeAge == 0 {
+		p.MaxHandshakeAge = caddy.Duration(3 * time.Minute)
+	}
+	if p.RefreshInterval == 0 {
+		p.RefreshInterval = caddy.Duration(10 * time.Second)
+	}
+
+	h := new(reverseproxy.Handler)
+	if len(p.ReverseProxy) > 0 {
+		if err := json.Unmarshal(p.ReverseProxy, h); err != nil {
+			return fmt.Errorf("decoding reverse_proxy: %v", err)
+		}
+		if len(h.Upstreams) > 0 {
+			return fmt.Errorf("reverse_proxy must not have upstreams")
+		}
+	}
+	if h.TransportRaw == nil {
+		h.TransportRaw = json.RawMessage(`{"protocol":"wireguard"}`)
+	}
+	// the active health checks are run by the handlers of the upstreams
+	p.healthChecks = h.HealthChecks
+	if h.HealthChecks != nil && h.HealthChecks.Active != nil {
+		hc := *h.HealthChecks
+		hc.Active = nil
+		h.HealthChecks = &hc
+	}
+	if err := h.Provision(ctx); err != nil {
+		return fmt.Errorf("provisioning reverse proxy: %v", err)
+	}
+	// the handler selects from the current upstreams instead of its own
+	h.LoadBalancing.SelectionPolicy = proxySelector{policy: h.LoadBalancing.SelectionPolicy, proxy: p}
+	p.handler = h
+
+	go p.refreshPeriodically()
+
+	return nil
+}
+
+// ServeHTTP proxies the request to one of the peers.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if len(p.currentPool()) == 0 {
+		return caddyhttp.Error(http.StatusServiceUnavailable, fmt.Errorf("no peers available"))
+	}
+	return p.handler.ServeHTTP(w, r, next)
+}
+
+// currentPool returns the current upstreams.
+func (p *Proxy) currentPool() reverseproxy.UpstreamPool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.pool
+}
+
+// Cleanup cleans up the upstreams and the reverse proxy handler,
+// and closes the idle connections of its transport.
+func (p *Proxy) Cleanup() error {
+	p.mu.Lock()
+	for addr, u := range p.current {
+		u.cleanup()
+		delete(p.current, addr)
+	}
+	p.pool = nil
+	p.mu.Unlock()
+
+	if p.handler != nil {
+		p.handler.Cleanup()
+		if cu, ok := p.handler.Transport.(caddy.CleanerUpper); ok {
+			cu.Cleanup()
+		}
+	}
+	return nil
+}
+
+// refreshPeriodically updates the upstreams until the config is unloaded.
+func (p *Proxy) refreshPeriodically() {
+	ticker := time.NewTicker(time.Duration(p.RefreshInterval))
+	defer ticker.Stop()
+	for {
+		if err := p.refresh(); err != nil {
+			p.logger.Error("updating upstreams", zap.Error(err))
+		}
+
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh swaps the upstreams when they changed. Upstreams that stay
+// are kept, with their health; upstreams that are new are provisioned,
+// and the others are cleaned up.
+func (p *Proxy) refresh() error {
+	app := running()
+	if app == nil {
+		return nil
+	}
+	addrs, err := p.upstreams(app)
+	if err != nil {
+		return err
+	}
+
+	p.mu.RLock()
+	var added []string
+	for _, addr := range addrs {
+		if _, ok := p.current[addr]; !ok {
+			added = append(added, addr)
+		}
+	}
+	unchanged := len(added) == 0 && len(addrs) == len(p.current)
+	p.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	provisioned := make(map[string]*proxyUpstream, len(added))
+	for _, addr := range added {
+		u, err := p.newUpstream(addr)
+		if err != nil {
+			for _, u := range provisioned {
+				u.cleanup()
+			}
+			return err
+		}
+		provisioned[addr] = u
+	}
+
+	p.mu.Lock()
+	if p.ctx.Err() != nil {
+		// the config was unloaded in the meantime
+		p.mu.Unlock()
+		for _, u := range provisioned {
+			u.cleanup()
+		}
+		return nil
+	}
+	keep := make(map[string]bool, len(addrs))
+	pool := make(reverseproxy.UpstreamPool, 0, len(addrs))
+	for _, addr := range addrs {
+		keep[addr] = true
+		u, ok := p.current[addr]
+		if !ok {
+			u = provisioned[addr]
+			p.current[addr] = u
+		}
+		pool = append(pool, u.upstream)
+	}
+	var removed []*proxyUpstream
+	for addr, u := range p.current {
+		if !keep[addr] {
+			removed = append(removed, u)
+			delete(p.current, addr)
+		}
+	}
+	p.pool = pool
+	p.mu.Unlock()
+	for _, u := range removed {
+		u.cleanup()
+	}
+
+	p.logger.Info("updated upstreams", zap.Strings("upstreams", addrs))
+	return nil
+}
+
+// upstreams returns the sorted addresses of the selected
+// peers that had a recent handshake.
+func (p *Proxy) upstreams(app *WireGuard) ([]string, error) {
+	handshakes, err := app.lastHandshakes()
+	if err != nil {
+		return nil, err
+	}
+
+	app.peersMu.RLock()
+	defer app.peersMu.RUnlock()
+
+	port := strconv.Itoa(p.Port)
+	var upstreams []string
+	for _, peer := range app.Peers {
+		if !p.Peers.matches(peer) {
+			continue
+		}
+		if time.Since(handshakes[peer.PublicKey]) > time.Duration(p.MaxHandshakeAge) {
+			continue
+		}
+		ips, err := parsePrefixIPs(peer.addresses())
+		if err != nil || len(ips) == 0 {
+			continue
+		}
+		upstreams = append(upstreams, net.JoinHostPort(ips[0].String(), port))
+	}
+	sort.Strings(upstreams)
+	return upstreams, nil
+}
+
+// newUpstream provisions the upstream for the address. Its handler
+// shares the transport and the circuit breaker of the handler of the
+// proxy, and gets its own context, so that its active health checks
+// stop when the upstream is removed.
+func (p *Proxy) newUpstream(addr string) (*proxyUpstream, error) {
+	upstream := &reverseproxy.Upstream{Dial: addr}
+	h := &reverseproxy.Handler{
+		Upstreams:     reverseproxy.UpstreamPool{upstream},
+		Transport:     p.handler.Transport,
+		CB:            p.handler.CB,
+		LoadBalancing: &reverseproxy.LoadBalancing{SelectionPolicy: reverseproxy.FirstSelection{}},
+	}
+	if p.healthChecks != nil {
+		// the handler sets up the health checks it is given
+		hc := *p.healthChecks
+		if hc.Passive != nil {
+			passive := *p.handler.HealthChecks.Passive
+			hc.Passive = &passive
+		}
+		if hc.Active != nil {
+			active := *hc.Active
+			hc.Active = &active
+		}
+		h.HealthChecks = &hc
+	}
+
+	ctx := p.ctx
+	c, cancel := context.WithCancel(p.ctx.Context)
+	ctx.Context = c
+	if err := h.Provision(ctx); err != nil {
+		cancel()
+		return nil, fmt.Errorf("provisioning upstream %s: %v", addr, err)
+	}
+	return &proxyUpstream{upstream: upstream, handler: h, cancel: cancel}, nil
+}
+
+// cleanup stops the health checks of the upstream and
+// releases its shared state.
+func (u *proxyUpstream) cleanup() {
+	u.cancel()
+	u.handler.Cleanup()
+}
+
+// proxySelector selects from the current upstreams of the proxy with
+// the configured selection policy, which keeps its state, like its
+// position for round robin, when the upstreams change.
+type proxySelector struct {
+	policy reverseproxy.Selector
+	proxy  *Proxy
+}
+
+// Select selects an upstream from the current upstreams; the pool of
+// the handler is empty.
+func (s proxySelector) Select(_ reverseproxy.UpstreamPool, r *http.Request, w http.ResponseWriter) *reverseproxy.Upstream {
+	return s.policy.Select(s.proxy.currentPool(), r, w)
+}
+
+// Interface guards
+var (
+	_ caddy.Module                = (*Proxy)(nil)
+	_ caddy.Provisioner           = (*Proxy)(nil)
+	_ caddy.CleanerUpper          = (*Proxy)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Proxy)(nil)
+)
@@ -0,0 +1,210 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+func init() {
+	caddy.RegisterModule(Publish{})
+}
+
+// publishUpstreamPlaceholder is the placeholder that is set to the
+// tunnel address of the peer a request is proxied to.
+const publishUpstreamPlaceholder = "wireguard.publish.upstream"
+
+// publishers are the provisioned Publish handlers, which the
+// /wireguard/tls-ask endpoint checks for the names they serve.
+var (
+	publishers   = make(map[*Publish]struct{})
+	publishersMu sync.RWMutex
+)
+
+// Publish is an HTTP handler that publishes peers at subdomains of a
+// domain: requests for <name>.<domain> are reverse proxied through the
+// tunnel to a port on the tunnel address of the peer with that name.
+// This makes it possible to expose services running on peers, like a
+// development server on a laptop, without changing the config.
+//
+// It is meant for a site like *.tunnels.example.com. Certificates can
+// be obtained on demand, with the /wireguard/tls-ask endpoint of the
+// admin API as the ask URL, so that only names of peers that are
+// published are allowed.
+type Publish struct {
+	// The domain under which peers are published, like
+	// tunnels.example.com.
+	Domain string `json:"domain,omitempty"`
+
+	// The port on the tunnel addresses of the peers to proxy to.
+	Port int `json:"port,omitempty"`
+
+	// The peers that can be published. Default: all peers with a name
+	Peers *PeerSelector `json:"peers,omitempty"`
+
+	// The configuration of the reverse_proxy handler, like its
+	// headers and timeouts, without upstreams and health checks.
+	// The transport defaults to the wireguard transport.
+	ReverseProxy json.RawMessage `json:"reverse_proxy,omitempty"`
+
+	handler *reverseproxy.Handler
+}
+
+// CaddyModule returns the Caddy module information.
+func (Publish) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.wireguard_publish",
+		New: func() caddy.Module { return new(Publish) },
+	}
+}
+
+// Provision sets up the handler.
+func (p *Publish) Provision(ctx caddy.Context) error {
+	p.Domain = strings.ToLower(strings.Trim(p.Domain, "."))
+	if p.Domain == "" {
+		return fmt.Errorf("domain is required")
+	}
+	if p.Port <= 0 || p.Port > 65535 {
+		return fmt.Errorf("invalid port: %d", p.Port)
+	}
+
+	h := new(reverseproxy.Handler)
+	if len(p.ReverseProxy) > 0 {
+		if err := json.Unmarshal(p.ReverseProxy, h); err != nil {
+			return fmt.Errorf("decoding reverse_proxy: %v", err)
+		}
+		if len(h.Upstreams) > 0 {
+			return fmt.Errorf("reverse_proxy must not have upstreams")
+		}
+		// all peers share a single upstream, so that
+		// one unhealthy peer would take down all others
+		if h.HealthChecks != nil {
+			return fmt.Errorf("reverse_proxy must not have health checks")
+		}
+	}
+	if h.TransportRaw == nil {
+		h.TransportRaw = json.RawMessage(`{"protocol":"wireguard"}`)
+	}
+	h.Upstreams = reverseproxy.UpstreamPool{
+		{Dial: "{" + publishUpstreamPlaceholder + "}"},
+	}
+	if err := h.Provision(ctx); err != nil {
+		return fmt.Errorf("provisioning reverse proxy: %v", err)
+	}
+	p.handler = h
+
+	publishersMu.Lock()
+	publishers[p] = struct{}{}
+	publishersMu.Unlock()
+
+	return nil
+}
+
+// ServeHTTP proxies the request to the peer named by the subdomain.
+func (p *Publish) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	name, ok := subdomain(r.Host, p.Domain)
+	if !ok {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("host %s is not a subdomain of %s", r.Host, p.Domain))
+	}
+
+	app := running()
+	if app == nil {
+		return caddyhttp.Error(http.StatusServiceUnavailable, fmt.Errorf("WireGuard app is not running"))
+	}
+	peer := p.peer(app, name)
+	if peer == nil {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("unknown peer: %s", name))
+	}
+	ips, err := parsePrefixIPs(peer.addresses())
+	if err != nil || len(ips) == 0 {
+		return caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("peer %s has no tunnel address", name))
+	}
+
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set(publishUpstreamPlaceholder, net.JoinHostPort(ips[0].String(), strconv.Itoa(p.Port)))
+
+	return p.handler.ServeHTTP(w, r, next)
+}
+
+// peer returns the peer with the name if it can be published.
+func (p *Publish) peer(app *WireGuard, name string) *Peer {
+	peer := app.peerByName(name)
+	if peer == nil || !p.Peers.matches(peer) {
+		return nil
+	}
+	return peer
+}
+
+// serves reports whether the handler publishes a peer at host.
+func (p *Publish) serves(app *WireGuard, host string) bool {
+	name, ok := subdomain(host, p.Domain)
+	return ok && p.peer(app, name) != nil
+}
+
+// published reports whether a Publish handler publishes a peer at host.
+func published(app *WireGuard, host string) bool {
+	publishersMu.RLock()
+	defer publishersMu.RUnlock()
+	for p := range publishers {
+		if p.serves(app, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Cleanup cleans up the reverse proxy handler.
+func (p *Publish) Cleanup() error {
+	publishersMu.Lock()
+	delete(publishers, p)
+	publishersMu.Unlock()
+
+	if p.handler != nil {
+		return p.handler.Cleanup()
+	}
+	return nil
+}
+
+// subdomain returns the single label in front of domain in host,
+// which may have a port.
+func subdomain(host, domain string) (string, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	name := strings.TrimSuffix(host, "."+domain)
+	if name == host || name == "" || strings.Contains(name, ".") {
+		return "", false
+	}
+	return name, true
+}
+
+// Interface guards
+var (
+	_ caddy.Module                = (*Publish)(nil)
+	_ caddy.Provisioner           = (*Publish)(nil)
+	_ caddy.CleanerUpper          = (*Publish)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Publish)(nil)
+)
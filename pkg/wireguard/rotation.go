@@ -0,0 +1,509 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"crypto/rand"
+	b64 "encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// keysStorageKey is the key under which the rotated keys are stored.
+const keysStorageKey = "wireguard/keys.json"
+
+// rotationCheckInterval is the interval at which
+// the rotation schedule is checked.
+const rotationCheckInterval = time.Minute
+
+// KeyRotation rotates the private key of the interface and the
+// preshared keys of peers on a schedule. The next keys are generated
+// ahead of the rotation and published in the client configurations of
+// the admin API, so that peers can fetch them. After a rotation, a
+// second device with the previous keys keeps serving the peers that
+// haven't switched yet, until the overlap window ends.
+//
+// The configured private key is the first key; the rotated keys are
+// persisted in the storage and replace the configured keys, until the
+// configured private key is changed.
+type KeyRotation struct {
+	// The interval at which the private key of the
+	// interface is rotated. Default: 0 (not rotated)
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	// The interval at which the preshared keys of peers that
+	// have one are rotated. Default: 0 (not rotated)
+	PresharedKeyInterval caddy.Duration `json:"preshared_key_interval,omitempty"`
+
+	// How long before a rotation the next keys are published.
+	// Default: 24h, or half the interval if that is shorter
+	Notice caddy.Duration `json:"notice,omitempty"`
+
+	// How long after a rotation the previous keys keep working.
+	// Default: 24h, or half the interval if that is shorter
+	Overlap caddy.Duration `json:"overlap,omitempty"`
+
+	mu    sync.Mutex // serializes rotations
+	state keyState
+}
+
+// keyState is the persisted state of the rotated keys.
+type keyState struct {
+	// the configured private key that the keys were rotated from
+	ConfiguredPrivateKey string `json:"configured_private_key,omitempty"`
+
+	PrivateKey         string    `json:"private_key,omitempty"`
+	NextPrivateKey     string    `json:"next_private_key,omitempty"`
+	PreviousPrivateKey string    `json:"previous_private_key,omitempty"`
+	RotatedAt          time.Time `json:"rotated_at"`
+
+	// by the public key of the peer
+	PresharedKeys          map[string]string `json:"preshared_keys,omitempty"`
+	NextPresharedKeys      map[string]string `json:"next_preshared_keys,omitempty"`
+	PreviousPresharedKeys  map[string]string `json:"previous_preshared_keys,omitempty"`
+	PresharedKeysRotatedAt time.Time         `json:"preshared_keys_rotated_at"`
+
+	// the end of the overlap window of the previous keys
+	OverlapUntil time.Time `json:"overlap_until,omitempty"`
+}
+
+// KeyRotationStatus is the schedule of the key rotation
+// that is reported by the admin API.
+type KeyRotationStatus struct {
+	PublicKey     string     `json:"public_key"`
+	NextPublicKey string     `json:"next_public_key,omitempty"`
+	RotateAt      *time.Time `json:"rotate_at,omitempty"`
+
+	NextPresharedKeys    bool       `json:"next_preshared_keys"`
+	RotatePresharedKeyAt *time.Time `json:"rotate_preshared_keys_at,omitempty"`
+
+	PreviousPublicKey string     `json:"previous_public_key,omitempty"`
+	OverlapUntil      *time.Time `json:"overlap_until,omitempty"`
+}
+
+// validate checks the configuration.
+func (k *KeyRotation) validate() error {
+	if k.Interval < 0 || k.PresharedKeyInterval < 0 || k.Notice < 0 || k.Overlap < 0 {
+		return fmt.Errorf("durations must not be negative")
+	}
+	return nil
+}
+
+// notice returns how long before a rotation with
+// the interval the next keys are published.
+func (k *KeyRotation) notice(interval caddy.Duration) time.Duration {
+	notice := time.Duration(k.Notice)
+	if notice == 0 {
+		notice = 24 * time.Hour
+		if half := time.Duration(interval) / 2; half < notice {
+			notice = half
+		}
+	}
+	return notice
+}
+
+// overlap returns how long after a rotation with
+// the interval the previous keys keep working.
+func (k *KeyRotation) overlap(interval caddy.Duration) time.Duration {
+	overlap := time.Duration(k.Overlap)
+	if overlap == 0 {
+		overlap = 24 * time.Hour
+		if half := time.Duration(interval) / 2; half < overlap {
+			overlap = half
+		}
+	}
+	return overlap
+}
+
+// provisionKeyRotation loads the rotated keys and replaces the
+// configured keys of the interface and the peers with them.
+func (w *WireGuard) provisionKeyRotation() error {
+	k := w.KeyRotation
+	storage := w.ctx.Storage()
+	if storage.Exists(w.ctx, keysStorageKey) {
+		data, err := storage.Load(w.ctx, keysStorageKey)
+		if err != nil {
+			return fmt.Errorf("loading keys: %v", err)
+		}
+		if err := json.Unmarshal(data, &k.state); err != nil {
+			return fmt.Errorf("decoding keys: %v", err)
+		}
+	}
+
+	if k.state.ConfiguredPrivateKey != w.PrivateKey {
+		// a changed private key replaces the rotated keys, like
+		// after the key was compromised
+		if k.state.ConfiguredPrivateKey != "" {
+			w.logger.Named("rotation").Info("configured private key changed; resetting the rotated keys")
+			k.state.PrivateKey = ""
+			k.state.NextPrivateKey = ""
+			k.state.PreviousPrivateKey = ""
+			k.state.OverlapUntil = time.Time{}
+		}
+		k.state.ConfiguredPrivateKey = w.PrivateKey
+	}
+
+	now := time.Now()
+	if k.state.PrivateKey == "" {
+		k.state.PrivateKey = w.PrivateKey
+		k.state.RotatedAt = now
+	}
+	if k.state.PresharedKeysRotatedAt.IsZero() {
+		k.state.PresharedKeysRotatedAt = now
+	}
+
+	var err error
+	w.PrivateKey = k.state.PrivateKey
+	w.publicKey, err = publicKey(w.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("invalid stored private key: %v", err)
+	}
+	for _, p := range w.Peers {
+		if psk, ok := k.state.PresharedKeys[p.PublicKey]; ok && p.PresharedKey != "" {
+			p.PresharedKey = psk
+		}
+	}
+	return w.saveKeys()
+}
+
+// saveKeys persists the rotated keys.
+func (w *WireGuard) saveKeys() error {
+	data, err := json.Marshal(w.KeyRotation.state)
+	if err != nil {
+		return fmt.Errorf("encoding keys: %v", err)
+	}
+	if err := w.ctx.Storage().Store(w.ctx, keysStorageKey, data); err != nil {
+		return fmt.Errorf("storing keys: %v", err)
+	}
+	return nil
+}
+
+// rotateKeysPeriodically publishes and rotates the keys
+// on their schedule, until the app is stopped.
+func (w *WireGuard) rotateKeysPeriodically() {
+	ticker := time.NewTicker(rotationCheckInterval)
+	defer ticker.Stop()
+	for {
+		if err := w.rotateKeys(time.Now()); err != nil {
+			w.logger.Error("rotating keys", zap.Error(err))
+		}
+
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// rotateKeys publishes the next keys when their rotation is near,
+// and rotates the keys that are due. Every step is logged through
+// the wireguard.rotation logger, so that peers can be notified.
+func (w *WireGuard) rotateKeys(now time.Time) error {
+	k := w.KeyRotation
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	logger := w.logger.Named("rotation")
+
+	if !k.state.OverlapUntil.IsZero() && !now.Before(k.state.OverlapUntil) {
+		if err := w.endOverlap(); err != nil {
+			return err
+		}
+		logger.Info("overlap of the previous keys ended")
+	}
+
+	if k.Interval > 0 {
+		due := k.state.RotatedAt.Add(time.Duration(k.Interval))
+		if k.state.NextPrivateKey == "" && !now.Before(due.Add(-k.notice(k.Interval))) {
+			next, nextPublicKey, err := GenerateKeyPair()
+			if err != nil {
+				return err
+			}
+			k.state.NextPrivateKey = next
+			if err := w.saveKeys(); err != nil {
+				return err
+			}
+			logger.Info("published next interface key",
+				zap.String("public_key", w.publicKey),
+				zap.String("next_public_key", nextPublicKey),
+				zap.Time("rotate_at", due),
+			)
+		}
+		if !now.Before(due) {
+			if err := w.rotatePrivateKey(now); err != nil {
+				return err
+			}
+			logger.Info("rotated interface key",
+				zap.String("public_key", w.publicKey),
+				zap.Time("overlap_until", k.state.OverlapUntil),
+			)
+		}
+	}
+
+	if k.PresharedKeyInterval > 0 {
+		due := k.state.PresharedKeysRotatedAt.Add(time.Duration(k.PresharedKeyInterval))
+		if k.state.NextPresharedKeys == nil && !now.Before(due.Add(-k.notice(k.PresharedKeyInterval))) {
+			if err := w.publishPresharedKeys(); err != nil {
+				return err
+			}
+			logger.Info("published next preshared keys",
+				zap.Int("peers", len(k.state.NextPresharedKeys)),
+				zap.Time("rotate_at", due),
+			)
+		}
+		if !now.Before(due) {
+			rotated, err := w.rotatePresharedKeys(now)
+			if err != nil {
+				return err
+			}
+			logger.Info("rotated preshared keys",
+				zap.Strings("peers", rotated),
+				zap.Time("overlap_until", k.state.OverlapUntil),
+			)
+		}
+	}
+
+	return nil
+}
+
+// rotatePrivateKey switches the device to the next private key.
+// The mutex of the key rotation must be held.
+func (w *WireGuard) rotatePrivateKey(now time.Time) error {
+	k := w.KeyRotation
+	next := k.state.NextPrivateKey
+	if next == "" {
+		// the rotation was due before the key could be published
+		var err error
+		next, _, err = GenerateKeyPair()
+		if err != nil {
+			return err
+		}
+	}
+	nextPublicKey, err := publicKey(next)
+	if err != nil {
+		return err
+	}
+	privateKey, err := hexKey(next)
+	if err != nil {
+		return err
+	}
+
+	w.peersMu.Lock()
+	defer w.peersMu.Unlock()
+	if err := w.dev.IpcSet(fmt.Sprintf("private_key=%s\n", privateKey)); err != nil {
+		return fmt.Errorf("setting private key: %v", err)
+	}
+	k.state.PreviousPrivateKey = w.PrivateKey
+	w.PrivateKey = next
+	w.publicKey = nextPublicKey
+	k.state.PrivateKey = next
+	k.state.NextPrivateKey = ""
+	k.state.RotatedAt = now
+	w.extendOverlap(now.Add(k.overlap(k.Interval)))
+	if err := w.startOverlap(); err != nil {
+		w.logger.Named("rotation").Error("starting overlap device", zap.Error(err))
+	}
+	return w.saveKeys()
+}
+
+// publishPresharedKeys generates the next preshared
+// keys of the peers that have one.
+func (w *WireGuard) publishPresharedKeys() error {
+	w.peersMu.Lock()
+	defer w.peersMu.Unlock()
+
+	next := make(map[string]string)
+	for _, p := range w.Peers {
+		if p.PresharedKey == "" {
+			continue
+		}
+		psk, err := generatePresharedKey()
+		if err != nil {
+			return err
+		}
+		next[p.PublicKey] = psk
+	}
+	w.KeyRotation.state.NextPresharedKeys = next
+	return w.saveKeys()
+}
+
+// rotatePresharedKeys sets the next preshared keys on the device
+// and returns the public keys of the peers that were rotated. Peers
+// that were added after the keys were published are rotated at the
+// next rotation.
+func (w *WireGuard) rotatePresharedKeys(now time.Time) ([]string, error) {
+	k := w.KeyRotation
+
+	w.peersMu.Lock()
+	defer w.peersMu.Unlock()
+
+	var (
+		b       strings.Builder
+		rotated []*Peer
+	)
+	for _, p := range w.Peers {
+		psk, ok := k.state.NextPresharedKeys[p.PublicKey]
+		if !ok || p.PresharedKey == "" {
+			continue
+		}
+		publicKey, err := hexKey(p.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		presharedKey, err := hexKey(psk)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&b, "public_key=%s\nupdate_only=true\npreshared_key=%s\n", publicKey, presharedKey)
+		rotated = append(rotated, p)
+	}
+	if b.Len() > 0 {
+		if err := w.dev.IpcSet(b.String()); err != nil {
+			return nil, fmt.Errorf("setting preshared keys: %v", err)
+		}
+	}
+
+	if k.state.PresharedKeys == nil {
+		k.state.PresharedKeys = make(map[string]string, len(rotated))
+	}
+	previous := make(map[string]string, len(rotated))
+	publicKeys := make([]string, 0, len(rotated))
+	for _, p := range rotated {
+		previous[p.PublicKey] = p.PresharedKey
+		p.PresharedKey = k.state.NextPresharedKeys[p.PublicKey]
+		k.state.PresharedKeys[p.PublicKey] = p.PresharedKey
+		publicKeys = append(publicKeys, p.PublicKey)
+	}
+	k.state.PreviousPresharedKeys = previous
+	k.state.NextPresharedKeys = nil
+	k.state.PresharedKeysRotatedAt = now
+	if len(rotated) > 0 {
+		w.extendOverlap(now.Add(k.overlap(k.PresharedKeyInterval)))
+		if err := w.startOverlap(); err != nil {
+			w.logger.Named("rotation").Error("starting overlap device", zap.Error(err))
+		}
+	}
+	return publicKeys, w.saveKeys()
+}
+
+// extendOverlap extends the overlap window of the previous
+// keys until the time, if it doesn't last that long already.
+func (w *WireGuard) extendOverlap(until time.Time) {
+	k := w.KeyRotation
+	if until.After(k.state.OverlapUntil) {
+		k.state.OverlapUntil = until
+	}
+}
+
+// endOverlap stops the overlap device and forgets the previous keys.
+func (w *WireGuard) endOverlap() error {
+	w.peersMu.Lock()
+	defer w.peersMu.Unlock()
+	w.stopOverlap()
+	k := w.KeyRotation
+	k.state.PreviousPrivateKey = ""
+	k.state.PreviousPresharedKeys = nil
+	k.state.OverlapUntil = time.Time{}
+	return w.saveKeys()
+}
+
+// nextClientConfig generates the client configuration of the peer
+// with the keys that were published for the next rotation.
+func (w *WireGuard) nextClientConfig(p *Peer) (string, error) {
+	w.peersMu.RLock()
+	var (
+		serverPublicKey = w.publicKey
+		presharedKey    = p.PresharedKey
+		published       bool
+	)
+	if k := w.KeyRotation; k != nil {
+		if k.state.NextPrivateKey != "" {
+			var err error
+			serverPublicKey, err = publicKey(k.state.NextPrivateKey)
+			if err != nil {
+				w.peersMu.RUnlock()
+				return "", err
+			}
+			published = true
+		}
+		if psk, ok := k.state.NextPresharedKeys[p.PublicKey]; ok {
+			presharedKey = psk
+			published = true
+		}
+	}
+	w.peersMu.RUnlock()
+
+	if !published {
+		return "", fmt.Errorf("no keys have been published for the next rotation")
+	}
+	return w.clientConfigWithKeys(p, serverPublicKey, presharedKey)
+}
+
+// keyRotationStatus returns the schedule of the key rotation.
+func (w *WireGuard) keyRotationStatus() (KeyRotationStatus, error) {
+	w.peersMu.RLock()
+	defer w.peersMu.RUnlock()
+
+	status := KeyRotationStatus{PublicKey: w.publicKey}
+	k := w.KeyRotation
+	if k == nil {
+		return status, nil
+	}
+	if k.Interval > 0 {
+		due := k.state.RotatedAt.Add(time.Duration(k.Interval))
+		status.RotateAt = &due
+	}
+	if k.state.NextPrivateKey != "" {
+		next, err := publicKey(k.state.NextPrivateKey)
+		if err != nil {
+			return status, err
+		}
+		status.NextPublicKey = next
+	}
+	if k.PresharedKeyInterval > 0 {
+		due := k.state.PresharedKeysRotatedAt.Add(time.Duration(k.PresharedKeyInterval))
+		status.RotatePresharedKeyAt = &due
+	}
+	status.NextPresharedKeys = k.state.NextPresharedKeys != nil
+	if !k.state.OverlapUntil.IsZero() {
+		until := k.state.OverlapUntil
+		status.OverlapUntil = &until
+		if k.state.PreviousPrivateKey != "" {
+			previous, err := publicKey(k.state.PreviousPrivateKey)
+			if err != nil {
+				return status, err
+			}
+			status.PreviousPublicKey = previous
+		}
+	}
+	return status, nil
+}
+
+// generatePresharedKey generates a new base64 encoded preshared key.
+func generatePresharedKey() (string, error) {
+	// preshared keys have the size of the other keys
+	k := make([]byte, device.NoisePublicKeySize)
+	if _, err := rand.Read(k); err != nil {
+		return "", fmt.Errorf("generating preshared key: %v", err)
+	}
+	return b64.StdEncoding.EncodeToString(k), nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"net"
+	"net/netip"
+)
+
+// peerRoutes finds the peer that an IP is routed to, by the longest
+// prefix match of the allowed IPs of the peers, like the device does.
+// It is looked up for every packet, so it is built from the peers when
+// they change instead of scanning them. The allowed IPs that are single
+// addresses, which most peers have, are found in a map; the others are
+// found in a binary trie per address family.
+type peerRoutes struct {
+	hosts map[netip.Addr]*Peer
+	v4    *routeNode
+	v6    *routeNode
+}
+
+// routeNode is a node of the trie, which is reached by the bits of a
+// prefix. The peer is set when the prefix is an allowed IP of a peer.
+type routeNode struct {
+	children [2]*routeNode
+	peer     *Peer
+}
+
+// newPeerRoutes builds the routes of the peers. When peers have the
+// same allowed IP, the first one is routed to.
+func newPeerRoutes(peers []*Peer) *peerRoutes {
+	r := &peerRoutes{
+		hosts: make(map[netip.Addr]*Peer),
+		v4:    &routeNode{},
+		v6:    &routeNode{},
+	}
+	for _, p := range peers {
+		for _, n := range p.allowedNets {
+			r.insert(n, p)
+		}
+	}
+	return r
+}
+
+// insert routes the prefix to p.
+func (r *peerRoutes) insert(n *net.IPNet, p *Peer) {
+	ones, bits := n.Mask.Size()
+	ip := n.IP.To16()
+	node := r.v6
+	if bits == 8*net.IPv4len {
+		ip = n.IP.To4()
+		node = r.v4
+	}
+	if ip == nil {
+		return
+	}
+	if ones == bits {
+		addr, _ := netip.AddrFromSlice(ip)
+		if _, ok := r.hosts[addr]; !ok {
+			r.hosts[addr] = p
+		}
+		return
+	}
+	for i := 0; i < ones; i++ {
+		bit := ip[i/8] >> (7 - uint(i%8)) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &routeNode{}
+		}
+		node = node.children[bit]
+	}
+	if node.peer == nil {
+		node.peer = p
+	}
+}
+
+// host returns the peer that has ip as one of its own
+// addresses, which are its /32 and /128 allowed IPs, or nil.
+func (r *peerRoutes) host(ip net.IP) *Peer {
+	if r == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return nil
+	}
+	return r.hosts[addr]
+}
+
+// lookup returns the peer that ip is routed to, or nil.
+func (r *peerRoutes) lookup(ip net.IP) *Peer {
+	if r == nil {
+		return nil
+	}
+	node := r.v6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = r.v4
+	} else if ip = ip.To16(); ip == nil {
+		return nil
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	if p, ok := r.hosts[addr]; ok {
+		return p
+	}
+	match := node.peer
+	for i := 0; i < 8*len(ip); i++ {
+		node = node.children[ip[i/8]>>(7-uint(i%8))&1]
+		if node == nil {
+			break
+		}
+		if node.peer != nil {
+			match = node.peer
+		}
+	}
+	return match
+}
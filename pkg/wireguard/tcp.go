@@ -0,0 +1,164 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/hslatman/caddy-wireguard/pkg/netstack"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// TCPOptions tune the TCP implementation of the netstack. The
+// defaults of the netstack are conservative, which gives poor
+// throughput for large transfers over links with a high latency.
+// Options that aren't configured keep the defaults of the netstack.
+type TCPOptions struct {
+	// The range of the receive buffer sizes of connections.
+	ReceiveBuffer *BufferSizeRange `json:"receive_buffer,omitempty"`
+
+	// The range of the send buffer sizes of connections.
+	SendBuffer *BufferSizeRange `json:"send_buffer,omitempty"`
+
+	// Enables selective acknowledgements (RFC 2018).
+	SACK *bool `json:"sack,omitempty"`
+
+	// Enables receive buffer moderation, which grows the receive
+	// buffer of a connection up to the maximum with its throughput.
+	ModerateReceiveBuffer *bool `json:"moderate_receive_buffer,omitempty"`
+
+	// The congestion control algorithm: reno or cubic.
+	CongestionControl string `json:"congestion_control,omitempty"`
+
+	// Enables Nagle's algorithm, which delays sending small segments
+	// to coalesce them. This is not a delayed ACK setting: the netstack
+	// has no option for delayed acknowledgements.
+	Delay *bool `json:"delay,omitempty"`
+
+	// Enables keepalives on the connections that are accepted by
+	// Caddy, after they are idle for this duration. Default: 0
+	// (disabled)
+	KeepaliveIdle caddy.Duration `json:"keepalive_idle,omitempty"`
+
+	// The interval between keepalives. Requires keepalive_idle.
+	// Default: 75s
+	KeepaliveInterval caddy.Duration `json:"keepalive_interval,omitempty"`
+
+	// The number of unanswered keepalives after which a connection
+	// is closed. Requires keepalive_idle. Default: 9
+	KeepaliveCount int `json:"keepalive_count,omitempty"`
+
+	// The duration a connection stays in the TIME-WAIT state.
+	// Default: 60s
+	TimeWaitTimeout caddy.Duration `json:"time_wait_timeout,omitempty"`
+}
+
+// BufferSizeRange is a range of buffer sizes in bytes.
+type BufferSizeRange struct {
+	// The minimum size.
+	Min int `json:"min,omitempty"`
+
+	// The size that connections start with.
+	Default int `json:"default,omitempty"`
+
+	// The maximum size.
+	Max int `json:"max,omitempty"`
+}
+
+// validate checks the configuration.
+func (o *TCPOptions) validate() error {
+	for name, r := range map[string]*BufferSizeRange{"receive": o.ReceiveBuffer, "send": o.SendBuffer} {
+		if r != nil && (r.Min <= 0 || r.Default < r.Min || r.Max < r.Default) {
+			return fmt.Errorf("invalid %s buffer: sizes must be positive with min <= default <= max", name)
+		}
+	}
+	switch o.CongestionControl {
+	case "", "reno", "cubic":
+	default:
+		return fmt.Errorf("unknown congestion control: %s", o.CongestionControl)
+	}
+	if o.KeepaliveIdle < 0 || o.KeepaliveInterval < 0 || o.KeepaliveCount < 0 {
+		return fmt.Errorf("keepalive options must not be negative")
+	}
+	if o.KeepaliveIdle == 0 && (o.KeepaliveInterval != 0 || o.KeepaliveCount != 0) {
+		return fmt.Errorf("keepalive interval and count require keepalive_idle, which enables keepalives")
+	}
+	return nil
+}
+
+// apply sets the options on the TCP protocol of the stack.
+func (o *TCPOptions) apply(s *stack.Stack) error {
+	var opts []tcpip.SettableTransportProtocolOption
+	if o.ReceiveBuffer != nil {
+		opts = append(opts, &tcpip.TCPReceiveBufferSizeRangeOption{
+			Min: o.ReceiveBuffer.Min, Default: o.ReceiveBuffer.Default, Max: o.ReceiveBuffer.Max,
+		})
+	}
+	if o.SendBuffer != nil {
+		opts = append(opts, &tcpip.TCPSendBufferSizeRangeOption{
+			Min: o.SendBuffer.Min, Default: o.SendBuffer.Default, Max: o.SendBuffer.Max,
+		})
+	}
+	if o.SACK != nil {
+		opt := tcpip.TCPSACKEnabled(*o.SACK)
+		opts = append(opts, &opt)
+	}
+	if o.ModerateReceiveBuffer != nil {
+		opt := tcpip.TCPModerateReceiveBufferOption(*o.ModerateReceiveBuffer)
+		opts = append(opts, &opt)
+	}
+	if o.CongestionControl != "" {
+		opt := tcpip.CongestionControlOption(o.CongestionControl)
+		opts = append(opts, &opt)
+	}
+	if o.Delay != nil {
+		opt := tcpip.TCPDelayEnabled(*o.Delay)
+		opts = append(opts, &opt)
+	}
+	if o.TimeWaitTimeout > 0 {
+		opt := tcpip.TCPTimeWaitTimeoutOption(o.TimeWaitTimeout)
+		opts = append(opts, &opt)
+	}
+
+	for _, opt := range opts {
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, opt); err != nil {
+			return fmt.Errorf("setting %T: %v", opt, err)
+		}
+	}
+	return nil
+}
+
+// listen returns a TCP listener on the port of the netstack, which
+// enables keepalives on the connections it accepts if configured.
+func (o *TCPOptions) listen(tnet *netstack.Net, port int) (net.Listener, error) {
+	addr := &net.TCPAddr{Port: port}
+	if o == nil || o.KeepaliveIdle == 0 {
+		l, err := tnet.ListenTCP(addr)
+		if err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+	return tnet.ListenTCPKeepAlive(addr, netstack.KeepAlive{
+		Idle:     time.Duration(o.KeepaliveIdle),
+		Interval: time.Duration(o.KeepaliveInterval),
+		Count:    o.KeepaliveCount,
+	})
+}
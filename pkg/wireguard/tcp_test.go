@@ -0,0 +1,183 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/hslatman/caddy-wireguard/pkg/netstack"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+func TestTCPOptionsValidate(t *testing.T) {
+	enabled := true
+	tests := []struct {
+		name    string
+		opts    TCPOptions
+		wantErr bool
+	}{
+		{"empty", TCPOptions{}, false},
+		{"buffers", TCPOptions{ReceiveBuffer: &BufferSizeRange{Min: 4096, Default: 1 << 20, Max: 8 << 20}}, false},
+		{"default below min", TCPOptions{SendBuffer: &BufferSizeRange{Min: 4096, Default: 1024, Max: 8 << 20}}, true},
+		{"max below default", TCPOptions{SendBuffer: &BufferSizeRange{Min: 4096, Default: 1 << 20, Max: 4096}}, true},
+		{"cubic", TCPOptions{CongestionControl: "cubic", SACK: &enabled}, false},
+		{"unknown congestion control", TCPOptions{CongestionControl: "bbr"}, true},
+		{"keepalive", TCPOptions{KeepaliveIdle: caddy.Duration(time.Minute), KeepaliveInterval: caddy.Duration(time.Second), KeepaliveCount: 3}, false},
+		{"negative keepalive", TCPOptions{KeepaliveIdle: caddy.Duration(-time.Minute)}, true},
+		{"interval without idle", TCPOptions{KeepaliveInterval: caddy.Duration(time.Second)}, true},
+		{"count without idle", TCPOptions{KeepaliveCount: 3}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// linkTUNs forwards the packets between the netstacks in both
+// directions, after a delay, like a link with a high latency. The
+// returned function stops forwarding, before the netstacks are closed.
+func linkTUNs(a, b tun.Device, delay time.Duration) (stop func()) {
+	type delayed struct {
+		at   time.Time
+		data []byte
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	forward := func(from, to tun.Device) {
+		queue := make(chan delayed, 8192)
+		go func() {
+			defer close(queue)
+			bufs := [][]byte{make([]byte, maxPacketSize)}
+			sizes := make([]int, 1)
+			for {
+				if _, err := from.Read(bufs, sizes, 0); err != nil {
+					return
+				}
+				select {
+				case queue <- delayed{time.Now().Add(delay), append([]byte(nil), bufs[0][:sizes[0]]...)}:
+				default:
+				}
+			}
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range queue {
+				select {
+				case <-time.After(time.Until(p.at)):
+				case <-done:
+					return
+				}
+				to.Write([][]byte{p.data}, 0)
+			}
+		}()
+	}
+	forward(a, b)
+	forward(b, a)
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// BenchmarkTCPOptions measures downloads over a link with a round
+// trip time of 50ms, with the defaults of the netstack and with larger
+// buffers, SACK and CUBIC.
+func BenchmarkTCPOptions(b *testing.B) {
+	enabled := true
+	tests := []struct {
+		name string
+		opts *TCPOptions
+	}{
+		{"defaults", nil},
+		{"tuned", &TCPOptions{
+			ReceiveBuffer:         &BufferSizeRange{Min: 4096, Default: 4 << 20, Max: 8 << 20},
+			SendBuffer:            &BufferSizeRange{Min: 4096, Default: 4 << 20, Max: 8 << 20},
+			SACK:                  &enabled,
+			ModerateReceiveBuffer: &enabled,
+			CongestionControl:     "cubic",
+		}},
+	}
+	const size = 16 << 20
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			serverIP, clientIP := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+			serverTUN, server, err := netstack.CreateNetTUN([]net.IP{serverIP}, nil, 1420)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer serverTUN.Close()
+			clientTUN, client, err := netstack.CreateNetTUN([]net.IP{clientIP}, nil, 1420)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer clientTUN.Close()
+			if tt.opts != nil {
+				if err := tt.opts.apply(server.Stack()); err != nil {
+					b.Fatal(err)
+				}
+				if err := tt.opts.apply(client.Stack()); err != nil {
+					b.Fatal(err)
+				}
+			}
+			defer linkTUNs(serverTUN, clientTUN, 25*time.Millisecond)()
+
+			l, err := server.ListenTCP(&net.TCPAddr{Port: 8080})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer l.Close()
+			go func() {
+				data := make([]byte, size)
+				for {
+					c, err := l.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						defer c.Close()
+						c.Write(data)
+					}()
+				}
+			}()
+
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c, err := client.DialTCP(&net.TCPAddr{IP: serverIP, Port: 8080})
+				if err != nil {
+					b.Fatal(err)
+				}
+				n, err := io.Copy(ioutil.Discard, c)
+				c.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if n != size {
+					b.Fatalf("downloaded %d bytes, want %d", n, size)
+				}
+			}
+		})
+	}
+}
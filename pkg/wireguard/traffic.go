@@ -0,0 +1,239 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+// trafficStorageKey is the key under which the traffic
+// counters of the peers are persisted in the Caddy storage.
+const trafficStorageKey = "wireguard/traffic.json"
+
+// trafficSaveInterval is the interval at which the
+// traffic counters are persisted.
+const trafficSaveInterval = time.Minute
+
+// BandwidthLimit limits the throughput of a peer. Packets that exceed
+// the limit are dropped, which makes TCP connections back off.
+type BandwidthLimit struct {
+	// The maximum rate of the traffic received from the
+	// peer, in bytes per second. Default: 0 (unlimited)
+	Rx int `json:"rx,omitempty"`
+
+	// The maximum rate of the traffic sent to the peer,
+	// in bytes per second. Default: 0 (unlimited)
+	Tx int `json:"tx,omitempty"`
+
+	// The number of bytes that can be received or sent in a burst
+	// above the rate. It is never less than the maximum packet size.
+	// Default: the number of bytes of one second at the rate
+	Burst int `json:"burst,omitempty"`
+}
+
+// PeerTraffic is the cumulative traffic of a peer.
+type PeerTraffic struct {
+	// The number of bytes received from the peer.
+	RxBytes uint64 `json:"rx_bytes"`
+
+	// The number of bytes sent to the peer.
+	TxBytes uint64 `json:"tx_bytes"`
+}
+
+// peerTraffic counts and limits the traffic of a peer.
+type peerTraffic struct {
+	// accessed atomically, so they come first
+	rxBytes uint64
+	txBytes uint64
+
+	rxLimiter *rate.Limiter
+	txLimiter *rate.Limiter
+}
+
+// validate checks the limits.
+func (l *BandwidthLimit) validate() error {
+	if l.Rx < 0 || l.Tx < 0 || l.Burst < 0 {
+		return fmt.Errorf("bandwidth limits must not be negative")
+	}
+	return nil
+}
+
+// limiter returns a token bucket for the rate, or nil if
+// the rate is unlimited.
+func (l *BandwidthLimit) limiter(bytesPerSecond int) *rate.Limiter {
+	if bytesPerSecond == 0 {
+		return nil
+	}
+	burst := l.Burst
+	if burst == 0 {
+		burst = bytesPerSecond
+	}
+	if burst < maxPacketSize {
+		burst = maxPacketSize
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), burst)
+}
+
+// newPeerTraffic returns the traffic state of a peer, continuing
+// from the stored counters.
+func newPeerTraffic(limit *BandwidthLimit, stored PeerTraffic) *peerTraffic {
+	t := &peerTraffic{
+		rxBytes: stored.RxBytes,
+		txBytes: stored.TxBytes,
+	}
+	if limit != nil {
+		t.rxLimiter = limit.limiter(limit.Rx)
+		t.txLimiter = limit.limiter(limit.Tx)
+	}
+	return t
+}
+
+// receive reports whether a packet of n bytes received from the
+// peer is within the limit, and counts it if it is.
+func (t *peerTraffic) receive(n int) bool {
+	if t.rxLimiter != nil && !t.rxLimiter.AllowN(time.Now(), n) {
+		return false
+	}
+	atomic.AddUint64(&t.rxBytes, uint64(n))
+	return true
+}
+
+// send reports whether a packet of n bytes sent to the
+// peer is within the limit, and counts it if it is.
+func (t *peerTraffic) send(n int) bool {
+	if t.txLimiter != nil && !t.txLimiter.AllowN(time.Now(), n) {
+		return false
+	}
+	atomic.AddUint64(&t.txBytes, uint64(n))
+	return true
+}
+
+// snapshot returns the current counters.
+func (t *peerTraffic) snapshot() PeerTraffic {
+	return PeerTraffic{
+		RxBytes: atomic.LoadUint64(&t.rxBytes),
+		TxBytes: atomic.LoadUint64(&t.txBytes),
+	}
+}
+
+// provisionTraffic loads the stored traffic counters
+// and sets up the traffic state of the peers.
+func (w *WireGuard) provisionTraffic() error {
+	w.storedTraffic = make(map[string]PeerTraffic)
+	storage := w.ctx.Storage()
+	if storage.Exists(w.ctx, trafficStorageKey) {
+		data, err := storage.Load(w.ctx, trafficStorageKey)
+		if err != nil {
+			return fmt.Errorf("loading traffic counters: %v", err)
+		}
+		if err := json.Unmarshal(data, &w.storedTraffic); err != nil {
+			return fmt.Errorf("decoding traffic counters: %v", err)
+		}
+	}
+	for _, p := range w.Peers {
+		w.initTraffic(p)
+	}
+	return nil
+}
+
+// initTraffic sets up the traffic state of a peer.
+func (w *WireGuard) initTraffic(p *Peer) {
+	limit := p.Limit
+	if limit == nil {
+		limit = w.PeerLimit
+	}
+	p.traffic = newPeerTraffic(limit, w.storedTraffic[p.PublicKey])
+}
+
+// receiveAllowed counts a packet received from a peer and
+// reports whether it is within the limits of the peer.
+func (w *WireGuard) receiveAllowed(packet []byte) bool {
+	src, _ := packetAddrs(packet)
+	if src == nil {
+		return true
+	}
+	p := w.peerForIP(src)
+	if p == nil || p.traffic == nil {
+		return true
+	}
+	return p.traffic.receive(len(packet))
+}
+
+// sendAllowed counts a packet to be sent to a peer and
+// reports whether it is within the limits of the peer.
+func (w *WireGuard) sendAllowed(packet []byte) bool {
+	_, dst := packetAddrs(packet)
+	if dst == nil {
+		return true
+	}
+	p := w.peerForIP(dst)
+	if p == nil || p.traffic == nil {
+		return true
+	}
+	return p.traffic.send(len(packet))
+}
+
+// traffic returns the traffic counters of the peers by public key,
+// including the stored counters of peers that are not configured.
+func (w *WireGuard) traffic() map[string]PeerTraffic {
+	w.peersMu.RLock()
+	defer w.peersMu.RUnlock()
+
+	traffic := make(map[string]PeerTraffic, len(w.storedTraffic))
+	for k, t := range w.storedTraffic {
+		traffic[k] = t
+	}
+	for _, p := range w.Peers {
+		if p.traffic != nil {
+			traffic[p.PublicKey] = p.traffic.snapshot()
+		}
+	}
+	return traffic
+}
+
+// saveTraffic persists the traffic counters.
+func (w *WireGuard) saveTraffic() error {
+	data, err := json.Marshal(w.traffic())
+	if err != nil {
+		return fmt.Errorf("encoding traffic counters: %v", err)
+	}
+	if err := w.ctx.Storage().Store(w.ctx, trafficStorageKey, data); err != nil {
+		return fmt.Errorf("storing traffic counters: %v", err)
+	}
+	return nil
+}
+
+// saveTrafficPeriodically persists the traffic counters
+// until the app is stopped.
+func (w *WireGuard) saveTrafficPeriodically() {
+	ticker := time.NewTicker(trafficSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := w.saveTraffic(); err != nil {
+			w.logger.Error("saving traffic counters", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(Transport{})
+}
+
+// Transport is a reverse proxy transport that connects to upstreams
+// through the WireGuard tunnel, so that upstreams that only exist on
+// the overlay network can be proxied to. As the active health checks
+// of the reverse proxy use the transport of the handler, they reach
+// the upstreams through the tunnel as well.
+//
+// It supports the options of the http transport, except for h2c.
+//
+// A connection through the tunnel is only returned once the TCP
+// handshake with the upstream completed, so no part of a request is
+// sent when dialing fails. The reverse proxy of this Caddy version only
+// recognizes the dial errors of its own http transport, though, so it
+// retries requests of which the dial failed like any other failed
+// request: within the try duration, GET requests and requests that are
+// matched by retry_match are retried; other requests are not.
+type Transport struct {
+	reverseproxy.HTTPTransport
+
+	// Fails connections to upstreams that are owned by a peer without
+	// a handshake in this duration, so that the health checks mark
+	// them unhealthy. A handshake is initiated when this happens, so
+	// that a peer that is reachable becomes healthy again at the next
+	// health check. WireGuard renews sessions every two minutes while
+	// there is traffic, so a value like 3m is recommended for peers
+	// that have a persistent keepalive. Default: 0 (disabled)
+	MaxHandshakeAge caddy.Duration `json:"max_handshake_age,omitempty"`
+
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (Transport) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.transport.wireguard",
+		New: func() caddy.Module { return new(Transport) },
+	}
+}
+
+// Provision sets up the transport.
+func (t *Transport) Provision(ctx caddy.Context) error {
+	for _, v := range t.Versions {
+		if v == "h2c" {
+			return fmt.Errorf("h2c is not supported through the tunnel")
+		}
+	}
+	if err := t.HTTPTransport.Provision(ctx); err != nil {
+		return err
+	}
+	t.logger = ctx.Logger(t)
+	t.HTTPTransport.Transport.DialContext = t.dial
+	return nil
+}
+
+// dial connects to the upstream through the tunnel of the running app.
+// It returns when the connection is established or has failed; nothing
+// is sent before that.
+func (t *Transport) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	// the proper dialing information should be embedded into the request's context
+	if dialInfo, ok := reverseproxy.GetDialInfo(ctx); ok {
+		network = dialInfo.Network
+		address = dialInfo.Address
+	}
+
+	app := running()
+	if app == nil || app.tnet == nil {
+		return nil, fmt.Errorf("wireguard app is not running")
+	}
+
+	if t.MaxHandshakeAge > 0 {
+		if err := t.checkHandshake(app, address); err != nil {
+			return nil, err
+		}
+	}
+
+	if t.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(t.DialTimeout))
+		defer cancel()
+	}
+	return app.tnet.DialContext(ctx, network, address)
+}
+
+// checkHandshake returns an error if the upstream at address is owned
+// by a peer without a recent handshake, after initiating a handshake.
+// Upstreams with a hostname or not owned by a peer are not checked.
+func (t *Transport) checkHandshake(app *WireGuard, address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	p := app.peerForIP(ip)
+	if p == nil {
+		return nil
+	}
+
+	last, err := app.lastHandshake(p.PublicKey)
+	if err != nil {
+		return err
+	}
+	if time.Since(last) <= time.Duration(t.MaxHandshakeAge) {
+		return nil
+	}
+
+	if err := app.initiateHandshake(p.PublicKey); err != nil {
+		t.logger.Error("initiating handshake", zap.String("peer", p.PublicKey), zap.Error(err))
+	}
+	if last.IsZero() {
+		return fmt.Errorf("peer %s of upstream %s has no handshake", p.PublicKey, address)
+	}
+	return fmt.Errorf("peer %s of upstream %s has no handshake since %s", p.PublicKey, address, last.Format(time.RFC3339))
+}
+
+// Interface guards
+var (
+	_ caddy.Module              = (*Transport)(nil)
+	_ caddy.Provisioner         = (*Transport)(nil)
+	_ caddy.CleanerUpper        = (*Transport)(nil)
+	_ http.RoundTripper         = (*Transport)(nil)
+	_ reverseproxy.TLSTransport = (*Transport)(nil)
+)
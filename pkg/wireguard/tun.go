@@ -0,0 +1,384 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// tunQueueLen is the number of packets that can be queued
+// for the WireGuard device to read, per queue.
+const tunQueueLen = 256
+
+// tunBatchSize is the number of packets that the WireGuard
+// device reads and writes at once.
+const tunBatchSize = conn.IdealBatchSize
+
+// maxPacketSize is the maximum size of a packet read from the netstack.
+const maxPacketSize = 65535
+
+// tunDevice wraps the netstack TUN device, so that the app can act
+// on the packets that the WireGuard device exchanges with it. Packets
+// written by the WireGuard device, which were received from peers,
+// can be handed back to the WireGuard device to be sent to another
+// peer or dropped by the firewall instead of being delivered to the
+// netstack. The traffic of peers is counted, limited and captured here
+// as well.
+//
+// Packets read from the netstack are queued in one queue per CPU, like
+// the encryption and decryption workers of the WireGuard device. The
+// packets of a flow always go to the same queue, so that they stay in
+// order, and Read takes packets from the queues in turn, so that a batch
+// holds packets of several flows and peers for the workers to encrypt
+// in parallel, instead of a run of packets of the busiest flow. The
+// cost of a read is spread over the packets of a batch.
+type tunDevice struct {
+	tun.Device
+	app *WireGuard
+
+	outbound []chan *packetBuffer // packets read from the netstack, per queue
+	injected chan *packetBuffer   // packets handed back by the app
+	ready    chan struct{}        // signals Read that packets were queued
+	next     int                  // queue that Read takes from first; only used by Read
+	buffers  sync.Pool
+
+	oversized uint64 // accessed atomically
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	overlapMu sync.Mutex
+	overlap   *overlapTUN
+	owners    overlapOwners
+}
+
+// packetBuffer holds a packet that is queued for the WireGuard device.
+// Buffers are reused, so that the packet path doesn't allocate a buffer
+// for every packet.
+type packetBuffer struct {
+	buf []byte
+	n   int
+}
+
+// packet returns the packet in the buffer.
+func (b *packetBuffer) packet() []byte {
+	return b.buf[:b.n]
+}
+
+// getBuffer returns a buffer from the pool that fits size bytes.
+func (t *tunDevice) getBuffer(size int) *packetBuffer {
+	b := t.buffers.Get().(*packetBuffer)
+	if cap(b.buf) < size {
+		b.buf = make([]byte, size)
+	}
+	b.buf = b.buf[:cap(b.buf)]
+	return b
+}
+
+// putBuffer returns the buffer to the pool.
+func (t *tunDevice) putBuffer(b *packetBuffer) {
+	b.n = 0
+	t.buffers.Put(b)
+}
+
+// newTUNDevice wraps dev for the app.
+func newTUNDevice(dev tun.Device, app *WireGuard) *tunDevice {
+	t := &tunDevice{
+		Device:   dev,
+		app:      app,
+		outbound: make([]chan *packetBuffer, runtime.NumCPU()),
+		injected: make(chan *packetBuffer, tunQueueLen),
+		ready:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	for i := range t.outbound {
+		t.outbound[i] = make(chan *packetBuffer, tunQueueLen)
+	}
+	// packets sent by the netstack never exceed its MTU
+	size := maxPacketSize
+	if mtu, err := dev.MTU(); err == nil && mtu > 0 && mtu < size {
+		size = mtu
+	}
+	t.buffers.New = func() interface{} {
+		return &packetBuffer{buf: make([]byte, size)}
+	}
+	go t.readNetstack()
+	return t
+}
+
+// readNetstack reads the packets that the netstack sends and queues
+// them for the WireGuard device, until the netstack is closed.
+func (t *tunDevice) readNetstack() {
+	// the slices of a read are reused, so that reads don't allocate
+	bufs := make([][]byte, 1)
+	sizes := make([]int, 1)
+	for {
+		b := t.getBuffer(0)
+		bufs[0] = b.buf
+		if _, err := t.Device.Read(bufs, sizes, 0); err != nil {
+			t.putBuffer(b)
+			t.closeOnce.Do(func() { close(t.done) })
+			return
+		}
+		b.n = sizes[0]
+		q := t.outbound[flowHash(b.packet())%uint32(len(t.outbound))]
+		select {
+		case q <- b:
+			t.signal()
+		case <-t.done:
+			t.putBuffer(b)
+			return
+		}
+	}
+}
+
+// signal wakes up Read after a packet was queued.
+func (t *tunDevice) signal() {
+	select {
+	case t.ready <- struct{}{}:
+	default:
+	}
+}
+
+// dequeue returns a queued packet without waiting, and whether it was
+// handed back by the app. Injected packets go first; the queues of the
+// netstack are taken from in turn.
+func (t *tunDevice) dequeue() (b *packetBuffer, injected bool) {
+	select {
+	case b = <-t.injected:
+		return b, true
+	default:
+	}
+	for i := 0; i < len(t.outbound); i++ {
+		q := t.outbound[t.next]
+		t.next = (t.next + 1) % len(t.outbound)
+		select {
+		case b = <-q:
+			return b, false
+		default:
+		}
+	}
+	return nil, false
+}
+
+// Read reads the packets to be sent to peers. It waits for the first
+// packet and reads the packets that are queued after it, up to the size
+// of bufs. Packets that exceed the bandwidth limit of the peer are
+// dropped, and so are packets that don't fit in bufs.
+func (t *tunDevice) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	n := 0
+	for n < len(bufs) {
+		b, injected := t.dequeue()
+		if b == nil {
+			if n > 0 {
+				return n, nil
+			}
+			select {
+			case <-t.ready:
+				continue
+			case <-t.done:
+				return 0, os.ErrClosed
+			}
+		}
+		packet := b.packet()
+		if len(packet) > len(bufs[n])-offset {
+			atomic.AddUint64(&t.oversized, 1)
+			t.app.trackConn(packet, true, dropOversized)
+			t.putBuffer(b)
+			continue
+		}
+		if !t.app.sendAllowed(packet) {
+			t.app.trackConn(packet, true, dropBandwidthLimit)
+			t.putBuffer(b)
+			continue
+		}
+		// packets routed between peers are tracked when received
+		if !injected {
+			t.app.trackConn(packet, true, "")
+		}
+		t.app.capture(packet, true)
+		if t.handToOverlap(b) {
+			continue
+		}
+		sizes[n] = copy(bufs[n][offset:], packet)
+		t.putBuffer(b)
+		n++
+	}
+	return n, nil
+}
+
+// BatchSize returns the number of packets that are read at once.
+func (t *tunDevice) BatchSize() int {
+	return tunBatchSize
+}
+
+// handToOverlap hands the packet to the overlap device when its
+// destination is a peer that last sent its packets through the overlap
+// device, and reports whether it did. The overlap device takes
+// ownership of b.
+func (t *tunDevice) handToOverlap(b *packetBuffer) bool {
+	t.overlapMu.Lock()
+	overlap := t.overlap
+	owned := false
+	if overlap != nil {
+		if dst, ok := packetDestination(b.packet()); ok {
+			_, owned = t.owners[dst]
+		}
+	}
+	t.overlapMu.Unlock()
+	if !owned {
+		return false
+	}
+	overlap.hand(b)
+	return true
+}
+
+// setOverlap sets the TUN device of the overlap device, which
+// is nil when there is no overlap device.
+func (t *tunDevice) setOverlap(overlap *overlapTUN) {
+	t.overlapMu.Lock()
+	defer t.overlapMu.Unlock()
+	t.overlap = overlap
+	t.owners = nil
+	if overlap != nil {
+		t.owners = make(overlapOwners)
+	}
+}
+
+// Write handles the packets that were received from peers. Packets
+// that exceed the bandwidth limit of the peer are dropped.
+func (t *tunDevice) Write(bufs [][]byte, offset int) (int, error) {
+	return t.write(bufs, offset, false)
+}
+
+// write handles the packets that were received from peers by the
+// device of the app, or by the overlap device, which the packets for
+// their sources are sent through from then on.
+func (t *tunDevice) write(bufs [][]byte, offset int, fromOverlap bool) (int, error) {
+	t.overlapMu.Lock()
+	if t.overlap != nil {
+		for _, buf := range bufs {
+			src, ok := packetSource(buf[offset:])
+			if !ok {
+				continue
+			}
+			if !fromOverlap {
+				delete(t.owners, src)
+				continue
+			}
+			if len(t.owners) >= maxOverlapOwners {
+				t.owners = make(overlapOwners)
+			}
+			t.owners[src] = struct{}{}
+		}
+	}
+	t.overlapMu.Unlock()
+
+	deliver := bufs[:0:0]
+	for _, buf := range bufs {
+		if t.receive(buf[offset:]) {
+			deliver = append(deliver, buf)
+		}
+	}
+	if len(deliver) > 0 {
+		if _, err := t.Device.Write(deliver, offset); err != nil {
+			return 0, err
+		}
+	}
+	return len(bufs), nil
+}
+
+// receive handles a packet that was received from a peer, and
+// reports whether it should be delivered to the netstack.
+func (t *tunDevice) receive(packet []byte) bool {
+	t.app.capture(packet, false)
+	if !t.app.receiveAllowed(packet) {
+		t.app.trackConn(packet, false, dropBandwidthLimit)
+		return false
+	}
+	if t.app.Hub != nil {
+		if handled, routed := t.app.Hub.route(t.app, packet, t.inject); handled {
+			if routed {
+				t.app.trackConn(packet, false, "")
+			} else {
+				t.app.trackConn(packet, false, dropHub)
+			}
+			return false
+		}
+	}
+	if t.app.Firewall != nil && !t.app.Firewall.accept(t.app, packet) {
+		t.app.trackConn(packet, false, dropFirewall)
+		return false
+	}
+	t.app.trackConn(packet, false, "")
+	return true
+}
+
+// inject queues a copy of the packet to be sent to a peer. The
+// packet is dropped when the queue is full, like a router would.
+func (t *tunDevice) inject(packet []byte) {
+	b := t.getBuffer(len(packet))
+	b.n = copy(b.buf, packet)
+	select {
+	case t.injected <- b:
+		t.signal()
+	default:
+		t.putBuffer(b)
+	}
+}
+
+// flowHash returns a hash of the addresses, protocol and ports of a
+// packet, which selects the queue of its flow.
+func flowHash(packet []byte) uint32 {
+	// FNV-1a
+	h := uint32(2166136261)
+	add := func(b byte) {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+	src, dst := packetAddrs(packet)
+	for _, b := range src {
+		add(b)
+	}
+	for _, b := range dst {
+		add(b)
+	}
+	if protocol, srcPort, dstPort, ok := packetTransport(packet); ok {
+		add(protocol)
+		add(byte(srcPort >> 8))
+		add(byte(srcPort))
+		add(byte(dstPort >> 8))
+		add(byte(dstPort))
+	}
+	return h
+}
+
+// oversizedDropped returns the number of packets that were
+// dropped because they didn't fit in the buffers of a read.
+func (t *tunDevice) oversizedDropped() uint64 {
+	return atomic.LoadUint64(&t.oversized)
+}
+
+// Close closes the netstack TUN device.
+func (t *tunDevice) Close() error {
+	t.closeOnce.Do(func() { close(t.done) })
+	return t.Device.Close()
+}
@@ -0,0 +1,503 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/hslatman/caddy-wireguard/pkg/netstack"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// ipv4Packet returns a UDP packet from src to dst with a payload of size bytes.
+func ipv4Packet(src, dst net.IP, size int) []byte {
+	p := make([]byte, 28+size)
+	p[0] = 0x45
+	binary.BigEndian.PutUint16(p[2:], uint16(len(p)))
+	p[8] = 64
+	p[9] = 17
+	copy(p[12:16], src.To4())
+	copy(p[16:20], dst.To4())
+	binary.BigEndian.PutUint16(p[20:], 40000)
+	binary.BigEndian.PutUint16(p[22:], 9000)
+	binary.BigEndian.PutUint16(p[24:], uint16(8+size))
+	var sum uint32
+	for i := 0; i < 20; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(p[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	binary.BigEndian.PutUint16(p[10:], ^uint16(sum))
+	return p
+}
+
+// packetTUN is a netstack that sends the same packet over and
+// over, and discards the packets that are written to it.
+type packetTUN struct {
+	packet    []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPacketTUN(packet []byte) *packetTUN {
+	return &packetTUN{packet: packet, done: make(chan struct{})}
+}
+
+func (t *packetTUN) File() *os.File                               { return nil }
+func (t *packetTUN) Write(bufs [][]byte, offset int) (int, error) { return len(bufs), nil }
+func (t *packetTUN) MTU() (int, error)                            { return 1420, nil }
+func (t *packetTUN) Name() (string, error)                        { return "packet", nil }
+func (t *packetTUN) Events() <-chan tun.Event                     { return nil }
+func (t *packetTUN) BatchSize() int                               { return 1 }
+
+func (t *packetTUN) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	select {
+	case <-t.done:
+		return 0, os.ErrClosed
+	default:
+	}
+	sizes[0] = copy(bufs[0][offset:], t.packet)
+	return 1, nil
+}
+
+func (t *packetTUN) Close() error {
+	t.closeOnce.Do(func() { close(t.done) })
+	return nil
+}
+
+// queueTUN is a netstack that sends the packets that are
+// queued on it, and discards the packets that are written to it.
+type queueTUN struct {
+	*packetTUN
+	packets chan []byte
+}
+
+func newQueueTUN(packets ...[]byte) *queueTUN {
+	t := &queueTUN{packetTUN: newPacketTUN(nil), packets: make(chan []byte, len(packets))}
+	for _, p := range packets {
+		t.packets <- p
+	}
+	return t
+}
+
+func (t *queueTUN) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	select {
+	case <-t.done:
+		return 0, os.ErrClosed
+	case p := <-t.packets:
+		sizes[0] = copy(bufs[0][offset:], p)
+		return 1, nil
+	}
+}
+
+// testApp returns an app with n peers, which have
+// the addresses 10.0.0.1 and up in 10.0.0.0/8.
+func testApp(n int) *WireGuard {
+	w := &WireGuard{
+		peersMu:  new(sync.RWMutex),
+		captures: &captures{active: make(map[*capture]struct{})},
+	}
+	for i := 1; i <= n; i++ {
+		ip := net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+		p := &Peer{AllowedIPs: []string{ip.String() + "/32"}}
+		if err := p.parseAllowedIPs(); err != nil {
+			panic(err)
+		}
+		w.Peers = append(w.Peers, p)
+	}
+	w.routes = newPeerRoutes(w.Peers)
+	return w
+}
+
+func TestPeerRoutes(t *testing.T) {
+	peer := func(name string, allowedIPs ...string) *Peer {
+		p := &Peer{Name: name, AllowedIPs: allowedIPs}
+		if err := p.parseAllowedIPs(); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	routes := newPeerRoutes([]*Peer{
+		peer("site", "10.1.0.0/16", "fd00:1::/48"),
+		peer("host", "10.1.2.3/32", "fd00:1::3/128"),
+		peer("subnet", "10.1.2.0/24"),
+		peer("same subnet", "10.1.2.0/24"),
+		peer("default", "0.0.0.0/0"),
+	})
+
+	tests := []struct {
+		ip       string
+		want     string
+		wantHost string
+	}{
+		{"10.1.2.3", "host", "host"},
+		{"10.1.2.4", "subnet", ""},
+		{"10.1.3.1", "site", ""},
+		{"192.0.2.1", "default", ""},
+		{"::ffff:10.1.2.3", "host", "host"},
+		{"fd00:1::3", "host", "host"},
+		{"fd00:1::4", "site", ""},
+		{"fd00:2::1", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			got := ""
+			if p := routes.lookup(net.ParseIP(tt.ip)); p != nil {
+				got = p.Name
+			}
+			if got != tt.want {
+				t.Errorf("lookup(%s) = %q, want %q", tt.ip, got, tt.want)
+			}
+			gotHost := ""
+			if p := routes.host(net.ParseIP(tt.ip)); p != nil {
+				gotHost = p.Name
+			}
+			if gotHost != tt.wantHost {
+				t.Errorf("host(%s) = %q, want %q", tt.ip, gotHost, tt.wantHost)
+			}
+		})
+	}
+}
+
+func TestTUNDeviceReadOversized(t *testing.T) {
+	small := ipv4Packet(net.IPv4(10, 255, 0, 1), net.IPv4(10, 0, 0, 1), 100)
+	large := ipv4Packet(net.IPv4(10, 255, 0, 1), net.IPv4(10, 0, 0, 1), 1000)
+	dev := newTUNDevice(newQueueTUN(large, small), testApp(1))
+	defer dev.Close()
+
+	bufs := [][]byte{make([]byte, 512)}
+	sizes := make([]int, 1)
+	n, err := dev.Read(bufs, sizes, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || !bytes.Equal(bufs[0][:sizes[0]], small) {
+		t.Errorf("Read() = %d packets of %d bytes, want the packet of %d bytes", n, sizes[0], len(small))
+	}
+	if got := dev.oversizedDropped(); got != 1 {
+		t.Errorf("oversizedDropped() = %d, want 1", got)
+	}
+}
+
+func TestTUNDeviceReadFlowOrder(t *testing.T) {
+	// packets of two flows, numbered by their size
+	var packets [][]byte
+	for i := 0; i < 50; i++ {
+		packets = append(packets,
+			ipv4Packet(net.IPv4(10, 255, 0, 1), net.IPv4(10, 0, 0, 1), i),
+			ipv4Packet(net.IPv4(10, 255, 0, 1), net.IPv4(10, 0, 0, 2), i))
+	}
+	dev := newTUNDevice(newQueueTUN(packets...), testApp(2))
+	defer dev.Close()
+
+	bufs := make([][]byte, dev.BatchSize())
+	for i := range bufs {
+		bufs[i] = make([]byte, maxPacketSize)
+	}
+	sizes := make([]int, len(bufs))
+	next := make(map[string]int)
+	for read := 0; read < len(packets); {
+		n, err := dev.Read(bufs, sizes, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			_, dst := packetAddrs(bufs[i][:sizes[i]])
+			if got := sizes[i] - 28; got != next[dst.String()] {
+				t.Fatalf("packet %d to %s, want %d", got, dst, next[dst.String()])
+			}
+			next[dst.String()]++
+		}
+		read += n
+	}
+}
+
+func BenchmarkPeerForIP(b *testing.B) {
+	for _, n := range []int{10, 1000} {
+		b.Run(fmt.Sprintf("%d peers", n), func(b *testing.B) {
+			w := testApp(n)
+			ip := net.IPv4(10, 0, 0, byte(n%256))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if w.peerForIP(ip) == nil {
+					b.Fatal("no peer")
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkTUNDeviceRead measures the packets that the device reads
+// from the netstack to send to peers, in batches like the device.
+func BenchmarkTUNDeviceRead(b *testing.B) {
+	packet := ipv4Packet(net.IPv4(10, 255, 0, 1), net.IPv4(10, 0, 0, 1), 1280)
+	t := newTUNDevice(newPacketTUN(packet), testApp(100))
+	defer t.Close()
+
+	bufs := make([][]byte, t.BatchSize())
+	for i := range bufs {
+		bufs[i] = make([]byte, maxPacketSize)
+	}
+	sizes := make([]int, len(bufs))
+	b.SetBytes(int64(len(packet)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for read := 0; read < b.N; {
+		n, err := t.Read(bufs, sizes, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		read += n
+	}
+}
+
+// BenchmarkTUNDeviceWrite measures the packets that the
+// device received from peers and writes to the netstack.
+func BenchmarkTUNDeviceWrite(b *testing.B) {
+	packet := ipv4Packet(net.IPv4(10, 0, 0, 1), net.IPv4(10, 255, 0, 1), 1280)
+	t := newTUNDevice(newPacketTUN(packet), testApp(100))
+	defer t.Close()
+
+	bufs := make([][]byte, tunBatchSize)
+	for i := range bufs {
+		bufs[i] = packet
+	}
+	b.SetBytes(int64(len(packet)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for written := 0; written < b.N; written += len(bufs) {
+		if _, err := t.Write(bufs, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// tunPaths are the packet paths between the netstack and the WireGuard
+// device that are compared: the channel based TUN device of the netstack
+// by itself, and wrapped by the app.
+var tunPaths = []struct {
+	name string
+	wrap func(dev tun.Device) tun.Device
+}{
+	{"netTun", func(dev tun.Device) tun.Device { return dev }},
+	{"tunDevice", func(dev tun.Device) tun.Device { return newTUNDevice(dev, testApp(2)) }},
+}
+
+// BenchmarkTUNPathRead measures the UDP packets that a netstack sends,
+// as the device reads them from its TUN device.
+func BenchmarkTUNPathRead(b *testing.B) {
+	payload := make([]byte, 1280)
+	for _, path := range tunPaths {
+		b.Run(path.name, func(b *testing.B) {
+			nsTUN, tnet, err := netstack.CreateNetTUN([]net.IP{net.IPv4(10, 0, 0, 1)}, nil, 1420)
+			if err != nil {
+				b.Fatal(err)
+			}
+			dev := path.wrap(nsTUN)
+			c, err := tnet.DialUDP(nil, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 9000})
+			if err != nil {
+				b.Fatal(err)
+			}
+			stop, stopped := make(chan struct{}), make(chan struct{})
+			go func() {
+				defer close(stopped)
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					c.Write(payload)
+				}
+			}()
+
+			bufs := make([][]byte, dev.BatchSize())
+			for i := range bufs {
+				bufs[i] = make([]byte, maxPacketSize)
+			}
+			sizes := make([]int, len(bufs))
+			b.SetBytes(int64(28 + len(payload)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for read := 0; read < b.N; {
+				n, err := dev.Read(bufs, sizes, 0)
+				if err != nil {
+					b.Fatal(err)
+				}
+				read += n
+			}
+			b.StopTimer()
+
+			// the netstack blocks while its queue is full, so the
+			// packets are drained until the sender has stopped
+			close(stop)
+			go func() {
+				for {
+					if _, err := dev.Read(bufs, sizes, 0); err != nil {
+						return
+					}
+				}
+			}()
+			<-stopped
+			c.Close()
+			dev.Close()
+		})
+	}
+}
+
+// BenchmarkTUNPathWrite measures the UDP packets that the device
+// received from peers, as it writes them to the netstack.
+func BenchmarkTUNPathWrite(b *testing.B) {
+	serverIP := net.IPv4(10, 0, 0, 1)
+	packet := ipv4Packet(net.IPv4(10, 0, 0, 2), serverIP, 1280)
+	bufs := make([][]byte, tunBatchSize)
+	for i := range bufs {
+		bufs[i] = packet
+	}
+	for _, path := range tunPaths {
+		b.Run(path.name, func(b *testing.B) {
+			nsTUN, tnet, err := netstack.CreateNetTUN([]net.IP{serverIP}, nil, 1420)
+			if err != nil {
+				b.Fatal(err)
+			}
+			dev := path.wrap(nsTUN)
+			defer dev.Close()
+			c, err := tnet.DialUDP(&net.UDPAddr{IP: serverIP, Port: 9000}, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+			go io.Copy(ioutil.Discard, c)
+
+			b.SetBytes(int64(len(packet)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for written := 0; written < b.N; written += len(bufs) {
+				if _, err := dev.Write(bufs, 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// pipeTUNs forwards the packets between the netstacks in both
+// directions, in batches of the size of the devices. The returned
+// function stops forwarding, before the netstacks are closed.
+func pipeTUNs(a, b tun.Device) (stop func()) {
+	var (
+		mu      sync.RWMutex
+		stopped bool
+	)
+	forward := func(from, to tun.Device) {
+		bufs := make([][]byte, from.BatchSize())
+		for i := range bufs {
+			bufs[i] = make([]byte, maxPacketSize)
+		}
+		sizes := make([]int, len(bufs))
+		packets := make([][]byte, len(bufs))
+		for {
+			n, err := from.Read(bufs, sizes, 0)
+			if err != nil {
+				return
+			}
+			for i := 0; i < n; i++ {
+				packets[i] = bufs[i][:sizes[i]]
+			}
+			mu.RLock()
+			if !stopped {
+				to.Write(packets[:n], 0)
+			}
+			mu.RUnlock()
+		}
+	}
+	go forward(a, b)
+	go forward(b, a)
+	return func() {
+		mu.Lock()
+		stopped = true
+		mu.Unlock()
+	}
+}
+
+// BenchmarkTUNPathTCP measures downloads between two netstacks, whose
+// packets go through the packet path on both ends, like iperf.
+func BenchmarkTUNPathTCP(b *testing.B) {
+	const size = 16 << 20
+	for _, path := range tunPaths {
+		b.Run(path.name, func(b *testing.B) {
+			serverIP, clientIP := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+			serverTUN, server, err := netstack.CreateNetTUN([]net.IP{serverIP}, nil, 1420)
+			if err != nil {
+				b.Fatal(err)
+			}
+			serverDev := path.wrap(serverTUN)
+			defer serverDev.Close()
+			clientTUN, client, err := netstack.CreateNetTUN([]net.IP{clientIP}, nil, 1420)
+			if err != nil {
+				b.Fatal(err)
+			}
+			clientDev := path.wrap(clientTUN)
+			defer clientDev.Close()
+			defer pipeTUNs(serverDev, clientDev)()
+
+			l, err := server.ListenTCP(&net.TCPAddr{Port: 8080})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer l.Close()
+			go func() {
+				data := make([]byte, size)
+				for {
+					c, err := l.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						defer c.Close()
+						c.Write(data)
+					}()
+				}
+			}()
+
+			b.SetBytes(size)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c, err := client.DialTCP(&net.TCPAddr{IP: serverIP, Port: 8080})
+				if err != nil {
+					b.Fatal(err)
+				}
+				n, err := io.Copy(ioutil.Discard, c)
+				c.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if n != size {
+					b.Fatalf("downloaded %d bytes, want %d", n, size)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,339 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/hslatman/caddy-wireguard/pkg/wgtest"
+	"github.com/hslatman/caddy-wireguard/pkg/wireguard"
+)
+
+// get returns the body of a successful GET request to url.
+func get(client *http.Client, url string) (string, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d: %s", resp.StatusCode, body)
+	}
+	return string(body), nil
+}
+
+func TestStartInvalidListen(t *testing.T) {
+	// port ranges can't be served on the tunnel
+	h, err := wgtest.Start(wgtest.Config{
+		HTTP: []byte(`{"servers": {"test": {
+			"listen": ["127.0.0.1:23821-23822"],
+			"automatic_https": {"disable": true},
+			"routes": [{"handle": [{"handler": "static_response", "body": "ok"}]}]
+		}}}`),
+	})
+	if err == nil {
+		h.Close()
+		t.Fatal("started with a port range")
+	}
+	if !strings.Contains(err.Error(), "port ranges") {
+		t.Errorf("error = %v, want an error about port ranges", err)
+	}
+}
+
+func TestEnroll(t *testing.T) {
+	h, err := wgtest.Start(wgtest.Config{
+		HTTP: []byte(`{"servers": {"test": {
+			"listen": ["127.0.0.1:23811"],
+			"automatic_https": {"disable": true},
+			"routes": [
+				{"match": [{"path": ["/enroll"]}], "handle": [{"handler": "wireguard_enroll"}]},
+				{"handle": [{"handler": "static_response", "body": "{http.request.remote.host}"}]}
+			]
+		}}}`),
+		WireGuard: func(app *wireguard.WireGuard) {
+			app.Endpoint = "wg.example.com:51820"
+			app.IPAM = &wireguard.IPAM{Subnets: []string{"10.99.0.0/24"}}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	token, err := wireguard.CreateEnrollToken(context.Background(), h.Storage(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, publicKey, err := wireguard.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(map[string]string{"token": token, "public_key": publicKey, "name": "laptop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := h.HTTPClient()
+	client.Timeout = 10 * time.Second
+
+	// invalid requests are refused without using the token
+	for _, invalid := range []string{
+		`{"token": "` + token + `", "public_key": "` + publicKey + `"`,
+		`{"token": "` + token + `", "public_key": "not a key"}`,
+		`{"token": "` + token + `", "public_key": "` + publicKey + `", "name": "Laptop!"}`,
+	} {
+		resp, err := client.Post("http://"+wgtest.ServerIP.String()+":23811/enroll", "application/json", strings.NewReader(invalid))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("enrolling with %s: status %d, want %d", invalid, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+
+	resp, err := client.Post("http://"+wgtest.ServerIP.String()+":23811/enroll", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("enrolling: status %d: %s", resp.StatusCode, config)
+	}
+
+	var address net.IP
+	for _, line := range strings.Split(string(config), "\n") {
+		if s := strings.TrimPrefix(line, "Address = "); s != line {
+			address, _, err = net.ParseCIDR(s)
+			if err != nil {
+				t.Fatalf("invalid address in client config: %v", err)
+			}
+		}
+	}
+	if address == nil {
+		t.Fatalf("client config has no address:\n%s", config)
+	}
+	if address.Equal(wgtest.ServerIP) || address.Equal(wgtest.PeerIP) {
+		t.Fatalf("enrolled peer was assigned %s, which is taken", address)
+	}
+
+	p, ok := wireguard.LookupPeerByPublicKey(publicKey)
+	if !ok || p.Name != "laptop" {
+		t.Fatalf("enrolled peer = %+v, %v", p, ok)
+	}
+
+	// the token can only be used once
+	resp, err = client.Post("http://"+wgtest.ServerIP.String()+":23811/enroll", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("enrolling twice: status %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+
+	// the enrolled peer connects with its own key and address
+	tnet, err := h.Connect(privateKey, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enrolled := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{Dial: tnet.Dial},
+	}
+	got, err := get(enrolled, "http://"+wgtest.ServerIP.String()+":23811/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != address.String() {
+		t.Errorf("remote host = %s, want %s", got, address)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	h, err := wgtest.Start(wgtest.Config{
+		HTTP: []byte(`{"servers": {"test": {
+			"listen": ["127.0.0.1:23812"],
+			"automatic_https": {"disable": true},
+			"routes": [
+				{"match": [{"path": ["/peer"]}], "handle": [{"handler": "wireguard_proxy", "port": 9000, "refresh_interval": "50ms"}]},
+				{"handle": [{"handler": "static_response", "body": "app"}]}
+			]
+		}}}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	l, err := h.Peer.ListenTCP(&net.TCPAddr{IP: wgtest.PeerIP, Port: 9000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "peer")
+	}))
+
+	// the peer only becomes an upstream after a handshake
+	client := h.HTTPClient()
+	client.Timeout = 10 * time.Second
+	if _, err := get(client, "http://"+wgtest.ServerIP.String()+":23812/"); err != nil {
+		t.Fatal(err)
+	}
+
+	host := &http.Client{Timeout: 10 * time.Second}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, err := get(host, "http://127.0.0.1:23812/peer")
+		if err == nil && got == "peer" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("proxying to the peer: got %q, %v", got, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestMatchPeer(t *testing.T) {
+	h, err := wgtest.Start(wgtest.Config{
+		HTTP: []byte(`{"servers": {"test": {
+			"listen": ["127.0.0.1:23814"],
+			"automatic_https": {"disable": true},
+			"routes": [
+				{"match": [{"wireguard_peer": {"tags": {"role": "dev"}}}], "handle": [{"handler": "static_response", "body": "peer"}]},
+				{"handle": [{"handler": "static_response", "body": "other"}]}
+			]
+		}}}`),
+		WireGuard: func(app *wireguard.WireGuard) {
+			app.Peers[0].Tags = map[string]string{"role": "dev"}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	client := h.HTTPClient()
+	client.Timeout = 10 * time.Second
+	got, err := get(client, "http://"+wgtest.ServerIP.String()+":23814/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "peer" {
+		t.Errorf("request through the tunnel: got %q, want %q", got, "peer")
+	}
+
+	// requests on the listeners of the host never come from a peer
+	host := &http.Client{Timeout: 10 * time.Second}
+	got, err = get(host, "http://127.0.0.1:23814/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "other" {
+		t.Errorf("request on the host: got %q, want %q", got, "other")
+	}
+}
+
+func TestKeyRotationOverlap(t *testing.T) {
+	oldKey, oldPublicKey, err := wireguard.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, newPublicKey, err := wireguard.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldIP, newIP := net.IPv4(10, 99, 0, 3), net.IPv4(10, 99, 0, 4)
+
+	h, err := wgtest.Start(wgtest.Config{
+		HTTP: []byte(`{"servers": {"test": {
+			"listen": ["127.0.0.1:23813"],
+			"automatic_https": {"disable": true},
+			"routes": [{"handle": [{"handler": "static_response", "body": "{http.request.remote.host}"}]}]
+		}}}`),
+		WireGuard: func(app *wireguard.WireGuard) {
+			app.KeyRotation = &wireguard.KeyRotation{Interval: caddy.Duration(720 * time.Hour)}
+			app.Peers = append(app.Peers,
+				&wireguard.Peer{PublicKey: oldPublicKey, AllowedIPs: []string{oldIP.String() + "/32"}},
+				&wireguard.Peer{PublicKey: newPublicKey, AllowedIPs: []string{newIP.String() + "/32"}},
+			)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	serverPublicKey, err := wireguard.RotatePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverPublicKey == h.ServerPublicKey {
+		t.Fatal("the private key wasn't rotated")
+	}
+
+	// a peer that still has the previous key of the app is
+	// served by the overlap device, and one with the new key
+	// by the device of the app
+	tests := []struct {
+		name      string
+		publicKey string
+		key       string
+		ip        net.IP
+	}{
+		{"previous key", h.ServerPublicKey, oldKey, oldIP},
+		{"new key", serverPublicKey, newKey, newIP},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h.ServerPublicKey = tc.publicKey
+			tnet, err := h.Connect(tc.key, tc.ip)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := &http.Client{
+				Timeout:   10 * time.Second,
+				Transport: &http.Transport{Dial: tnet.Dial},
+			}
+			got, err := get(client, "http://"+wgtest.ServerIP.String()+":23813/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.ip.String() {
+				t.Errorf("remote host = %s, want %s", got, tc.ip)
+			}
+		})
+	}
+}
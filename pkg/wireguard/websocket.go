@@ -0,0 +1,341 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+)
+
+func init() {
+	caddy.RegisterModule(WebSocketTransport{})
+}
+
+// relayRetryInterval is the interval at which the client
+// reconnects to a WebSocket transport.
+const relayRetryInterval = 5 * time.Second
+
+// WebSocketTransport is an HTTP handler that carries WireGuard
+// datagrams over WebSockets, so that peers behind networks that block
+// UDP can reach the device wherever HTTPS is reachable. Every message
+// is a single datagram, which is handed to the device directly, with
+// the WebSocket as the endpoint of the peer. Peers can roam between
+// WebSockets and UDP like between UDP addresses.
+//
+// WireGuard authenticates the datagrams themselves, so WebSockets
+// aren't authenticated. Messages that aren't WireGuard messages are
+// dropped, the number of concurrent WebSockets is limited and idle
+// WebSockets are closed. Browsers can only open WebSockets from the
+// origins that are allowed, which is the same origin by default.
+//
+// Peers connect to it with a client that does the same on their side,
+// like the app in client mode with a wss:// endpoint.
+type WebSocketTransport struct {
+	// The maximum number of concurrent WebSockets. Default: 1024
+	MaxConnections int `json:"max_connections,omitempty"`
+
+	// The duration after which a WebSocket without datagrams
+	// in either direction is closed. Default: 3m
+	IdleTimeout caddy.Duration `json:"idle_timeout,omitempty"`
+
+	// The origins, like https://example.com, from which browsers are
+	// allowed to open WebSockets, besides the origin of the request.
+	// Default: none
+	AllowedOrigins []string `json:"allowed_origins,omitempty"`
+
+	logger *zap.Logger
+	active int64 // accessed atomically
+}
+
+// CaddyModule returns the Caddy module information.
+func (WebSocketTransport) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.wireguard_transport",
+		New: func() caddy.Module { return new(WebSocketTransport) },
+	}
+}
+
+// Provision sets up the handler.
+func (t *WebSocketTransport) Provision(ctx caddy.Context) error {
+	t.logger = ctx.Logger(t)
+	if t.MaxConnections == 0 {
+		t.MaxConnections = 1024
+	}
+	if t.IdleTimeout == 0 {
+		t.IdleTimeout = caddy.Duration(3 * time.Minute)
+	}
+	return nil
+}
+
+// ServeHTTP upgrades the request to a WebSocket and relays its
+// datagrams to the device until either side closes.
+func (t *WebSocketTransport) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	if r.Method != http.MethodGet {
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+	}
+
+	app := running()
+	if app == nil || app.bind == nil {
+		return caddyhttp.Error(http.StatusServiceUnavailable, fmt.Errorf("WireGuard app is not running"))
+	}
+	if !t.originAllowed(r) {
+		return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("origin not allowed: %s", r.Header.Get("Origin")))
+	}
+	if atomic.AddInt64(&t.active, 1) > int64(t.MaxConnections) {
+		atomic.AddInt64(&t.active, -1)
+		return caddyhttp.Error(http.StatusServiceUnavailable, fmt.Errorf("too many WebSockets"))
+	}
+	defer atomic.AddInt64(&t.active, -1)
+
+	server := websocket.Server{
+		// the origin was checked above
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			t.relay(ws, app.bind, r.RemoteAddr)
+		},
+	}
+	server.ServeHTTP(w, r)
+	return nil
+}
+
+// originAllowed reports whether the request has no Origin header,
+// which browsers always send, or comes from an allowed origin.
+func (t *WebSocketTransport) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if u.Host == r.Host {
+		return true
+	}
+	for _, allowed := range t.AllowedOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// relay hands the datagrams of the WebSocket to the device, which
+// sends its answers on the WebSocket, until either side closes or
+// the WebSocket is idle.
+func (t *WebSocketTransport) relay(ws *websocket.Conn, bind *appBind, remoteAddr string) {
+	defer ws.Close()
+	ws.PayloadType = websocket.BinaryFrame
+	ws.MaxPayloadBytes = maxPacketSize
+
+	idleTimeout := time.Duration(t.IdleTimeout)
+	idle := time.AfterFunc(idleTimeout, func() { ws.Close() })
+	defer idle.Stop()
+
+	var mu sync.Mutex
+	ep := newTransportEndpoint(remoteAddr, func(b []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		idle.Reset(idleTimeout)
+		_, err := ws.Write(b)
+		return err
+	})
+
+	start := time.Now()
+	t.logger.Debug("relay opened", zap.String("remote_addr", remoteAddr))
+
+	for {
+		var datagram []byte
+		if err := websocket.Message.Receive(ws, &datagram); err != nil {
+			break
+		}
+		if !isWireGuardMessage(datagram) {
+			continue
+		}
+		idle.Reset(idleTimeout)
+		bind.deliver(datagram, ep)
+	}
+
+	t.logger.Debug("relay closed",
+		zap.String("remote_addr", remoteAddr),
+		zap.Duration("duration", time.Since(start)),
+	)
+}
+
+// websocketRelay is the client side of a WebSocket transport. It
+// is the endpoint of the remote server on the device, under the URL
+// of the transport, and carries the datagrams of the device over a
+// WebSocket to the server.
+type websocketRelay struct {
+	url    string
+	logger *zap.Logger
+	bind   *appBind
+	ep     *transportEndpoint
+
+	mu      sync.Mutex
+	ws      *websocket.Conn
+	stopped bool
+}
+
+// newWebSocketRelay returns a relay to the wss:// or ws:// URL.
+func newWebSocketRelay(rawURL string) (*websocketRelay, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %v", err)
+	}
+	if (u.Scheme != "wss" && u.Scheme != "ws") || u.Host == "" {
+		return nil, fmt.Errorf("invalid URL %s: must be a wss:// or ws:// URL", rawURL)
+	}
+	return &websocketRelay{url: rawURL}, nil
+}
+
+// isWebSocketURL reports whether the endpoint is a WebSocket URL.
+func isWebSocketURL(endpoint string) bool {
+	return strings.HasPrefix(endpoint, "wss://") || strings.HasPrefix(endpoint, "ws://")
+}
+
+// attach adds the endpoint of the relay to the bind of the
+// device, under the URL of the relay.
+func (r *websocketRelay) attach(bind *appBind, logger *zap.Logger) {
+	r.bind = bind
+	r.logger = logger
+	r.ep = newTransportEndpoint(r.url, r.send)
+	bind.addEndpoint(r.url, r.ep)
+}
+
+// send sends a datagram of the device on the current WebSocket.
+// Datagrams are dropped while there is no WebSocket, and failures
+// are noticed by the reads of the WebSocket.
+func (r *websocketRelay) send(b []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ws != nil {
+		r.ws.Write(b)
+	}
+	return nil
+}
+
+// run relays datagrams until ctx is done, reconnecting
+// to the server when the WebSocket fails.
+func (r *websocketRelay) run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		r.close()
+	}()
+
+	for {
+		ws, err := r.dial()
+		switch {
+		case err != nil:
+			r.logger.Error("connecting to websocket transport", zap.String("url", r.url), zap.Error(err))
+		case !r.connected(ws):
+			ws.Close()
+			return
+		default:
+			r.logger.Info("connected to websocket transport", zap.String("url", r.url))
+			r.readWebSocket(ws)
+			if !r.disconnected(ws) {
+				return
+			}
+			r.logger.Warn("disconnected from websocket transport", zap.String("url", r.url))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(relayRetryInterval):
+		}
+	}
+}
+
+// connected makes ws the current WebSocket, unless the relay
+// was stopped in the meantime.
+func (r *websocketRelay) connected(ws *websocket.Conn) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return false
+	}
+	r.ws = ws
+	return true
+}
+
+// disconnected closes ws, which failed, and reports
+// whether the relay should reconnect.
+func (r *websocketRelay) disconnected(ws *websocket.Conn) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ws.Close()
+	r.ws = nil
+	return !r.stopped
+}
+
+// close stops the relay and closes the current WebSocket.
+func (r *websocketRelay) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopped = true
+	if r.ws != nil {
+		r.ws.Close()
+	}
+}
+
+// dial connects a WebSocket to the server.
+func (r *websocketRelay) dial() (*websocket.Conn, error) {
+	origin := strings.Replace(r.url, "ws", "http", 1)
+	config, err := websocket.NewConfig(r.url, origin)
+	if err != nil {
+		return nil, err
+	}
+	config.Dialer = &net.Dialer{Timeout: resolveTimeout}
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	ws.MaxPayloadBytes = maxPacketSize
+	return ws, nil
+}
+
+// readWebSocket hands the datagrams of the WebSocket
+// to the device, until the WebSocket fails.
+func (r *websocketRelay) readWebSocket(ws *websocket.Conn) {
+	for {
+		var datagram []byte
+		if err := websocket.Message.Receive(ws, &datagram); err != nil {
+			return
+		}
+		r.bind.deliver(datagram, r.ep)
+	}
+}
+
+// Interface guards
+var (
+	_ caddy.Module                = (*WebSocketTransport)(nil)
+	_ caddy.Provisioner           = (*WebSocketTransport)(nil)
+	_ caddyhttp.MiddlewareHandler = (*WebSocketTransport)(nil)
+)
@@ -0,0 +1,197 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// nopBind is a base Bind without sockets, so
+// that only the transports of the app are used.
+type nopBind struct{}
+
+func (nopBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) { return nil, port, nil }
+func (nopBind) Close() error                                         { return nil }
+func (nopBind) SetMark(mark uint32) error                            { return nil }
+func (nopBind) Send(bufs [][]byte, ep conn.Endpoint) error           { return conn.ErrWrongEndpointType }
+func (nopBind) BatchSize() int                                       { return 1 }
+func (nopBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	return nil, fmt.Errorf("no endpoint %s", s)
+}
+
+// receiveDatagram receives a single datagram with fn.
+func receiveDatagram(t *testing.T, fn conn.ReceiveFunc) ([]byte, conn.Endpoint) {
+	t.Helper()
+	type result struct {
+		data []byte
+		ep   conn.Endpoint
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		packets := [][]byte{make([]byte, maxPacketSize)}
+		sizes := make([]int, 1)
+		eps := make([]conn.Endpoint, 1)
+		_, err := fn(packets, sizes, eps)
+		done <- result{packets[0][:sizes[0]], eps[0], err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r.data, r.ep
+	case <-time.After(5 * time.Second):
+		t.Fatal("no datagram received")
+		return nil, nil
+	}
+}
+
+// wireGuardMessage returns a message of the type and size.
+func wireGuardMessage(typ byte, size int) []byte {
+	b := make([]byte, size)
+	b[0] = typ
+	for i := 4; i < size; i++ {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	server := newAppBind(nopBind{})
+	serverFns, _, err := server.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	activeAppMu.Lock()
+	activeApp = &WireGuard{bind: server}
+	activeAppMu.Unlock()
+	defer func() {
+		activeAppMu.Lock()
+		activeApp = nil
+		activeAppMu.Unlock()
+	}()
+
+	transport := &WebSocketTransport{
+		MaxConnections: 1,
+		IdleTimeout:    caddy.Duration(time.Minute),
+		logger:         zap.NewNop(),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := transport.ServeHTTP(w, r, nil); err != nil {
+			herr := err.(caddyhttp.HandlerError)
+			w.WriteHeader(herr.StatusCode)
+		}
+	}))
+	defer srv.Close()
+	wsURL := strings.Replace(srv.URL, "http", "ws", 1) + "/"
+
+	client := newAppBind(nopBind{})
+	clientFns, _, err := client.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	relay, err := newWebSocketRelay(wsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay.attach(client, zap.NewNop())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go relay.run(ctx)
+
+	ep, err := client.ParseEndpoint(wsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	initiation := wireGuardMessage(device.MessageInitiationType, device.MessageInitiationSize)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		relay.mu.Lock()
+		connected := relay.ws != nil
+		relay.mu.Unlock()
+		if connected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("relay didn't connect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// messages that aren't WireGuard messages are dropped
+	if err := client.Send([][]byte{[]byte("not wireguard"), initiation}, ep); err != nil {
+		t.Fatal(err)
+	}
+	got, peer := receiveDatagram(t, serverFns[0])
+	if !bytes.Equal(got, initiation) {
+		t.Fatalf("server received %x, want %x", got, initiation)
+	}
+
+	// the device answers on the WebSocket of the peer
+	response := wireGuardMessage(device.MessageResponseType, device.MessageResponseSize)
+	if err := server.Send([][]byte{response}, peer); err != nil {
+		t.Fatal(err)
+	}
+	got, from := receiveDatagram(t, clientFns[0])
+	if !bytes.Equal(got, response) {
+		t.Fatalf("client received %x, want %x", got, response)
+	}
+	if from.DstToString() != wsURL {
+		t.Errorf("client received from %s, want %s", from.DstToString(), wsURL)
+	}
+
+	// the relay is the only WebSocket allowed
+	if _, err := websocket.Dial(wsURL, "", srv.URL); err == nil {
+		t.Error("opening more WebSockets than allowed succeeded")
+	}
+
+	relay.close()
+	deadline = time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&transport.active) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("WebSocket of the relay wasn't closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// browsers can't open WebSockets from other origins
+	if _, err := websocket.Dial(wsURL, "", "https://example.com"); err == nil {
+		t.Error("opening a WebSocket from another origin succeeded")
+	}
+	ws, err := websocket.Dial(wsURL, "", srv.URL)
+	if err != nil {
+		t.Fatalf("opening a WebSocket after the relay closed: %v", err)
+	}
+	ws.Close()
+}
@@ -15,22 +15,25 @@
 package wireguard
 
 import (
-	b64 "encoding/base64"
-	"encoding/hex"
+	"context"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"go.uber.org/zap"
 
 	"golang.zx2c4.com/wireguard/device"
-	"golang.zx2c4.com/wireguard/tun"
+
+	"github.com/hslatman/caddy-wireguard/pkg/netstack"
 )
 
 func init() {
@@ -45,11 +48,118 @@ func (WireGuard) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
-// WireGuard is an App that ... ;-)
+// WireGuard is an App that runs a userspace WireGuard device
+// with its own TCP/IP stack and serves Caddy on it.
 type WireGuard struct {
-	ctx     caddy.Context
-	logger  *zap.Logger
-	httpApp *caddyhttp.App
+	// The base64 encoded private key of the WireGuard interface.
+	PrivateKey string `json:"private_key,omitempty"`
+
+	// The UDP port to listen on for WireGuard traffic.
+	// Default: 51820
+	ListenPort int `json:"listen_port,omitempty"`
+
+	// The host:port addresses to listen on for WireGuard traffic instead
+	// of the listen port on all interfaces, like the addresses of specific
+	// interfaces of a multihomed host. The device answers from the address
+	// that a peer sent to. Default: the listen port on all interfaces
+	Listen []string `json:"listen,omitempty"`
+
+	// The firewall mark of the packets that the device sends,
+	// for policy routing. Only supported on Linux. Default: none
+	FirewallMark uint32 `json:"fwmark,omitempty"`
+
+	// The name of a Bind that a program embedding Caddy registered
+	// with RegisterBind, which the device uses to send and receive
+	// its datagrams instead of UDP sockets. Default: none
+	Bind string `json:"bind,omitempty"`
+
+	// The IP addresses of the interface on the tunnel network.
+	// Default: 192.168.31.38
+	Addresses []string `json:"addresses,omitempty"`
+
+	// The DNS servers to use inside the tunnel. These are also
+	// handed out to peers in generated client configurations.
+	// Default: 8.8.8.8, 8.8.4.4
+	DNS []string `json:"dns,omitempty"`
+
+	// The MTU of the tunnel interface. Default: 1420
+	MTU int `json:"mtu,omitempty"`
+
+	// Tunes the TCP implementation of the netstack.
+	// Default: the defaults of the netstack
+	TCP *TCPOptions `json:"tcp,omitempty"`
+
+	// The public host:port at which peers can reach this device.
+	// Only used for generating client configurations.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// The peers that are allowed to connect to the device.
+	Peers []*Peer `json:"peers,omitempty"`
+
+	// Automatic assignment of tunnel addresses to peers
+	// that don't have one configured.
+	IPAM *IPAM `json:"ipam,omitempty"`
+
+	// Routes traffic between peers when configured.
+	Hub *Hub `json:"hub,omitempty"`
+
+	// Filters the traffic from peers to the netstack when configured.
+	Firewall *Firewall `json:"firewall,omitempty"`
+
+	// Lets peers use the host as a gateway when configured.
+	ExitNode *ExitNode `json:"exit_node,omitempty"`
+
+	// Rotates the private key and preshared keys on
+	// a schedule when configured.
+	KeyRotation *KeyRotation `json:"key_rotation,omitempty"`
+
+	// Connects the app to a remote WireGuard server when configured.
+	Client *Client `json:"client,omitempty"`
+
+	// Limits the throughput of peers that have no limit
+	// of their own. Default: no limit
+	PeerLimit *BandwidthLimit `json:"peer_limit,omitempty"`
+
+	// Shares a UDP port, like 443, between WireGuard
+	// and HTTP/3 when configured.
+	UDPMux *UDPMux `json:"udp_mux,omitempty"`
+
+	// Logs the TCP and UDP connections with peers when configured.
+	ConnectionLog *ConnectionLog `json:"connection_log,omitempty"`
+
+	ctx       caddy.Context
+	logger    *zap.Logger
+	httpApp   *caddyhttp.App
+	publicKey string
+	addresses []net.IP
+	dns       []net.IP
+	bind      *appBind
+	tunDev    *tunDevice
+	dev       *device.Device
+	overlap   *overlapDevice
+	tnet      *netstack.Net
+	servers   []*http.Server
+	peersMu   *sync.RWMutex
+	routes    *peerRoutes
+	captures  *captures
+
+	storedTraffic map[string]PeerTraffic
+}
+
+// activeApp is the WireGuard app that is currently running. It is used
+// by the admin API and the HTTP handlers, which can't get a reference
+// to the app while it is being provisioned.
+var (
+	activeApp   *WireGuard
+	activeAppMu sync.RWMutex
+)
+
+// running returns the WireGuard app that is currently
+// running, or nil if there is none.
+func running() *WireGuard {
+	activeAppMu.RLock()
+	defer activeAppMu.RUnlock()
+	return activeApp
 }
 
 // Provision sets up the WireGuard app.
@@ -62,167 +172,494 @@ func (w *WireGuard) Provision(ctx caddy.Context) error {
 	}
 	w.httpApp = httpAppIface.(*caddyhttp.App)
 
-	fmt.Println(w.httpApp.Servers)
-	for n, s := range w.httpApp.Servers {
-		fmt.Println(fmt.Sprintf("%s - %#+v", n, s))
-	}
-
 	w.ctx = ctx
 	w.logger = ctx.Logger(w)
 	defer w.logger.Sync()
 
+	w.peersMu = new(sync.RWMutex)
+	w.captures = &captures{active: make(map[*capture]struct{})}
+
+	// in client mode, the port is chosen randomly and the
+	// addresses are assigned by the remote server
+	if w.ListenPort == 0 && w.Client == nil {
+		w.ListenPort = 51820
+	}
+	if len(w.Addresses) == 0 {
+		if w.Client != nil {
+			return fmt.Errorf("client mode requires the addresses assigned by the remote server")
+		}
+		w.Addresses = []string{"192.168.31.38"}
+	}
+	if len(w.DNS) == 0 {
+		w.DNS = []string{"8.8.8.8", "8.8.4.4"}
+	}
+	if w.MTU == 0 {
+		w.MTU = 1420
+	}
+
+	if w.PrivateKey != "" {
+		w.publicKey, err = publicKey(w.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("invalid private key: %v", err)
+		}
+	}
+
+	w.addresses, err = parseIPs(w.Addresses)
+	if err != nil {
+		return fmt.Errorf("invalid address: %v", err)
+	}
+	w.dns, err = parseIPs(w.DNS)
+	if err != nil {
+		return fmt.Errorf("invalid DNS server: %v", err)
+	}
+
+	// restore the peers that were added at runtime
+	stored, err := loadPeers(ctx, ctx.Storage())
+	if err != nil {
+		return err
+	}
+	for _, p := range stored {
+		if w.peer(p.PublicKey) == nil {
+			w.Peers = append(w.Peers, p)
+		}
+	}
+
+	if err := w.provisionPeerExpiry(); err != nil {
+		return err
+	}
+
+	if w.KeyRotation != nil {
+		if err := w.provisionKeyRotation(); err != nil {
+			return fmt.Errorf("provisioning key rotation: %v", err)
+		}
+	}
+
+	if w.IPAM != nil {
+		if err := w.provisionIPAM(); err != nil {
+			return fmt.Errorf("provisioning IPAM: %v", err)
+		}
+	}
+
+	if w.Client != nil {
+		if err := w.Client.provision(); err != nil {
+			return fmt.Errorf("provisioning client: %v", err)
+		}
+	}
+
+	if err := w.provisionTraffic(); err != nil {
+		return err
+	}
+
+	if w.Firewall != nil {
+		if err := w.Firewall.provision(); err != nil {
+			return fmt.Errorf("provisioning firewall: %v", err)
+		}
+	}
+
+	if w.ExitNode != nil {
+		if err := w.ExitNode.provision(w.logger.Named("exit")); err != nil {
+			return fmt.Errorf("provisioning exit node: %v", err)
+		}
+	}
+
+	if w.UDPMux != nil {
+		if err := w.UDPMux.provision(w.logger.Named("mux")); err != nil {
+			return fmt.Errorf("provisioning UDP mux: %v", err)
+		}
+	}
+
+	if w.ConnectionLog != nil {
+		w.ConnectionLog.provision(w.logger.Named("connections"))
+	}
+
+	return nil
+}
+
+// provisionIPAM assigns addresses to the peers that have none
+// configured and reclaims the addresses of removed peers.
+func (w *WireGuard) provisionIPAM() error {
+	configured := make(map[string]bool)
+	static := make(map[string]string)
+	for _, p := range w.Peers {
+		configured[p.PublicKey] = true
+		ips, err := parsePrefixIPs(p.addresses())
+		if err != nil {
+			return err
+		}
+		for _, ip := range ips {
+			if _, ok := static[ip.String()]; !ok {
+				static[ip.String()] = p.PublicKey
+			}
+		}
+	}
+	if err := w.IPAM.provision(w.ctx, w.ctx.Storage(), w.addresses, static); err != nil {
+		return err
+	}
+	if err := w.IPAM.reclaim(func(publicKey string) bool { return configured[publicKey] }); err != nil {
+		return err
+	}
+
+	for _, p := range w.Peers {
+		if len(p.addresses()) > 0 {
+			continue
+		}
+		addrs, err := w.IPAM.assign(p.PublicKey)
+		if err != nil {
+			return fmt.Errorf("assigning addresses to peer %s: %v", p.PublicKey, err)
+		}
+		p.AllowedIPs = append(p.AllowedIPs, addrs...)
+	}
+
 	return nil
 }
 
 // Validate ensures the app's configuration is valid.
 func (w *WireGuard) Validate() error {
+	if w.PrivateKey == "" {
+		return fmt.Errorf("private key is required")
+	}
+	if w.Bind != "" {
+		if _, err := registeredBind(w.Bind); err != nil {
+			return err
+		}
+		if len(w.Listen) > 0 {
+			return fmt.Errorf("a bind can't be combined with listen addresses")
+		}
+	}
+	for _, addr := range w.Listen {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("invalid listen address %s: %v", addr, err)
+		}
+		if host != "" && net.ParseIP(host) == nil {
+			return fmt.Errorf("invalid listen address %s: host must be an IP address", addr)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return fmt.Errorf("invalid listen address %s: invalid port %s", addr, port)
+		}
+	}
+	if w.FirewallMark != 0 && runtime.GOOS != "linux" {
+		return fmt.Errorf("firewall marks are only supported on Linux")
+	}
+	seen := make(map[string]bool)
+	names := make(map[string]bool)
+	for i, p := range w.Peers {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("peer %d: %v", i, err)
+		}
+		if seen[p.PublicKey] {
+			return fmt.Errorf("peer %d: duplicate public key %s", i, p.PublicKey)
+		}
+		seen[p.PublicKey] = true
+		if p.Name != "" {
+			if names[p.Name] {
+				return fmt.Errorf("peer %d: duplicate name %s", i, p.Name)
+			}
+			names[p.Name] = true
+		}
+		ips, err := parsePrefixIPs(p.addresses())
+		if err != nil {
+			return fmt.Errorf("peer %d: %v", i, err)
+		}
+		for _, ip := range ips {
+			for _, a := range w.addresses {
+				if ip.Equal(a) {
+					return fmt.Errorf("peer %d: address %s collides with an address of the interface", i, ip)
+				}
+			}
+		}
+	}
+	if w.Client != nil && seen[w.Client.PublicKey] {
+		return fmt.Errorf("client: public key %s is also configured as a peer", w.Client.PublicKey)
+	}
+	if w.Hub != nil {
+		if err := w.Hub.validate(); err != nil {
+			return fmt.Errorf("hub: %v", err)
+		}
+	}
+	if w.PeerLimit != nil {
+		if err := w.PeerLimit.validate(); err != nil {
+			return fmt.Errorf("peer limit: %v", err)
+		}
+	}
+	if w.ConnectionLog != nil && w.ConnectionLog.MaxConnections < 0 {
+		return fmt.Errorf("connection log: max connections must not be negative")
+	}
+	if w.TCP != nil {
+		if err := w.TCP.validate(); err != nil {
+			return fmt.Errorf("tcp: %v", err)
+		}
+	}
+	if w.KeyRotation != nil {
+		if err := w.KeyRotation.validate(); err != nil {
+			return fmt.Errorf("key rotation: %v", err)
+		}
+		if w.Client != nil && w.KeyRotation.Interval > 0 {
+			return fmt.Errorf("key rotation: the private key can't be rotated in client mode")
+		}
+	}
 	return nil
 }
 
-// Start starts the CrowdSec Caddy app
+// Start starts the WireGuard Caddy app
 func (w *WireGuard) Start() error {
-	tun, tnet, err := tun.CreateNetTUN(
-		[]net.IP{net.ParseIP("192.168.31.38")},
-		[]net.IP{net.ParseIP("8.8.8.8"), net.ParseIP("8.8.4.4")},
-		1420,
-	)
+	tun, tnet, err := netstack.CreateNetTUN(w.addresses, w.dns, w.MTU)
 	if err != nil {
 		w.logger.Error(err.Error())
 		return err
 	}
 
-	fmt.Println(tun, tnet)
-	fmt.Println(fmt.Sprintf("%#+v", tun))
-	fmt.Println(fmt.Sprintf("%#+v", tnet))
-
-	logger := log.New(os.Stderr, "", log.LstdFlags)
-
-	// [Interface]
-	// PrivateKey = 6M8iJ4VMoDpdY3fLw3HEvxqy+9K2Lj6lypGBVx7ooHc=
-	// Address = 192.168.4.6/24
-	// DNS = 8.8.8.8, 8.8.4.4, 1.1.1.1, 1.0.0.1
-
-	// [Peer]
-	// PublicKey = JRI8Xc0zKP9kXk8qP84NdUQA04h6DLfFbwJn4g+/PFs=
-	// Endpoint = demo.wireguard.com:12912
-	// AllowedIPs = 0.0.0.0/0
-
-	publicKeyB64 := "k6z61BBVP8HOyRs63O+TP8SsR936tD3THq0Cpxj+FlE="
-	privateKeyB64 := "6M8iJ4VMoDpdY3fLw3HEvxqy+9K2Lj6lypGBVx7ooHc="
-
-	publicKey, _ := b64.StdEncoding.DecodeString(publicKeyB64)
-	privateKey, _ := b64.StdEncoding.DecodeString(privateKeyB64)
-
-	publicKeyHex := hex.EncodeToString(publicKey)
-	privateKeyHex := hex.EncodeToString(privateKey)
+	if w.TCP != nil {
+		if err := w.TCP.apply(tnet.Stack()); err != nil {
+			tun.Close()
+			return fmt.Errorf("configuring TCP: %v", err)
+		}
+	}
 
-	fmt.Println(publicKeyHex, privateKeyHex)
+	if w.ExitNode != nil {
+		if err := w.ExitNode.start(w, tnet.Stack()); err != nil {
+			tun.Close()
+			return fmt.Errorf("starting exit node: %v", err)
+		}
+	}
 
-	// config := fmt.Sprintf(`
-	// 	private_key=%s
-	// 	public_key=%s
-	// 	endpoint=demo.wireguard.com:12912
-	// 	allowed_ip=0.0.0.0/0
-	// 	persistent_keepalive_interval=25
-	// `, privateKeyHex, publicKeyHex)
+	base, err := w.newBind()
+	if err != nil {
+		tun.Close()
+		return err
+	}
+	w.bind = newAppBind(base)
+	if w.Client != nil && w.Client.relay != nil {
+		w.Client.relay.attach(w.bind, w.logger.Named("relay"))
+	}
 
-	// NOTE: format of the below is SUPER important; it breaks stuff if it isn't correct!
-	// 	config := fmt.Sprintf(`private_key=%s
-	// listen_port=51820
-	// public_key=%s
-	// allowed_ip=0.0.0.0/0
-	// persistent_keepalive_interval=25
-	// `, privateKeyHex, publicKeyHex)
+	w.resolveEndpoints()
+	config, err := w.uapiConfig()
+	if err != nil {
+		tun.Close()
+		return err
+	}
 
-	listenPort := 51820
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	w.peersMu.Lock()
+	w.routes = newPeerRoutes(w.Peers)
+	w.peersMu.Unlock()
+	w.tunDev = newTUNDevice(tun, w)
+	dev := device.NewDevice(w.tunDev, w.bind, &device.Logger{Verbosef: logger.Printf, Errorf: logger.Printf})
+	if err := dev.IpcSet(config); err != nil {
+		dev.Close()
+		return fmt.Errorf("configuring device: %v", err)
+	}
+	dev.Up()
 
-	config := fmt.Sprintf(`private_key=%s
-listen_port=%d
-public_key=%s
-allowed_ip=0.0.0.0/0
-`, privateKeyHex, listenPort, publicKeyHex)
+	w.dev = dev
+	w.tnet = tnet
 
-	fmt.Println(config)
+	if w.KeyRotation != nil && time.Now().Before(w.KeyRotation.state.OverlapUntil) {
+		w.peersMu.Lock()
+		err := w.startOverlap()
+		w.peersMu.Unlock()
+		if err != nil {
+			dev.Close()
+			return err
+		}
+	}
 
-	dev := device.NewDevice(tun, &device.Logger{logger, logger, logger})
-	dev.IpcSet(config)
-	dev.Up()
 	// TODO: mapping from the Caddy listeners to listeners here?
 	// Then do http/l4 proxying?
 
-	fmt.Println(w.httpApp.Servers)
+	listeners := make(map[string]net.Listener)
+	closeListeners := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
 	for n, s := range w.httpApp.Servers {
-		//fmt.Println(fmt.Sprintf("%s - %#+v", n, s))
-		fmt.Println(fmt.Sprintf("serving: %s", n))
-
-		if n == "remaining_auto_https_redirects" {
+		if n == "remaining_auto_https_redirects" || len(s.Listen) == 0 {
 			continue
 		}
-
-		port, _ := strconv.Atoi(strings.Split(s.Listen[0], ":")[1])
-		listener, err := tnet.ListenTCP(&net.TCPAddr{Port: port})
+		addr, err := caddy.ParseNetworkAddress(s.Listen[0])
+		if err == nil && addr.PortRangeSize() > 1 {
+			err = fmt.Errorf("port ranges are not supported on the tunnel")
+		}
+		if err != nil {
+			closeListeners()
+			dev.Close()
+			return fmt.Errorf("listen address of server %s: %v", n, err)
+		}
+		l, err := w.TCP.listen(tnet, int(addr.StartPort))
 		if err != nil {
-			w.logger.Error(err.Error())
+			closeListeners()
+			dev.Close()
+			return fmt.Errorf("listening on tunnel for server %s: %v", n, err)
 		}
+		listeners[n] = l
+	}
 
-		http.HandleFunc("/", s.ServeHTTP)
+	if w.UDPMux != nil {
+		if err := w.UDPMux.start(w, w.bind); err != nil {
+			closeListeners()
+			dev.Close()
+			return fmt.Errorf("starting UDP mux: %v", err)
+		}
+	}
 
-		// http.HandleFunc("/", func(writer http.ResponseWriter, request *http.Request) {
-		// 	w.logger.Info(fmt.Sprintf("> %s - %s - %s", request.RemoteAddr, request.URL.String(), request.UserAgent()))
-		// 	io.WriteString(writer, "Hello from userspace TCP!")
-		// })
+	go w.expirePeers()
+	go w.saveTrafficPeriodically()
+	go w.followEndpoints()
+	if w.Client != nil && w.Client.relay != nil {
+		go w.Client.relay.run(w.ctx)
+	}
+	if w.ConnectionLog != nil {
+		go w.sweepConnectionsPeriodically()
+	}
+	if w.KeyRotation != nil {
+		go w.rotateKeysPeriodically()
+	}
 
-		//s.ServeHTTP()
-		go func() {
-			err = http.Serve(listener, nil)
-			if err != nil {
+	for n, listener := range listeners {
+		w.logger.Debug("serving on tunnel", zap.String("server", n))
+
+		// the server is served with a handler of its own instead of
+		// the default mux, so that the app can be started again in
+		// the same process, like after a reload; its connections are
+		// marked, so that requests through the tunnel can be told
+		// apart from requests on the listeners of the host
+		srv := &http.Server{
+			Handler: w.httpApp.Servers[n],
+			ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+				return context.WithValue(ctx, tunnelConnKey{}, w)
+			},
+		}
+		w.servers = append(w.servers, srv)
+		go func(listener net.Listener) {
+			if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
 				w.logger.Error(err.Error())
 			}
-		}()
-
-	}
-
-	// 	logger := log.New(os.Stderr, "", log.LstdFlags)
-
-	// 	tun, tnet, err := tun.CreateNetTUN(
-	// 		[]net.IP{net.ParseIP("192.168.4.29")},
-	// 		[]net.IP{net.ParseIP("8.8.8.8")},
-	// 		1420)
-	// 	if err != nil {
-	// 		log.Panic(err)
-	// 	}
-	// 	dev := device.NewDevice(tun, &device.Logger{logger, logger, logger})
-	// 	dev.IpcSet(`private_key=a8dac1d8a70a751f0f699fb14ba1cff7b79cf4fbd8f09f44c6e6a90d0369604f
-	// public_key=25123c5dcd3328ff645e4f2a3fce0d754400d3887a0cb7c56f0267e20fbf3c5b
-	// endpoint=163.172.161.0:12912
-	// allowed_ip=0.0.0.0/0
-	// `)
-	// 	dev.Up()
-
-	// 	client := http.Client{
-	// 		Transport: &http.Transport{
-	// 			DialContext: tnet.DialContext,
-	// 		},
-	// 	}
-	// 	resp, err := client.Get("https://www.zx2c4.com/ip")
-	// 	if err != nil {
-	// 		log.Panic(err)
-	// 	}
-	// 	body, err := io.ReadAll(resp.Body)
-	// 	if err != nil {
-	// 		log.Panic(err)
-	// 	}
-	// 	log.Println(string(body))
+		}(listener)
+	}
+
+	activeAppMu.Lock()
+	activeApp = w
+	activeAppMu.Unlock()
 
 	return nil
 }
 
-// Stop stops the CrowdSec Caddy app
+// Stop stops the WireGuard Caddy app
 func (w *WireGuard) Stop() error {
 
+	activeAppMu.Lock()
+	if activeApp == w {
+		activeApp = nil
+	}
+	activeAppMu.Unlock()
+
+	if w.Client != nil && w.Client.relay != nil {
+		w.Client.relay.close()
+	}
+	if w.UDPMux != nil {
+		w.UDPMux.stop()
+	}
+	// the servers on the tunnel get the grace period of the HTTP app
+	ctx := context.Background()
+	if w.httpApp.GracePeriod > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(w.httpApp.GracePeriod))
+		defer cancel()
+	}
+	for _, srv := range w.servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			w.logger.Error("stopping server on tunnel", zap.Error(err))
+		}
+	}
+	w.servers = nil
+	w.peersMu.Lock()
+	w.stopOverlap()
+	w.peersMu.Unlock()
+	if w.dev != nil {
+		w.dev.Close()
+		if err := w.saveTraffic(); err != nil {
+			w.logger.Error("saving traffic counters", zap.Error(err))
+		}
+		if oversized := w.tunDev.oversizedDropped(); oversized > 0 {
+			w.logger.Warn("oversized packets dropped", zap.Uint64("dropped", oversized))
+		}
+	}
+
+	return nil
+}
+
+// uapiConfig returns the configuration of the device and
+// its peers in the format expected by device.IpcSet.
+func (w *WireGuard) uapiConfig() (string, error) {
+	privateKey, err := hexKey(w.PrivateKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid private key: %v", err)
+	}
+
+	// NOTE: format of the below is SUPER important; it breaks stuff if it isn't correct!
+	var b strings.Builder
+	fmt.Fprintf(&b, "private_key=%s\n", privateKey)
+	fmt.Fprintf(&b, "listen_port=%d\n", w.ListenPort)
+	if w.FirewallMark != 0 {
+		fmt.Fprintf(&b, "fwmark=%d\n", w.FirewallMark)
+	}
+	w.peersMu.RLock()
+	defer w.peersMu.RUnlock()
+	for _, p := range w.Peers {
+		if err := p.writeUAPI(&b); err != nil {
+			return "", err
+		}
+	}
+	if w.Client != nil {
+		if err := w.Client.peer.writeUAPI(&b); err != nil {
+			return "", err
+		}
+	}
+
+	return b.String(), nil
+}
+
+// peer returns the configured peer with the given
+// base64 encoded public key, or nil if there is none.
+func (w *WireGuard) peer(publicKey string) *Peer {
+	w.peersMu.RLock()
+	defer w.peersMu.RUnlock()
+	for _, p := range w.Peers {
+		if p.PublicKey == publicKey {
+			return p
+		}
+	}
 	return nil
 }
 
+// parseIPs parses a list of IP addresses.
+func parseIPs(addrs []string) ([]net.IP, error) {
+	ips := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address: %s", a)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// parsePrefixIPs returns the IPs of a list of prefixes in CIDR notation.
+func parsePrefixIPs(prefixes []string) ([]net.IP, error) {
+	ips := make([]net.IP, 0, len(prefixes))
+	for _, p := range prefixes {
+		ip, _, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
 // Interface guards
 var (
 	_ caddy.Module      = (*WireGuard)(nil)